@@ -1,40 +1,73 @@
 package main
 
 import (
+	"context"
 	"os"
+	"time"
 
+	"bytetrade.io/web3os/osnode-init/pkg/admin"
+	"bytetrade.io/web3os/osnode-init/pkg/cmd"
 	controllers "bytetrade.io/web3os/osnode-init/pkg/controller"
 	"bytetrade.io/web3os/osnode-init/pkg/log"
+	"bytetrade.io/web3os/osnode-init/pkg/nonce"
+	"bytetrade.io/web3os/osnode-init/pkg/tracing"
 	"github.com/pkg/errors"
 	"github.com/spf13/pflag"
+	"go.opentelemetry.io/otel/attribute"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/kubernetes"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"k8s.io/utils/clock"
 	ctrl "sigs.k8s.io/controller-runtime"
-	"sigs.k8s.io/controller-runtime/pkg/healthz"
-	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 )
 
 var (
 	logLevel string
 
+	logFormat string
+
+	logComponentLevels string
+
+	logOpts log.Options
+
 	metricsAddr string
 
 	enableLeaderElection bool
 
 	probeAddr string
 
+	gracefulShutdownTimeout time.Duration
+
+	reconcileFailureThreshold time.Duration
+
+	adminAddr string
+
+	adminToken string
+
+	adminTokenReview bool
+
+	adminAllowedGroups []string
+
+	traceOpts tracing.Options
+
+	provisionTargets string
+
+	provisionAllNodes bool
+
+	dirTemplates string
+
+	hostPrerequisites string
+
+	dataMigration string
+
 	scheme = runtime.NewScheme()
 )
 
 func init() {
 	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
 
-	opts := zap.Options{
-		Development: true,
-	}
-	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
-
 	//+kubebuilder:scaffold:scheme
 }
 
@@ -51,6 +84,8 @@ func run() error {
 		HealthProbeBindAddress: probeAddr,
 		LeaderElection:         enableLeaderElection,
 		LeaderElectionID:       "77yco38a.bytetrade.io",
+		// bounds how long a refresh that is being cancelled may take to stop
+		GracefulShutdownTimeout: &gracefulShutdownTimeout,
 		// LeaderElectionReleaseOnCancel defines if the leader should step down voluntarily
 		// when the Manager ends. This requires the binary to immediately end when the
 		// Manager is stopped, otherwise, this setting is unsafe. Setting this significantly
@@ -67,46 +102,193 @@ func run() error {
 		return errors.Errorf("new manager: %v", err)
 	}
 
-	if err = mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
-		return errors.Errorf("unable to set up health check: %v", err)
+	nodeInitController := controllers.NewNodeInitController(mgr.GetClient(), mgr.GetScheme(), c)
+	if err = nodeInitController.SetupWithManager(mgr); err != nil {
+		return errors.Errorf("unable to create nodeInitController: %v", err)
 	}
-	if err = mgr.AddReadyzCheck("readyz", healthz.Ping); err != nil {
-		return errors.Errorf("unable to setup ready check: %v", err)
+
+	if err = nodeInitController.AddHealthChecks(mgr, controllers.HealthOptions{
+		ReconcileFailureThreshold: reconcileFailureThreshold,
+	}); err != nil {
+		return errors.Errorf("unable to set up health checks: %v", err)
 	}
 
-	if err = controllers.NewNodeInitController(mgr.GetClient(), mgr.GetScheme(), c).
-		SetupWithManager(mgr); err != nil {
-		return errors.Errorf("unable to create nodeInitController: %v", err)
+	if err = setupAdminServer(mgr, c, nodeInitController); err != nil {
+		return errors.Errorf("unable to set up admin api: %v", err)
 	}
 
 	log.Info("starting manager")
 
-	if err = mgr.Start(ctrl.SetupSignalHandler()); err != nil {
+	ctx := ctrl.SetupSignalHandler()
+	log.HandleSignals(ctx)
+
+	traceOpts.Attributes = append(traceOpts.Attributes, attribute.String("node", controllers.NodeIP))
+	shutdownTracing, err := tracing.Init(ctx, traceOpts)
+	if err != nil {
+		return errors.Errorf("unable to set up tracing: %v", err)
+	}
+	defer func() {
+		flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(flushCtx); err != nil {
+			log.Warnf("flush traces: %v", err)
+		}
+	}()
+
+	if err = mgr.Start(ctx); err != nil {
 		return errors.Errorf("start manager: %v", err)
 	}
 
 	return nil
 }
 
+func setupAdminServer(mgr ctrl.Manager, c *rest.Config, controller admin.Controller) error {
+	if adminAddr == "" {
+		return nil
+	}
+
+	opts := admin.Options{
+		BindAddress:   adminAddr,
+		Token:         adminToken,
+		AllowedGroups: adminAllowedGroups,
+	}
+	if adminTokenReview {
+		kubeClient, err := kubernetes.NewForConfig(c)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		opts.KubeClient = kubeClient
+	}
+	if opts.Token == "" && opts.KubeClient == nil {
+		log.Warn("no admin token configured and token review disabled, admin api is not served")
+		return nil
+	}
+
+	server, err := admin.NewServer(opts, controller)
+	if err != nil {
+		return err
+	}
+	server.Handle("/api/v1/loglevel", log.LevelHandler())
+	return mgr.Add(server)
+}
+
 func main() {
+	if len(os.Args) > 1 && cmd.IsCommand(os.Args[1]) {
+		os.Exit(cmd.Execute(os.Args[1], os.Args[2:]))
+	}
+
 	pflag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	pflag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
+	pflag.DurationVar(&reconcileFailureThreshold, "reconcile-failure-threshold", 10*time.Minute,
+		"How long reconciling a user namespace may keep failing before the pod is not ready, 0 to disable.")
+	pflag.DurationVar(&gracefulShutdownTimeout, "graceful-shutdown-timeout", 30*time.Second,
+		"How long to wait for the refresh job and the admin api to stop on shutdown.")
 	pflag.BoolVar(&enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
 
+	pflag.StringVar(&adminAddr, "admin-bind-address", "127.0.0.1:8082",
+		"The address the admin api binds to, empty to disable it.")
+	pflag.StringVar(&adminToken, "admin-token", os.Getenv("ADMIN_TOKEN"),
+		"Static bearer token of the admin api, defaults to $ADMIN_TOKEN.")
+	pflag.BoolVar(&adminTokenReview, "admin-token-review", false,
+		"Authenticate admin api requests with Kubernetes TokenReview.")
+	pflag.StringSliceVar(&adminAllowedGroups, "admin-allowed-groups", []string{"system:masters"},
+		"Groups allowed to use the admin api when authenticated by TokenReview.")
+
 	pflag.StringVarP(&logLevel, "log-level", "l", "debug", "log level")
+	pflag.StringVar(&logFormat, "log-format", log.FormatConsole, "log format, console or json")
+	pflag.StringVar(&logComponentLevels, "log-component-levels", "",
+		"per component log levels, e.g. cloud=debug,filesystem=warn")
+	pflag.StringVar(&logOpts.File, "log-file", "",
+		"also write logs to this file with rotation, e.g. /olares/var/log/osnode-init/osnode-init.log")
+	pflag.IntVar(&logOpts.FileMaxSizeMB, "log-file-max-size", 100, "max size in MB of the log file before rotation")
+	pflag.IntVar(&logOpts.FileMaxBackups, "log-file-max-backups", 5, "rotated log files to keep")
+	pflag.IntVar(&logOpts.FileMaxAgeDays, "log-file-max-age", 7, "days to keep rotated log files")
+	pflag.StringVar(&traceOpts.Endpoint, "otlp-endpoint", "",
+		"OTLP/HTTP collector for traces, e.g. localhost:4318, defaults to $"+tracing.EnvEndpoint+", tracing is off without either")
+	pflag.BoolVar(&traceOpts.Insecure, "otlp-insecure", true, "send traces to the collector over plain HTTP")
+	pflag.Float64Var(&traceOpts.SampleRatio, "trace-sample-ratio", 1, "ratio of reconciles and rotations to trace")
+	pflag.StringVar(&provisionTargets, "provision-targets", os.Getenv(controllers.EnvProvisionTargets),
+		"JSON file with the objects whose data dirs are provisioned, replaces the built in bfl target")
+	pflag.BoolVar(&provisionAllNodes, "provision-all-nodes", os.Getenv("PROVISION_ALL_NODES") == "true",
+		"provision every target object on this node, even where its pods cannot be scheduled")
+	pflag.StringVar(&dirTemplates, "dir-templates", os.Getenv(controllers.EnvDirTemplates),
+		"JSON file with the templates new user data dirs are seeded from")
+	pflag.StringVar(&hostPrerequisites, "host-prerequisites", os.Getenv(controllers.EnvHostPrerequisites),
+		"JSON file with the sysctls and kernel modules every node needs, none are applied without it")
+	pflag.StringVar(&dataMigration, "data-migration", controllers.MigrationOff,
+		"what to do with data when the hostpath annotations of a target object change: off, copy or move")
+	applyHostFlags := cmd.AddHostFlags(pflag.CommandLine)
 	pflag.Parse()
 
-	log.InitLog(logLevel)
-
+	// the node is on every line, the controller-runtime and klog ones too
 	hostIP := os.Getenv("NODE_IP")
+	logOpts.Level, logOpts.Format = logLevel, logFormat
+	if hostIP != "" {
+		logOpts.Fields = []any{"node", hostIP}
+	}
+	log.Init(logOpts)
+	ctrl.SetLogger(log.Logr())
+	if err := log.SetComponentLevels(logComponentLevels); err != nil {
+		log.Errorf("%v", err)
+		os.Exit(1)
+	}
+
 	if hostIP == "" {
 		log.Errorf("no env 'NODE_IP' provided")
 		os.Exit(1)
 	}
 	controllers.NodeIP = hostIP
 
+	if err := applyHostFlags(); err != nil {
+		log.Errorf("%v", err)
+		os.Exit(1)
+	}
+	for _, m := range controllers.HostPaths.Mounts() {
+		log.Infof("host dir %s is mounted at %s", m.Host, m.Local)
+	}
+
+	controllers.ProvisionAllNodes = provisionAllNodes
+
+	// before the templates, which are checked against the sub dirs
+	if provisionTargets != "" {
+		if err := controllers.LoadProvisionTargets(provisionTargets); err != nil {
+			log.Errorf("load provisioning targets: %v", err)
+			os.Exit(1)
+		}
+	}
+
+	if dirTemplates != "" {
+		if err := controllers.LoadDirTemplates(dirTemplates); err != nil {
+			log.Errorf("load data dir templates: %v", err)
+			os.Exit(1)
+		}
+	}
+
+	switch dataMigration {
+	case controllers.MigrationOff, controllers.MigrationCopy, controllers.MigrationMove:
+		controllers.DataMigrationMode = dataMigration
+	default:
+		log.Errorf("invalid --data-migration %q, want off, copy or move", dataMigration)
+		os.Exit(1)
+	}
+
+	if hostPrerequisites != "" {
+		if err := controllers.LoadHostPrerequisites(hostPrerequisites); err != nil {
+			log.Errorf("load host prerequisites: %v", err)
+			os.Exit(1)
+		}
+	}
+
+	if err := controllers.SetupTerminusNonce(clock.RealClock{}); err != nil {
+		if !errors.Is(err, nonce.ErrMissingKey) {
+			log.Errorf("invalid terminus nonce key: %v", err)
+			os.Exit(1)
+		}
+		log.Warnf("%v, olares space account of the owner will not be fetched", err)
+	}
+
 	if err := run(); err != nil {
 		log.Errorf("%+v", err)
 		os.Exit(1)
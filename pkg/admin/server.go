@@ -0,0 +1,263 @@
+// Package admin serves a small authenticated HTTP API for support engineers
+// to inspect what osnode-init did on a node and to trigger work on demand.
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	controllers "bytetrade.io/web3os/osnode-init/pkg/controller"
+	"bytetrade.io/web3os/osnode-init/pkg/log"
+	"github.com/pkg/errors"
+	authnv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/kubernetes"
+)
+
+// maxManifestSize bounds the manifest a restore request may send.
+const maxManifestSize = 8 << 20
+
+// Controller is what the API needs from the node init controller.
+type Controller interface {
+	Status() controllers.Status
+	TriggerProvision(ctx context.Context, namespace string) ([]*controllers.ProvisionResult, error)
+	TriggerRefresh(ctx context.Context) (*controllers.RefreshResult, error)
+	ExportManifest(ctx context.Context) (*controllers.Manifest, error)
+	RestoreManifest(ctx context.Context, m *controllers.Manifest, opts controllers.RestoreOptions) (*controllers.RestoreResult, error)
+}
+
+type Options struct {
+	// BindAddress to listen on, keep it on loopback unless protected by
+	// TokenReview.
+	BindAddress string
+
+	// Token is a static bearer token accepted by the API.
+	Token string
+
+	// KubeClient enables Kubernetes TokenReview authentication when set,
+	// accepting users in one of AllowedGroups.
+	KubeClient    kubernetes.Interface
+	AllowedGroups []string
+}
+
+// Server is a manager.Runnable serving the admin API.
+type Server struct {
+	opts       Options
+	controller Controller
+	mux        *http.ServeMux
+}
+
+func NewServer(opts Options, controller Controller) (*Server, error) {
+	if opts.Token == "" && opts.KubeClient == nil {
+		return nil, errors.New("admin api needs a token or token review to authenticate requests")
+	}
+
+	s := &Server{opts: opts, controller: controller, mux: http.NewServeMux()}
+	s.mux.HandleFunc("/api/v1/status", s.handleStatus)
+	s.mux.HandleFunc("/api/v1/provision", s.handleProvision)
+	s.mux.HandleFunc("/api/v1/refresh", s.handleRefresh)
+	s.mux.HandleFunc("/api/v1/manifest", s.handleManifest)
+	s.mux.HandleFunc("/api/v1/manifest/restore", s.handleRestore)
+	return s, nil
+}
+
+// Handle registers an additional authenticated handler.
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
+// NeedLeaderElection lets every replica serve its own node.
+func (s *Server) NeedLeaderElection() bool {
+	return false
+}
+
+func (s *Server) Start(ctx context.Context) error {
+	ln, err := net.Listen("tcp", s.opts.BindAddress)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	srv := &http.Server{
+		Handler:           s.authenticate(s.mux),
+		ReadHeaderTimeout: 10 * time.Second,
+		// a shutdown cancels the refresh or provisioning a request runs
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			log.Errorf("shutdown admin api: %v", err)
+		}
+	}()
+
+	log.Infof("serving admin api on %s", ln.Addr())
+	if err = srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	allowed := sets.NewString(s.opts.AllowedGroups...)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" || token == r.Header.Get("Authorization") {
+			writeError(w, http.StatusUnauthorized, errors.New("bearer token required"))
+			return
+		}
+
+		if s.opts.Token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(s.opts.Token)) == 1 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if s.opts.KubeClient != nil {
+			review, err := s.opts.KubeClient.AuthenticationV1().TokenReviews().Create(r.Context(),
+				&authnv1.TokenReview{Spec: authnv1.TokenReviewSpec{Token: token}}, metav1.CreateOptions{})
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+			if review.Status.Authenticated {
+				if !allowed.HasAny(review.Status.User.Groups...) {
+					writeError(w, http.StatusForbidden, errors.Errorf("%q is not in an allowed group", review.Status.User.Username))
+					return
+				}
+				log.Infof("admin api %s %s by %q", r.Method, r.URL.Path, review.Status.User.Username)
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		writeError(w, http.StatusUnauthorized, errors.New("invalid bearer token"))
+	})
+}
+
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	status := s.controller.Status()
+	if ns := r.URL.Query().Get("namespace"); ns != "" {
+		var filtered []controllers.NamespaceStatus
+		for _, n := range status.Namespaces {
+			if n.Namespace == ns {
+				filtered = append(filtered, n)
+			}
+		}
+		status.Namespaces = filtered
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+func (s *Server) handleProvision(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	namespace := r.URL.Query().Get("namespace")
+	if namespace == "" {
+		writeError(w, http.StatusBadRequest, errors.New("namespace is required"))
+		return
+	}
+
+	log.Infof("admin api triggers provisioning of %q", namespace)
+	results, err := s.controller.TriggerProvision(r.Context(), namespace)
+	if err != nil && results == nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, results)
+		return
+	}
+	writeJSON(w, http.StatusOK, results)
+}
+
+func (s *Server) handleRefresh(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	log.Info("admin api triggers credential refresh")
+	result, err := s.controller.TriggerRefresh(r.Context())
+	if err != nil {
+		if result == nil {
+			writeError(w, http.StatusConflict, err)
+			return
+		}
+		writeJSON(w, http.StatusInternalServerError, result)
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (s *Server) handleManifest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	m, err := s.controller.ExportManifest(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, m)
+}
+
+func (s *Server) handleRestore(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	var m controllers.Manifest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxManifestSize)).Decode(&m); err != nil {
+		writeError(w, http.StatusBadRequest, errors.Errorf("decode manifest: %v", err))
+		return
+	}
+	query := r.URL.Query()
+	opts := controllers.RestoreOptions{
+		DryRun:    query.Get("dryRun") == "true",
+		AnyNode:   query.Get("anyNode") == "true",
+		Namespace: query.Get("namespace"),
+	}
+
+	log.Infof("admin api restores a manifest of %d dirs from node %s, dry run: %v", len(m.Dirs), m.Node, opts.DryRun)
+	result, err := s.controller.RestoreManifest(r.Context(), &m, opts)
+	if err != nil {
+		if result == nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, http.StatusInternalServerError, result)
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorf("write admin api response: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
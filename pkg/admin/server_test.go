@@ -0,0 +1,120 @@
+package admin
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	controllers "bytetrade.io/web3os/osnode-init/pkg/controller"
+	authnv1 "k8s.io/api/authentication/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+type fakeController struct {
+	restored int
+}
+
+func (f *fakeController) Status() controllers.Status { return controllers.Status{} }
+
+func (f *fakeController) TriggerProvision(context.Context, string) ([]*controllers.ProvisionResult, error) {
+	return nil, nil
+}
+
+func (f *fakeController) TriggerRefresh(context.Context) (*controllers.RefreshResult, error) {
+	return &controllers.RefreshResult{}, nil
+}
+
+func (f *fakeController) ExportManifest(context.Context) (*controllers.Manifest, error) {
+	return &controllers.Manifest{}, nil
+}
+
+func (f *fakeController) RestoreManifest(context.Context, *controllers.Manifest, controllers.RestoreOptions) (*controllers.RestoreResult, error) {
+	f.restored++
+	return &controllers.RestoreResult{}, nil
+}
+
+// tokenReviewer accepts the tokens "admin" and "viewer", of which only the
+// first is in the allowed group.
+func tokenReviewer() *fake.Clientset {
+	client := fake.NewSimpleClientset()
+	client.PrependReactor("create", "tokenreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authnv1.TokenReview)
+		switch review.Spec.Token {
+		case "admin":
+			review.Status = authnv1.TokenReviewStatus{Authenticated: true,
+				User: authnv1.UserInfo{Username: "admin", Groups: []string{"system:masters"}}}
+		case "viewer":
+			review.Status = authnv1.TokenReviewStatus{Authenticated: true,
+				User: authnv1.UserInfo{Username: "viewer", Groups: []string{"system:authenticated"}}}
+		}
+		return true, review, nil
+	})
+	return client
+}
+
+func TestServerAuthentication(t *testing.T) {
+	s, err := NewServer(Options{Token: "static", KubeClient: tokenReviewer(),
+		AllowedGroups: []string{"system:masters"}}, &fakeController{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := s.authenticate(s.mux)
+
+	for _, tc := range []struct {
+		name, authorization string
+		code                int
+	}{
+		{"no token", "", http.StatusUnauthorized},
+		{"not bearer", "Basic static", http.StatusUnauthorized},
+		{"wrong token", "Bearer wrong", http.StatusUnauthorized},
+		{"static token", "Bearer static", http.StatusOK},
+		{"group not allowed", "Bearer viewer", http.StatusForbidden},
+		{"allowed group", "Bearer admin", http.StatusOK},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/status", nil)
+		if tc.authorization != "" {
+			req.Header.Set("Authorization", tc.authorization)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tc.code {
+			t.Errorf("%s: status %d, want %d, %s", tc.name, rec.Code, tc.code, rec.Body)
+		}
+	}
+}
+
+func TestServerRequests(t *testing.T) {
+	controller := &fakeController{}
+	s, err := NewServer(Options{Token: "static"}, controller)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := s.authenticate(s.mux)
+
+	for _, tc := range []struct {
+		name, method, path, body string
+		code                     int
+	}{
+		{"status by post", http.MethodPost, "/api/v1/status", "", http.StatusMethodNotAllowed},
+		{"refresh by get", http.MethodGet, "/api/v1/refresh", "", http.StatusMethodNotAllowed},
+		{"restore by get", http.MethodGet, "/api/v1/manifest/restore", "", http.StatusMethodNotAllowed},
+		{"oversized manifest", http.MethodPost, "/api/v1/manifest/restore",
+			`{"node":"` + strings.Repeat("x", maxManifestSize) + `"}`, http.StatusBadRequest},
+		{"restore", http.MethodPost, "/api/v1/manifest/restore", `{"version":1,"dirs":[]}`, http.StatusOK},
+	} {
+		req := httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body))
+		req.Header.Set("Authorization", "Bearer static")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tc.code {
+			t.Errorf("%s: status %d, want %d, %s", tc.name, rec.Code, tc.code, rec.Body)
+		}
+	}
+	if controller.restored != 1 {
+		t.Fatalf("%d manifests restored, want only the one within the size limit", controller.restored)
+	}
+}
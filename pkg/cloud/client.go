@@ -0,0 +1,333 @@
+package cloud
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"bytetrade.io/web3os/osnode-init/pkg/tracing"
+	"github.com/go-resty/resty/v2"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.uber.org/zap"
+)
+
+const (
+	DefaultBaseURL = "https://cloud-api.bttcdn.com"
+
+	// EnvBaseURL overrides DefaultBaseURL, e.g. to point at a dev Space.
+	EnvBaseURL = "OLARES_SPACE_URL"
+
+	HeaderRequestID  = "X-Request-ID"
+	HeaderRetryAfter = "Retry-After"
+
+	DefaultTokenDuration = 12 * time.Hour
+
+	setupSTSTokenPath    = "/v1/resource/stsToken/setup"
+	registerIdentityPath = "/v1/resource/cluster/identity/register"
+)
+
+// Client talks to the Olares Space cloud API.
+type Client struct {
+	baseURL string
+	http    *resty.Client
+	logger  *zap.SugaredLogger
+
+	identity *Identity
+
+	maxRetries   int
+	retryWait    time.Duration
+	retryMaxWait time.Duration
+}
+
+type Option func(*Client)
+
+func WithBaseURL(url string) Option {
+	return func(c *Client) {
+		if url != "" {
+			c.baseURL = strings.TrimSuffix(url, "/")
+		}
+	}
+}
+
+// WithHTTPClient replaces the underlying transport, mostly for tests.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) {
+		c.http = resty.NewWithClient(hc)
+	}
+}
+
+func WithTimeout(timeout time.Duration) Option {
+	return func(c *Client) {
+		c.http.SetTimeout(timeout)
+	}
+}
+
+// WithRetry sets how many times a retryable failure is repeated and the
+// exponential backoff bounds between attempts.
+func WithRetry(maxRetries int, wait, maxWait time.Duration) Option {
+	return func(c *Client) {
+		c.maxRetries, c.retryWait, c.retryMaxWait = maxRetries, wait, maxWait
+	}
+}
+
+// WithIdentity signs every request with the cluster key, and once the
+// identity is registered, rejects responses not signed by Space.
+func WithIdentity(identity *Identity) Option {
+	return func(c *Client) {
+		c.identity = identity
+	}
+}
+
+func WithLogger(logger *zap.SugaredLogger) Option {
+	return func(c *Client) {
+		if logger != nil {
+			c.logger = logger
+		}
+	}
+}
+
+// NewClient builds a Space client, the base URL defaults to $OLARES_SPACE_URL
+// or DefaultBaseURL.
+func NewClient(opts ...Option) *Client {
+	c := &Client{
+		baseURL:      DefaultBaseURL,
+		http:         resty.New(),
+		logger:       zap.NewNop().Sugar(),
+		maxRetries:   5,
+		retryWait:    30 * time.Second,
+		retryMaxWait: 180 * time.Second,
+	}
+	if v := os.Getenv(EnvBaseURL); v != "" {
+		c.baseURL = strings.TrimSuffix(v, "/")
+	}
+	c.http.SetTimeout(15 * time.Second)
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	tracing.InjectResty(c.http)
+	if c.identity != nil {
+		c.http.SetPreRequestHook(func(_ *resty.Client, req *http.Request) error {
+			return c.identity.sign(req, time.Now())
+		})
+	}
+	return c
+}
+
+func (c *Client) BaseURL() string {
+	return c.baseURL
+}
+
+// SetupSTSToken requests a fresh session token for the cluster bucket.
+func (c *Client) SetupSTSToken(ctx context.Context, req *STSTokenRequest) (*AWSAccount, error) {
+	if req.ClusterID == "" {
+		return nil, fmt.Errorf("cluster id is required: %w", ErrInvalidCluster)
+	}
+
+	var account *AWSAccount
+	err := c.do(ctx, "setup sts token", func(r *resty.Request) (*resty.Response, error) {
+		return r.SetFormData(req.formData()).Post(c.baseURL + setupSTSTokenPath)
+	}, func(body []byte) (*Header, error) {
+		var resp AWSAccountResponse
+		if err := json.Unmarshal(body, &resp); err != nil {
+			return nil, err
+		}
+		account = resp.Data
+		return &resp.Header, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if account == nil {
+		return nil, ErrEmptyData
+	}
+	return account, nil
+}
+
+// RegisterIdentity registers the client identity with Space and returns
+// the Space public key to pin for response verification.
+func (c *Client) RegisterIdentity(ctx context.Context, req *RegisterIdentityRequest) (ed25519.PublicKey, error) {
+	if req.Identity == nil || req.Identity.ClusterID == "" {
+		return nil, fmt.Errorf("cluster id is required: %w", ErrInvalidCluster)
+	}
+
+	var spaceKey string
+	err := c.do(ctx, "register identity", func(r *resty.Request) (*resty.Response, error) {
+		return r.SetFormData(req.formData()).Post(c.baseURL + registerIdentityPath)
+	}, func(body []byte) (*Header, error) {
+		var resp RegisterIdentityResponse
+		if err := json.Unmarshal(body, &resp); err != nil {
+			return nil, err
+		}
+		if resp.Data != nil {
+			spaceKey = resp.Data.SpacePublicKey
+		}
+		return &resp.Header, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if spaceKey == "" {
+		return nil, ErrEmptyData
+	}
+	return ParseSpacePublicKey(spaceKey)
+}
+
+// do runs one logical request, retrying transient failures with backoff
+// until ctx is done. decode must return the response envelope.
+func (c *Client) do(ctx context.Context, op string,
+	send func(*resty.Request) (*resty.Response, error),
+	decode func([]byte) (*Header, error)) (err error) {
+	requestID := uuid.New().String()
+	ctx, span := tracing.Start(ctx, "space "+op, attribute.String("space.request_id", requestID))
+	defer func() { tracing.End(span, err) }()
+
+	var lastErr error
+	for attempt := 0; attempt <= c.maxRetries; attempt++ {
+		if attempt > 0 {
+			wait := c.backoff(attempt, lastErr)
+			c.logger.Infow("retrying olares space request", "op", op, "requestId", requestID,
+				"attempt", attempt, "wait", wait.String(), "error", lastErr)
+
+			timer := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return fmt.Errorf("%s: %w, last error: %v", op, ctx.Err(), lastErr)
+			case <-timer.C:
+			}
+		}
+
+		span.SetAttributes(attribute.Int("space.attempts", attempt+1))
+		lastErr = c.attempt(ctx, requestID, send, decode)
+		if lastErr == nil || !IsRetryable(lastErr) || ctx.Err() != nil {
+			return lastErr
+		}
+	}
+
+	return lastErr
+}
+
+func (c *Client) attempt(ctx context.Context, requestID string,
+	send func(*resty.Request) (*resty.Response, error),
+	decode func([]byte) (*Header, error)) (err error) {
+	ctx, span := tracing.Start(ctx, "space attempt")
+	defer func() { tracing.End(span, err) }()
+
+	resp, err := send(c.http.R().SetContext(ctx).SetHeader(HeaderRequestID, requestID))
+	if err != nil {
+		return &APIError{RequestID: requestID, err: err}
+	}
+	span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode()))
+
+	apiErr := &APIError{
+		StatusCode: resp.StatusCode(),
+		RequestID:  requestID,
+		RetryAfter: parseRetryAfter(resp.Header().Get(HeaderRetryAfter)),
+	}
+
+	// the signature covers the id we sent, a response echoing another one
+	// was captured for another request
+	if id := resp.Header().Get(HeaderRequestID); id != "" && id != requestID {
+		apiErr.err = fmt.Errorf("response is for request %s", id)
+		apiErr.kind = ErrUntrustedResponse
+		return apiErr
+	}
+
+	if resp.StatusCode() != http.StatusOK {
+		apiErr.Message = strings.TrimSpace(string(resp.Body()))
+		apiErr.kind = classify(resp.StatusCode())
+		// revoking or forgetting the cluster makes the caller drop its
+		// identity, so only Space itself may say so
+		if (apiErr.kind == ErrCredentialsRevoked || apiErr.kind == ErrInvalidCluster) && c.identity != nil {
+			if err = c.identity.verify(requestID, resp.Header(), resp.Body()); err != nil {
+				apiErr.err, apiErr.kind = fmt.Errorf("unsigned %d response: %w", resp.StatusCode(), err), ErrUntrustedResponse
+			}
+		}
+		return apiErr
+	}
+
+	if c.identity != nil {
+		if err = c.identity.verify(requestID, resp.Header(), resp.Body()); err != nil {
+			apiErr.err, apiErr.kind = err, ErrUntrustedResponse
+			return apiErr
+		}
+	}
+
+	header, err := decode(resp.Body())
+	if err != nil {
+		apiErr.err = fmt.Errorf("decode response: %w", err)
+		apiErr.Message = apiErr.err.Error()
+		// a broken body will not get better on retry
+		apiErr.kind = errDecode
+		return apiErr
+	}
+
+	if header.Code != http.StatusOK {
+		apiErr.Code, apiErr.Message = header.Code, header.Message
+		apiErr.kind = classify(header.Code)
+		if apiErr.kind == nil {
+			apiErr.kind = errRejected
+		}
+		return apiErr
+	}
+
+	c.logger.Debugw("olares space request succeed", "requestId", requestID)
+	return nil
+}
+
+func (c *Client) backoff(attempt int, lastErr error) time.Duration {
+	if d, ok := RetryAfter(lastErr); ok {
+		return d
+	}
+	wait := time.Duration(float64(c.retryWait) * math.Pow(2, float64(attempt-1)))
+	if c.retryMaxWait > 0 && wait > c.retryMaxWait {
+		wait = c.retryMaxWait
+	}
+	return wait
+}
+
+func parseRetryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// ParseTimestamp parses the RFC3339 or unix milliseconds timestamps used
+// by Space.
+func ParseTimestamp(v string) (time.Time, bool) {
+	if v == "" {
+		return time.Time{}, false
+	}
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, true
+	}
+	if ms, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.UnixMilli(ms), true
+	}
+	return time.Time{}, false
+}
+
+func formatSeconds(d time.Duration) string {
+	return fmt.Sprintf("%.0f", d.Seconds())
+}
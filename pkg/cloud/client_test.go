@@ -0,0 +1,217 @@
+package cloud
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestClient(url string) *Client {
+	return NewClient(WithBaseURL(url), WithRetry(3, time.Millisecond, 5*time.Millisecond))
+}
+
+func TestSetupSTSToken(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != setupSTSTokenPath {
+			t.Errorf("unexpected path %q", r.URL.Path)
+		}
+		if r.Header.Get(HeaderRequestID) == "" {
+			t.Error("request id header is missing")
+		}
+		if got := r.FormValue("bucketPrefix"); got != "cluster-1" {
+			t.Errorf("bucketPrefix = %q", got)
+		}
+		fmt.Fprint(w, `{"code":200,"data":{"ak":"AK","sk":"SK","st":"ST","expiration":"1700000000000"}}`)
+	}))
+	defer srv.Close()
+
+	account, err := newTestClient(srv.URL).SetupSTSToken(context.Background(),
+		&STSTokenRequest{ClusterID: "cluster-1", Bucket: "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if account.Key != "AK" || account.Secret != "SK" || account.Token != "ST" {
+		t.Fatalf("unexpected account %+v", account)
+	}
+	if exp, ok := account.ExpiresAt(); !ok || exp.UnixMilli() != 1700000000000 {
+		t.Fatalf("unexpected expiration %v", exp)
+	}
+}
+
+func TestSetupSTSTokenErrors(t *testing.T) {
+	cases := []struct {
+		name      string
+		status    int
+		body      string
+		want      error
+		retryable bool
+		calls     int32
+	}{
+		{"invalid cluster", http.StatusOK, `{"code":404,"message":"cluster not found"}`, ErrInvalidCluster, false, 1},
+		{"revoked", http.StatusUnauthorized, `denied`, ErrCredentialsRevoked, false, 1},
+		{"rate limited", http.StatusTooManyRequests, ``, ErrRateLimited, true, 4},
+		{"server error", http.StatusBadGateway, ``, nil, true, 4},
+		{"rejected", http.StatusOK, `{"code":500,"message":"boom"}`, nil, false, 1},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var calls int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&calls, 1)
+				w.Header().Set(HeaderRetryAfter, "0")
+				w.WriteHeader(c.status)
+				fmt.Fprint(w, c.body)
+			}))
+			defer srv.Close()
+
+			_, err := newTestClient(srv.URL).SetupSTSToken(context.Background(),
+				&STSTokenRequest{ClusterID: "cluster-1"})
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			if c.want != nil && !errors.Is(err, c.want) {
+				t.Errorf("error %v is not %v", err, c.want)
+			}
+			if IsRetryable(err) != c.retryable {
+				t.Errorf("retryable = %v, want %v", IsRetryable(err), c.retryable)
+			}
+			if calls != c.calls {
+				t.Errorf("calls = %d, want %d", calls, c.calls)
+			}
+		})
+	}
+}
+
+func TestSetupSTSTokenCancel(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(HeaderRetryAfter, "60")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := newTestClient(srv.URL).SetupSTSToken(ctx, &STSTokenRequest{ClusterID: "cluster-1"})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Fatal("retry wait did not honor context cancellation")
+	}
+}
+
+func TestIdentitySignedRequest(t *testing.T) {
+	identity, err := NewIdentity("cluster-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	spacePub, spacePriv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		sig, _ := base64.StdEncoding.DecodeString(r.Header.Get(HeaderSignature))
+		payload := signingPayload(r.Method, r.URL.Path, r.Header.Get(HeaderTimestamp), body)
+		if !ed25519.Verify(identity.PrivateKey.Public().(ed25519.PublicKey), payload, sig) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		var resp string
+		if r.URL.Path == registerIdentityPath {
+			resp = fmt.Sprintf(`{"code":200,"data":{"spacePublicKey":%q}}`,
+				base64.StdEncoding.EncodeToString(spacePub))
+		} else {
+			resp = `{"code":200,"data":{"ak":"AK"}}`
+		}
+		sum := sha256.Sum256([]byte(resp))
+		w.Header().Set(HeaderSpaceSignature, base64.StdEncoding.EncodeToString(ed25519.Sign(spacePriv,
+			[]byte(r.Header.Get(HeaderRequestID)+"\n"+hex.EncodeToString(sum[:])))))
+		fmt.Fprint(w, resp)
+	}))
+	defer srv.Close()
+
+	c := NewClient(WithBaseURL(srv.URL), WithIdentity(identity), WithRetry(0, 0, 0))
+	key, err := c.RegisterIdentity(context.Background(), &RegisterIdentityRequest{Identity: identity, AccessKey: "old"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity.SpacePublicKey = key
+
+	if _, err = c.SetupSTSToken(context.Background(), &STSTokenRequest{ClusterID: "cluster-1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a signed response replayed from another request must be rejected
+	replayed := `{"code":200,"data":{"ak":"OLD"}}`
+	sum := sha256.Sum256([]byte(replayed))
+	replaySig := base64.StdEncoding.EncodeToString(ed25519.Sign(spacePriv, []byte("old-request\n"+hex.EncodeToString(sum[:]))))
+	replay := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(HeaderRequestID, "old-request")
+		w.Header().Set(HeaderSpaceSignature, replaySig)
+		fmt.Fprint(w, replayed)
+	}))
+	defer replay.Close()
+	rc := NewClient(WithBaseURL(replay.URL), WithIdentity(identity), WithRetry(0, 0, 0))
+	if _, err = rc.SetupSTSToken(context.Background(), &STSTokenRequest{ClusterID: "cluster-1"}); !errors.Is(err, ErrUntrustedResponse) {
+		t.Fatalf("expected the replayed response to be untrusted, got %v", err)
+	}
+
+	// a different pinned key must reject the response
+	other, _, _ := ed25519.GenerateKey(nil)
+	identity.SpacePublicKey = other
+	if _, err = c.SetupSTSToken(context.Background(), &STSTokenRequest{ClusterID: "cluster-1"}); !errors.Is(err, ErrUntrustedResponse) {
+		t.Fatalf("expected untrusted response, got %v", err)
+	}
+}
+
+func TestUnsignedRevocation(t *testing.T) {
+	identity, err := NewIdentity("cluster-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	spacePub, spacePriv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity.SpacePublicKey = spacePub
+
+	var signed bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := "revoked"
+		if signed {
+			sum := sha256.Sum256([]byte(body))
+			w.Header().Set(HeaderSpaceSignature, base64.StdEncoding.EncodeToString(ed25519.Sign(spacePriv,
+				[]byte(r.Header.Get(HeaderRequestID)+"\n"+hex.EncodeToString(sum[:])))))
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, body)
+	}))
+	defer srv.Close()
+
+	c := NewClient(WithBaseURL(srv.URL), WithIdentity(identity), WithRetry(0, 0, 0))
+	_, err = c.SetupSTSToken(context.Background(), &STSTokenRequest{ClusterID: "cluster-1"})
+	if !errors.Is(err, ErrUntrustedResponse) || errors.Is(err, ErrCredentialsRevoked) {
+		t.Fatalf("unsigned 401 must not revoke, got %v", err)
+	}
+
+	signed = true
+	if _, err = c.SetupSTSToken(context.Background(), &STSTokenRequest{ClusterID: "cluster-1"}); !errors.Is(err, ErrCredentialsRevoked) {
+		t.Fatalf("signed 401 must revoke, got %v", err)
+	}
+}
@@ -0,0 +1,109 @@
+package cloud
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+var (
+	// ErrInvalidCluster means Space does not know the cluster id, retrying
+	// will not help until the cluster is registered again.
+	ErrInvalidCluster = errors.New("cluster is not registered in olares space")
+
+	// ErrCredentialsRevoked means the credentials used to authenticate the
+	// request were rejected.
+	ErrCredentialsRevoked = errors.New("cluster credentials are revoked")
+
+	// ErrRateLimited means Space asked us to slow down.
+	ErrRateLimited = errors.New("rate limited by olares space")
+
+	// ErrEmptyData means Space answered with success but without payload.
+	ErrEmptyData = errors.New("olares space response data is empty")
+
+	errRejected = errors.New("rejected by olares space")
+	errDecode   = errors.New("malformed olares space response")
+)
+
+// APIError describes a failed call to the Space API.
+type APIError struct {
+	// StatusCode is the HTTP status, 0 when the request never got a response.
+	StatusCode int
+	// Code and Message come from the response envelope.
+	Code    int
+	Message string
+
+	RequestID string
+	// RetryAfter is the delay requested by the server, if any.
+	RetryAfter time.Duration
+
+	kind error
+	err  error
+}
+
+func (e *APIError) Error() string {
+	msg := e.Message
+	if msg == "" && e.err != nil {
+		msg = e.err.Error()
+	}
+	return fmt.Sprintf("olares space request %s failed, status: %d, code: %d, %s",
+		e.RequestID, e.StatusCode, e.Code, msg)
+}
+
+// Is matches the classification sentinel, so
+// errors.Is(err, ErrInvalidCluster) works on the returned value.
+func (e *APIError) Is(target error) bool {
+	return e.kind != nil && e.kind == target
+}
+
+func (e *APIError) Unwrap() error {
+	return e.err
+}
+
+// Retryable reports whether repeating the same request may succeed.
+func (e *APIError) Retryable() bool {
+	switch e.kind {
+	case ErrInvalidCluster, ErrCredentialsRevoked, ErrUntrustedResponse, errRejected, errDecode:
+		return false
+	case ErrRateLimited:
+		return true
+	}
+	if e.StatusCode == 0 {
+		// transport error
+		return true
+	}
+	return e.StatusCode >= http.StatusInternalServerError
+}
+
+// IsRetryable reports whether err is a transient Space API failure.
+func IsRetryable(err error) bool {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.Retryable()
+	}
+	return false
+}
+
+// RetryAfter returns the server requested delay carried by err.
+func RetryAfter(err error) (time.Duration, bool) {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && apiErr.RetryAfter > 0 {
+		return apiErr.RetryAfter, true
+	}
+	return 0, false
+}
+
+// classify maps HTTP status and envelope code to one of the sentinels.
+// Space reuses HTTP status numbers as envelope codes.
+func classify(code int) error {
+	switch code {
+	case http.StatusNotFound:
+		return ErrInvalidCluster
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return ErrCredentialsRevoked
+	case http.StatusTooManyRequests:
+		return ErrRateLimited
+	}
+	return nil
+}
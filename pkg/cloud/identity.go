@@ -0,0 +1,129 @@
+package cloud
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	HeaderClusterID      = "X-Olares-Cluster-Id"
+	HeaderKeyID          = "X-Olares-Key-Id"
+	HeaderTimestamp      = "X-Olares-Timestamp"
+	HeaderSignature      = "X-Olares-Signature"
+	HeaderSpaceSignature = "X-Olares-Space-Signature"
+)
+
+// ErrUntrustedResponse means a response was not signed by the pinned Space
+// key, the payload must not be used.
+var ErrUntrustedResponse = errors.New("olares space response signature is invalid")
+
+// Identity is the keypair a cluster uses to prove itself to Space, together
+// with the Space public key pinned at registration so responses can be
+// verified in return.
+type Identity struct {
+	ClusterID  string
+	PrivateKey ed25519.PrivateKey
+
+	// SpacePublicKey is nil until the identity has been registered.
+	SpacePublicKey ed25519.PublicKey
+}
+
+// NewIdentity generates a fresh keypair for the cluster.
+func NewIdentity(clusterID string) (*Identity, error) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{ClusterID: clusterID, PrivateKey: priv}, nil
+}
+
+// PublicKey returns the base64 encoded public key registered with Space.
+func (i *Identity) PublicKey() string {
+	return base64.StdEncoding.EncodeToString(i.PrivateKey.Public().(ed25519.PublicKey))
+}
+
+// KeyID is a short fingerprint of the public key, sent with every signed
+// request so Space can pick the right key during rotation.
+func (i *Identity) KeyID() string {
+	sum := sha256.Sum256(i.PrivateKey.Public().(ed25519.PublicKey))
+	return hex.EncodeToString(sum[:8])
+}
+
+// Registered reports whether Space has accepted this identity.
+func (i *Identity) Registered() bool {
+	return len(i.SpacePublicKey) == ed25519.PublicKeySize
+}
+
+// sign adds the signature headers to req. The signed payload is
+//
+//	METHOD \n PATH \n TIMESTAMP \n hex(sha256(body))
+func (i *Identity) sign(req *http.Request, now time.Time) error {
+	body, err := readBody(req)
+	if err != nil {
+		return err
+	}
+	ts := strconv.FormatInt(now.Unix(), 10)
+
+	sig := ed25519.Sign(i.PrivateKey, signingPayload(req.Method, req.URL.Path, ts, body))
+	req.Header.Set(HeaderClusterID, i.ClusterID)
+	req.Header.Set(HeaderKeyID, i.KeyID())
+	req.Header.Set(HeaderTimestamp, ts)
+	req.Header.Set(HeaderSignature, base64.StdEncoding.EncodeToString(sig))
+	return nil
+}
+
+// verify checks the Space signature over requestID and the response body.
+func (i *Identity) verify(requestID string, header http.Header, body []byte) error {
+	if !i.Registered() {
+		return nil
+	}
+	sig, err := base64.StdEncoding.DecodeString(header.Get(HeaderSpaceSignature))
+	if err != nil || len(sig) == 0 {
+		return ErrUntrustedResponse
+	}
+	sum := sha256.Sum256(body)
+	payload := []byte(requestID + "\n" + hex.EncodeToString(sum[:]))
+	if !ed25519.Verify(i.SpacePublicKey, payload, sig) {
+		return ErrUntrustedResponse
+	}
+	return nil
+}
+
+func signingPayload(method, path, ts string, body []byte) []byte {
+	sum := sha256.Sum256(body)
+	return []byte(strings.Join([]string{method, path, ts, hex.EncodeToString(sum[:])}, "\n"))
+}
+
+func readBody(req *http.Request) ([]byte, error) {
+	if req.GetBody == nil {
+		return nil, nil
+	}
+	rc, err := req.GetBody()
+	if err != nil {
+		return nil, fmt.Errorf("read request body for signing: %w", err)
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+// ParseSpacePublicKey decodes the key returned by RegisterIdentity.
+func ParseSpacePublicKey(v string) (ed25519.PublicKey, error) {
+	b, err := base64.StdEncoding.DecodeString(v)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid space public key size %d", len(b))
+	}
+	return b, nil
+}
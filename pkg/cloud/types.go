@@ -0,0 +1,128 @@
+package cloud
+
+import "time"
+
+// Header is the envelope shared by every Olares Space API response.
+type Header struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// AWSAccount is the temporary S3 credential issued by Olares Space.
+type AWSAccount struct {
+	Cloud      string `json:"cloud"`
+	Bucket     string `json:"bucket"`
+	Token      string `json:"st"`
+	Prefix     string `json:"prefix"`
+	Secret     string `json:"sk"`
+	Key        string `json:"ak"`
+	Expiration string `json:"expiration"`
+	Region     string `json:"region"`
+	// NextRefresh is when Space wants the next refresh, if it says so.
+	NextRefresh string `json:"nextRefresh,omitempty"`
+}
+
+// ExpiresAt parses Expiration, which Space sends either as RFC3339 or
+// as unix milliseconds.
+func (a *AWSAccount) ExpiresAt() (time.Time, bool) {
+	return ParseTimestamp(a.Expiration)
+}
+
+// NextRefreshAt parses NextRefresh, in the same formats as Expiration.
+func (a *AWSAccount) NextRefreshAt() (time.Time, bool) {
+	return ParseTimestamp(a.NextRefresh)
+}
+
+type AWSAccountResponse struct {
+	Header
+	Data *AWSAccount `json:"data"`
+}
+
+// STSTokenRequest asks Space to set up a new session token for the
+// cluster bucket prefix.
+type STSTokenRequest struct {
+	ClusterID string
+	Bucket    string
+	// BucketPrefix defaults to ClusterID.
+	BucketPrefix string
+	Duration     time.Duration
+
+	// Previous credentials, only needed by clusters that authenticate
+	// without a registered Identity.
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+
+	// Space account of the cluster owner, optional.
+	UserID    string
+	UserToken string
+}
+
+func (r *STSTokenRequest) formData() map[string]string {
+	prefix := r.BucketPrefix
+	if prefix == "" {
+		prefix = r.ClusterID
+	}
+	duration := r.Duration
+	if duration <= 0 {
+		duration = DefaultTokenDuration
+	}
+
+	data := map[string]string{
+		"clusterId":       r.ClusterID,
+		"bucket":          r.Bucket,
+		"bucketPrefix":    prefix,
+		"durationSeconds": formatSeconds(duration),
+	}
+	setIfNotEmpty(data, "ak", r.AccessKey)
+	setIfNotEmpty(data, "sk", r.SecretKey)
+	setIfNotEmpty(data, "st", r.SessionToken)
+	setIfNotEmpty(data, "userid", r.UserID)
+	setIfNotEmpty(data, "token", r.UserToken)
+	return data
+}
+
+// RegisterIdentityRequest registers the cluster public key. Space needs a
+// proof that the caller owns the cluster: the current, still valid STS
+// credentials, the Space account token of the cluster owner, or a one-time
+// bootstrap token issued from Space when both are lost.
+type RegisterIdentityRequest struct {
+	Identity *Identity
+
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+
+	UserID    string
+	UserToken string
+
+	BootstrapToken string
+}
+
+func (r *RegisterIdentityRequest) formData() map[string]string {
+	data := map[string]string{
+		"clusterId": r.Identity.ClusterID,
+		"publicKey": r.Identity.PublicKey(),
+		"keyId":     r.Identity.KeyID(),
+	}
+	setIfNotEmpty(data, "ak", r.AccessKey)
+	setIfNotEmpty(data, "sk", r.SecretKey)
+	setIfNotEmpty(data, "st", r.SessionToken)
+	setIfNotEmpty(data, "userid", r.UserID)
+	setIfNotEmpty(data, "token", r.UserToken)
+	setIfNotEmpty(data, "bootstrapToken", r.BootstrapToken)
+	return data
+}
+
+type RegisterIdentityResponse struct {
+	Header
+	Data *struct {
+		SpacePublicKey string `json:"spacePublicKey"`
+	} `json:"data"`
+}
+
+func setIfNotEmpty(m map[string]string, key, value string) {
+	if value != "" {
+		m[key] = value
+	}
+}
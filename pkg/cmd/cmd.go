@@ -0,0 +1,134 @@
+// Package cmd implements the one-shot subcommands of osnode_init, so
+// provisioning and credential refresh can be run as a Job or from a node
+// shell instead of waiting for the manager.
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+
+	"bytetrade.io/web3os/osnode-init/pkg/log"
+	"github.com/spf13/pflag"
+	"go.uber.org/zap/zapcore"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Exit codes of the subcommands.
+const (
+	ExitOK      = 0
+	ExitFailure = 1
+	ExitUsage   = 2
+	// ExitDrift means the command ran, but found the node not in the
+	// expected state.
+	ExitDrift = 3
+)
+
+type command struct {
+	name  string
+	short string
+	flags func(fs *pflag.FlagSet)
+	run   func(ctx context.Context, env *env) int
+}
+
+// env is what every command gets after flags are parsed.
+type env struct {
+	config *rest.Config
+	client client.Client
+}
+
+var commands = map[string]*command{}
+
+func register(c *command) {
+	commands[c.name] = c
+}
+
+// IsCommand reports whether name is a known subcommand.
+func IsCommand(name string) bool {
+	_, ok := commands[name]
+	return ok || name == "help"
+}
+
+// Execute runs subcommand name with args and returns the process exit code.
+func Execute(name string, args []string) int {
+	c, ok := commands[name]
+	if !ok {
+		usage()
+		if name == "help" {
+			return ExitOK
+		}
+		return ExitUsage
+	}
+
+	fs := pflag.NewFlagSet(name, pflag.ContinueOnError)
+	logLevel := fs.StringP("log-level", "l", "info", "log level")
+	logFormat := fs.String("log-format", log.FormatConsole, "log format, console or json")
+	applyHostFlags := AddHostFlags(fs)
+	if c.flags != nil {
+		c.flags(fs)
+	}
+	if err := fs.Parse(args); err != nil {
+		if err == pflag.ErrHelp {
+			return ExitOK
+		}
+		return ExitUsage
+	}
+
+	// keep stdout for the result
+	log.Init(log.Options{Level: *logLevel, Format: *logFormat, Writers: []zapcore.WriteSyncer{os.Stderr}})
+	ctrl.SetLogger(log.Logr())
+	if err := applyHostFlags(); err != nil {
+		log.Errorf("%v", err)
+		return ExitUsage
+	}
+
+	config, err := ctrl.GetConfig()
+	if err != nil {
+		log.Errorf("get kube config: %v", err)
+		return ExitFailure
+	}
+	scheme := runtime.NewScheme()
+	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+	kubeClient, err := client.New(config, client.Options{Scheme: scheme})
+	if err != nil {
+		log.Errorf("create kube client: %v", err)
+		return ExitFailure
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	return c.run(ctx, &env{config: config, client: kubeClient})
+}
+
+func usage() {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(os.Stderr, "Usage: %s [command] [flags]\n\nCommands:\n", os.Args[0])
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-22s %s\n", name, commands[name].short)
+	}
+	fmt.Fprintf(os.Stderr, "\nWithout a command the controller manager is started.\n")
+}
+
+// printResult writes v as JSON to stdout.
+func printResult(v any) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Errorf("encode result: %v", err)
+	}
+}
@@ -0,0 +1,47 @@
+package cmd
+
+import (
+	"os"
+	"strings"
+
+	controllers "bytetrade.io/web3os/osnode-init/pkg/controller"
+	"bytetrade.io/web3os/osnode-init/pkg/hostpath"
+	"github.com/spf13/pflag"
+)
+
+// AddHostFlags registers the flags of where the host is mounted and where
+// juicefs is, with defaults from the env. The returned func applies them
+// once fs is parsed.
+func AddHostFlags(fs *pflag.FlagSet) func() error {
+	root := os.Getenv(controllers.EnvHostRoot)
+	if root == "" {
+		root = controllers.HostRoot
+	}
+	juicefsPaths := controllers.JuicefsSearchPaths
+	if env := os.Getenv(controllers.EnvJuicefsSearchPaths); env != "" {
+		juicefsPaths = strings.Split(env, ",")
+	}
+
+	fs.StringVar(&root, "host-root", root, "the Olares dir on the host, defaults to $"+controllers.EnvHostRoot)
+	mounts := fs.StringSlice("host-mount", splitEnv(controllers.EnvHostMounts),
+		"HOST=LOCAL, the host dir HOST is mounted at LOCAL in the pod, e.g. /=/host, defaults to $"+controllers.EnvHostMounts)
+	fs.StringSliceVar(&juicefsPaths, "juicefs-search-paths", juicefsPaths,
+		"where to look for the juicefs client, in order, defaults to $"+controllers.EnvJuicefsSearchPaths)
+
+	return func() error {
+		paths, err := hostpath.Parse(*mounts)
+		if err != nil {
+			return err
+		}
+		controllers.SetHostPaths(root, paths)
+		controllers.JuicefsSearchPaths = juicefsPaths
+		return nil
+	}
+}
+
+func splitEnv(name string) []string {
+	if v := os.Getenv(name); v != "" {
+		return strings.Split(v, ",")
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package cmd
+
+import (
+	"context"
+
+	controllers "bytetrade.io/web3os/osnode-init/pkg/controller"
+	"bytetrade.io/web3os/osnode-init/pkg/log"
+	"github.com/spf13/pflag"
+)
+
+func init() {
+	var output, configMap string
+
+	register(&command{
+		name:  "export-manifest",
+		short: "Export the user data dirs of this node with their owner and mode",
+		flags: func(fs *pflag.FlagSet) {
+			fs.StringVarP(&output, "output", "o", "", "write the manifest to this file instead of stdout")
+			fs.StringVar(&configMap, "configmap", "", "also save the manifest to this configmap, namespace/name")
+		},
+		run: func(ctx context.Context, e *env) int {
+			m, err := controllers.ExportManifest(ctx, e.client)
+			if err != nil {
+				log.Errorf("export manifest: %v", err)
+				return ExitFailure
+			}
+			if configMap != "" {
+				if err = controllers.SaveManifestConfigMap(ctx, e.client, configMap, m); err != nil {
+					log.Errorf("save manifest to configmap %s: %v", configMap, err)
+					return ExitFailure
+				}
+				log.Infof("manifest of %d dirs saved to configmap %s", len(m.Dirs), configMap)
+			}
+			if output == "" {
+				printResult(m)
+				return ExitOK
+			}
+			if err = controllers.WriteManifestFile(output, m); err != nil {
+				log.Errorf("write manifest: %v", err)
+				return ExitFailure
+			}
+			log.Infof("manifest of %d dirs written to %s", len(m.Dirs), output)
+			return ExitOK
+		},
+	})
+}
+
+func init() {
+	var (
+		input, configMap string
+		opts             controllers.RestoreOptions
+	)
+
+	register(&command{
+		name:  "restore-manifest",
+		short: "Recreate user data dirs and reset their owner and mode from a manifest",
+		flags: func(fs *pflag.FlagSet) {
+			fs.StringVarP(&input, "input", "i", "", "manifest file written by export-manifest")
+			fs.StringVar(&configMap, "configmap", "", "read the manifest from this configmap, namespace/name")
+			fs.StringVarP(&opts.Namespace, "namespace", "n", "", "only restore the dirs of this user namespace")
+			fs.BoolVar(&opts.DryRun, "dry-run", false, "only print what would change")
+			fs.BoolVar(&opts.AnyNode, "any-node", false, "restore a manifest exported from another node")
+		},
+		run: func(ctx context.Context, e *env) int {
+			if (input == "") == (configMap == "") {
+				log.Error("exactly one of --input or --configmap is required")
+				return ExitUsage
+			}
+
+			var (
+				m   *controllers.Manifest
+				err error
+			)
+			if input != "" {
+				m, err = controllers.ReadManifestFile(input)
+			} else {
+				m, err = controllers.ReadManifestConfigMap(ctx, e.client, configMap)
+			}
+			if err != nil {
+				log.Errorf("read manifest: %v", err)
+				return ExitFailure
+			}
+
+			result, err := controllers.RestoreManifest(ctx, e.client, m, opts)
+			if result != nil {
+				printResult(result)
+			}
+			if err != nil {
+				log.Errorf("restore manifest: %v", err)
+				return ExitFailure
+			}
+			if opts.DryRun && result.Changed() > 0 {
+				return ExitDrift
+			}
+			return ExitOK
+		},
+	})
+}
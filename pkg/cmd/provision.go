@@ -0,0 +1,59 @@
+package cmd
+
+import (
+	"context"
+
+	controllers "bytetrade.io/web3os/osnode-init/pkg/controller"
+	"bytetrade.io/web3os/osnode-init/pkg/log"
+	"github.com/spf13/pflag"
+)
+
+func init() {
+	var (
+		namespace string
+		all       bool
+	)
+
+	register(&command{
+		name:  "provision",
+		short: "Create the data dirs of the provisioning targets on this node",
+		flags: func(fs *pflag.FlagSet) {
+			fs.StringVarP(&namespace, "namespace", "n", "", "namespace, e.g. user-space-alice")
+			fs.BoolVar(&all, "all", false, "provision every namespace with a target object")
+		},
+		run: func(ctx context.Context, e *env) int {
+			if (namespace == "") == !all {
+				log.Error("exactly one of --namespace or --all is required")
+				return ExitUsage
+			}
+
+			namespaces := []string{namespace}
+			if all {
+				states, err := controllers.VerifyNode(ctx, e.client)
+				if err != nil {
+					log.Errorf("list target objects: %v", err)
+					return ExitFailure
+				}
+				namespaces = namespaces[:0]
+				for _, s := range states {
+					if len(namespaces) == 0 || namespaces[len(namespaces)-1] != s.Namespace {
+						namespaces = append(namespaces, s.Namespace)
+					}
+				}
+			}
+
+			code := ExitOK
+			var results []*controllers.ProvisionResult
+			for _, ns := range namespaces {
+				nsResults, err := controllers.ProvisionNamespace(ctx, e.client, ns)
+				if err != nil {
+					log.Errorf("provision %q: %v", ns, err)
+					code = ExitFailure
+				}
+				results = append(results, nsResults...)
+			}
+			printResult(results)
+			return code
+		},
+	})
+}
@@ -0,0 +1,40 @@
+package cmd
+
+import (
+	"context"
+
+	controllers "bytetrade.io/web3os/osnode-init/pkg/controller"
+	"bytetrade.io/web3os/osnode-init/pkg/log"
+	"github.com/spf13/pflag"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/utils/clock"
+)
+
+func init() {
+	var opts controllers.RefreshOptions
+
+	register(&command{
+		name:  "refresh-credentials",
+		short: "Refresh the juicefs S3 session token from Olares Space now",
+		flags: func(fs *pflag.FlagSet) {
+			fs.StringVar(&opts.Bucket, "bucket", "", "S3 bucket, defaults to $S3_BUCKET")
+			fs.BoolVar(&opts.DryRun, "dry-run", false, "only check the refresh prerequisites")
+		},
+		run: func(ctx context.Context, e *env) int {
+			var settings *controllers.SettingsAccountClient
+			if err := controllers.SetupTerminusNonce(clock.RealClock{}); err != nil {
+				log.Warnf("%v, olares space account of the owner will not be fetched", err)
+			} else if dynamicClient, err := dynamic.NewForConfig(e.config); err == nil {
+				settings = controllers.NewSettingsAccountClient(dynamicClient)
+			}
+
+			result, err := controllers.RefreshCredentials(ctx, e.config, settings, opts)
+			printResult(result)
+			if err != nil {
+				log.Errorf("refresh credentials: %v", err)
+				return ExitFailure
+			}
+			return ExitOK
+		},
+	})
+}
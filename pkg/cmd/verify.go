@@ -0,0 +1,30 @@
+package cmd
+
+import (
+	"context"
+
+	controllers "bytetrade.io/web3os/osnode-init/pkg/controller"
+	"bytetrade.io/web3os/osnode-init/pkg/log"
+)
+
+func init() {
+	register(&command{
+		name:  "verify",
+		short: "Check the user data dirs on this node without changing them",
+		run: func(ctx context.Context, e *env) int {
+			results, err := controllers.VerifyNode(ctx, e.client)
+			if err != nil {
+				log.Errorf("verify: %v", err)
+				return ExitFailure
+			}
+			printResult(results)
+
+			for _, r := range results {
+				if !r.Ready() {
+					return ExitDrift
+				}
+			}
+			return ExitOK
+		},
+	})
+}
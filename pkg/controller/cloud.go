@@ -2,21 +2,17 @@ package controllers
 
 import (
 	"context"
-	"encoding/json"
-	"fmt"
-	"net/http"
-	"os"
-	"strings"
-	"time"
-
-	"github.com/emicklei/go-restful/v3"
-	"github.com/go-resty/resty/v2"
+
+	"bytetrade.io/web3os/osnode-init/pkg/cloud"
+	"bytetrade.io/web3os/osnode-init/pkg/log"
+	"bytetrade.io/web3os/osnode-init/pkg/tracing"
 	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/util/retry"
-	"k8s.io/klog/v2"
 )
 
 type Header struct {
@@ -51,27 +47,15 @@ type AccountResponseData struct {
 }
 
 type AccountValue struct {
-	Email   string `json:"email"`
-	Userid  string `json:"userid"`
-	Token   string `json:"token"`
-	Expired any    `json:"expired"`
-}
-
-type AWSAccount struct {
-	Cloud      string `json:"cloud"`
-	Bucket     string `json:"bucket"`
-	Token      string `json:"st"`
-	Prefix     string `json:"prefix"`
-	Secret     string `json:"sk"`
-	Key        string `json:"ak"`
-	Expiration string `json:"expiration"`
-	Region     string `json:"region"`
+	Email   string    `json:"email"`
+	Userid  string    `json:"userid"`
+	Token   string    `json:"token"`
+	Expired Timestamp `json:"expired"`
 }
 
-type AWSAccountResponse struct {
-	Header
-	Data *AWSAccount `json:"data"`
-}
+// AWSAccount is kept as an alias so callers in this package don't need to
+// import the cloud package for the credential type.
+type AWSAccount = cloud.AWSAccount
 
 const (
 	LABEL_CLUSTER_ID    = "bytetrade.io/cluster-id"
@@ -88,132 +72,128 @@ var (
 	}
 )
 
-func getAccountFromSettings(admin string) (userid, token string, err error) {
-	settingsUrl := fmt.Sprintf("http://settings-service.user-space-%s/api/account", admin)
-	client := resty.New().SetTimeout(2 * time.Second).SetRetryCount(3)
+// GetAwsAccountFromCloud refreshes the S3 session token from Olares Space.
+// Requests are signed with the cluster identity, which is registered on the
+// first call using the current credentials from the Terminus object. When
+// settings is not nil, the owner's Space account is sent along as well.
+func GetAwsAccountFromCloud(ctx context.Context, kubeClient kubernetes.Interface,
+	client dynamic.Interface, settings *SettingsAccountClient, bucket string) (_ *AWSAccount, err error) {
+	ctx, span := tracing.Start(ctx, "GetAwsAccountFromCloud", attribute.String("bucket", bucket))
+	defer func() { tracing.End(span, err) }()
 
-	req := &ProxyRequest{
-		Op:       "getAccount",
-		DataType: "account",
-		Version:  "v1",
-		Group:    "service.settings",
-		Data:     "settings-account-space",
-	}
-
-	terminusNonce, err := GenTerminusNonce()
+	logger := log.FromContext(ctx)
+	clusterId, ak, sk, st, err := getClusterId(ctx, client)
 	if err != nil {
-		klog.Error("generate nonce error, ", err)
-		return
+		return nil, err
 	}
 
-	klog.Info("fetch account from settings, ", settingsUrl)
-	resp, err := client.R().SetDebug(true).
-		SetHeader(restful.HEADER_ContentType, restful.MIME_JSON).
-		SetHeader("Terminus-Nonce", terminusNonce).
-		SetBody(req).
-		SetResult(&AccountResponse{}).
-		Post(settingsUrl)
+	var owner *AccountValue
+	if settings != nil {
+		if owner, err = settings.Get(ctx); err != nil {
+			logger.Warn("get owner space account from settings error, ", err)
+		}
+	}
 
+	store := newIdentityStore(kubeClient)
+	identity, secret, err := store.load(ctx, clusterId)
 	if err != nil {
-		klog.Error("request settings account api error, ", err)
-		return
+		return nil, err
 	}
-
-	if resp.StatusCode() != http.StatusOK {
-		klog.Error("request settings account api response not ok, ", resp.StatusCode())
-		err = fmt.Errorf("settings account response, %d, %s", resp.StatusCode(), string(resp.Body()))
-		return
+	if secret, err = store.ensureRegistered(ctx, secret, identity, ak, sk, st, owner); err != nil {
+		logger.Error("register cluster identity error, ", err)
+		return nil, err
 	}
 
-	accountResp := resp.Result().(*AccountResponse)
-	klog.Infof("settings account api response, %+v", accountResp)
-	if accountResp.Code != 0 {
-		klog.Error("request settings account api response error, ", accountResp.Code, ", ", accountResp.Message)
-		err = errors.New(accountResp.Message)
-		return
+	account, err := setupSTSToken(ctx, identity, owner, bucket)
+	if errors.Is(err, cloud.ErrCredentialsRevoked) && owner != nil {
+		// the rejected token may be the owner's, not the identity's
+		account, owner, err = retryRevokedOwner(ctx, owner, settings.Refresh, func(owner *AccountValue) (*AWSAccount, error) {
+			return setupSTSToken(ctx, identity, owner, bucket)
+		})
 	}
-
-	if accountResp.Data == nil {
-		klog.Error("request settings account api response data is nil, ", accountResp.Code, ", ", accountResp.Message)
-		err = errors.New("request settings account api response data is nil")
-		return
+	if errors.Is(err, cloud.ErrCredentialsRevoked) {
+		logger.Warn("cluster identity is revoked by olares space, register a new one")
+		if identity, secret, err = store.reset(ctx, secret, clusterId); err != nil {
+			return nil, err
+		}
+		if _, err = store.ensureRegistered(ctx, secret, identity, ak, sk, st, owner); err != nil {
+			logger.Error("register cluster identity error, ", err)
+			return nil, err
+		}
+		account, err = setupSTSToken(ctx, identity, owner, bucket)
 	}
-
-	var value AccountValue
-	err = json.Unmarshal([]byte(accountResp.Data.Value), &value)
 	if err != nil {
-		klog.Error("parse value error, ", err, ", ", value)
-		return
+		return nil, err
 	}
-	userid = value.Userid
-	token = value.Token
+	logger.Infof("get aws account from cloud, bucket: %s, prefix: %s, expiration: %s",
+		account.Bucket, account.Prefix, account.Expiration)
 
-	return
+	return account, nil
 }
 
-func GetAwsAccountFromCloud(ctx context.Context, client dynamic.Interface, bucket string) (*AWSAccount, error) {
-	// cloudUrl := "https://cloud-dev-api.bttcdn.com/v1/resource/stsToken"
-	cloudHost := "https://cloud-api.bttcdn.com"
-	cloudHostFromEnv := os.Getenv("OLARES_SPACE_URL")
-	if cloudHostFromEnv != "" {
-		cloudHost = cloudHostFromEnv
-	}
-	cloudURL := fmt.Sprintf("%s/v1/resource/stsToken/setup", strings.TrimSuffix(cloudHost, "/"))
+// retryRevokedOwner repeats a request Space rejected with the stale owner
+// account, first with the owner fetched again and then with the identity
+// alone. Only when that is rejected too is the identity itself revoked. The
+// owner returned is the one to register a new identity with.
+func retryRevokedOwner(ctx context.Context, stale *AccountValue,
+	refresh func(context.Context) (*AccountValue, error),
+	setup func(owner *AccountValue) (*AWSAccount, error)) (*AWSAccount, *AccountValue, error) {
+	logger := log.FromContext(ctx)
 
-	clusterId, ak, sk, st, err := getClusterId(ctx, client)
+	owner, err := refresh(ctx)
 	if err != nil {
-		return nil, err
+		logger.Warn("get owner space account from settings error, ", err)
+		owner = nil
 	}
-
-	httpClient := resty.New().SetTimeout(15 * time.Second).
-		SetDebug(true).
-		SetRetryCount(5).
-		SetRetryWaitTime(30 * time.Second).
-		SetRetryMaxWaitTime(180 * time.Second)
-	duration := 12 * time.Hour
-	resp, err := httpClient.R().
-		SetFormData(map[string]string{
-			"clusterId":       clusterId,
-			"ak":              ak,
-			"sk":              sk,
-			"st":              st,
-			"bucket":          bucket,
-			"bucketPrefix":    clusterId,
-			"durationSeconds": fmt.Sprintf("%.0f", duration.Seconds()),
-		}).
-		SetResult(&AWSAccountResponse{}).
-		Post(cloudURL)
-
-	if err != nil {
-		klog.Error("fetch data from cloud error, ", err, ", ", cloudURL)
-		return nil, err
+	if owner != nil && owner.Token != stale.Token {
+		logger.Info("owner space token is rejected by olares space, retry with a fresh one")
+		account, err := setup(owner)
+		if !errors.Is(err, cloud.ErrCredentialsRevoked) {
+			return account, owner, err
+		}
 	}
 
-	if resp.StatusCode() != http.StatusOK {
-		klog.Error("fetch data from cloud response error, ", resp.StatusCode(), ", ", resp.Body())
-		return nil, errors.New(string(resp.Body()))
+	account, err := setup(nil)
+	if err == nil {
+		logger.Warn("owner space account is rejected by olares space, continue with the cluster identity alone")
 	}
+	return account, owner, err
+}
 
-	awsResp := resp.Result().(*AWSAccountResponse)
-	if awsResp.Code != http.StatusOK {
-		klog.Error("get aws account from cloud error, ", awsResp.Code, ", ", awsResp.Message)
-		return nil, errors.New(awsResp.Message)
+func setupSTSToken(ctx context.Context, identity *cloud.Identity, owner *AccountValue, bucket string) (*AWSAccount, error) {
+	logger := log.FromContext(ctx)
+	spaceClient := cloud.NewClient(cloud.WithIdentity(identity), cloud.WithLogger(logger.Named(log.ComponentCloud)))
+	req := &cloud.STSTokenRequest{
+		ClusterID: identity.ClusterID,
+		Bucket:    bucket,
 	}
-	klog.Infof("get aws account from cloud %v", ToJSON(awsResp))
-
-	if awsResp.Data == nil {
-		klog.Error("get aws account from cloud data is empty, ", awsResp.Code, ", ", awsResp.Message)
-		return nil, errors.New("data is empty")
+	if owner != nil {
+		req.UserID, req.UserToken = owner.Userid, owner.Token
 	}
-
-	return awsResp.Data, nil
+	account, err := spaceClient.SetupSTSToken(ctx, req)
+	if err != nil {
+		switch {
+		case errors.Is(err, cloud.ErrInvalidCluster):
+			logger.Error("cluster id is rejected by olares space, ", identity.ClusterID, ", ", err)
+		case errors.Is(err, cloud.ErrUntrustedResponse):
+			logger.Error("olares space response is not trusted, ", err)
+		default:
+			logger.Error("fetch data from cloud error, ", err, ", ", spaceClient.BaseURL())
+		}
+		return nil, err
+	}
+	return account, nil
 }
 
 func getClusterId(ctx context.Context, client dynamic.Interface) (cluster_id, ak, sk, st string, err error) {
+	ctx, span := tracing.Start(ctx, "getClusterId")
+	defer func() { tracing.End(span, err) }()
+
+	logger := log.FromContext(ctx)
 
 	data, err := client.Resource(gvr).Get(ctx, "terminus", metav1.GetOptions{})
 	if err != nil {
-		klog.Error("get terminus define error, ", err)
+		logger.Error("get terminus define error, ", err)
 		return
 	}
 
@@ -221,12 +201,12 @@ func getClusterId(ctx context.Context, client dynamic.Interface) (cluster_id, ak
 	var ok = false
 	if labels != nil {
 		if cluster_id, ok = labels[LABEL_CLUSTER_ID]; ok {
-			klog.Info("found cluster id, ", cluster_id)
+			logger.Info("found cluster id, ", cluster_id)
 		}
 	}
 
 	if cluster_id == "" {
-		klog.Error("cluster id not found")
+		logger.Error("cluster id not found")
 		err = errors.New("cluster id not found")
 		return
 	}
@@ -234,15 +214,15 @@ func getClusterId(ctx context.Context, client dynamic.Interface) (cluster_id, ak
 	annotations := data.GetAnnotations()
 	if annotations != nil {
 		if ak, ok = annotations[LABEL_ACCESS_KEY]; ok {
-			klog.Info("found access key, ", ak)
+			logger.Info("found access key, ", ak)
 		}
 
 		if sk, ok = annotations[LABEL_SECRET_KEY]; ok {
-			klog.Info("found secret key, ", sk)
+			logger.Info("found secret key, ", sk)
 		}
 
 		if st, ok = annotations[LABEL_SESSION_TOKEN]; ok {
-			klog.Info("found session token, ", st)
+			logger.Info("found session token, ", st)
 		}
 
 		return
@@ -251,11 +231,15 @@ func getClusterId(ctx context.Context, client dynamic.Interface) (cluster_id, ak
 	return
 }
 
-func updateAwsAccount(ctx context.Context, client dynamic.Interface, account *AWSAccount) error {
+func updateAwsAccount(ctx context.Context, client dynamic.Interface, account *AWSAccount) (err error) {
+	ctx, span := tracing.Start(ctx, "updateAwsAccount")
+	defer func() { tracing.End(span, err) }()
+
+	logger := log.FromContext(ctx)
 	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
 		data, err := client.Resource(gvr).Get(ctx, "terminus", metav1.GetOptions{})
 		if err != nil {
-			klog.Error("get terminus define error, ", err)
+			logger.Error("get terminus define error, ", err)
 			return err
 		}
 		annotations := data.GetAnnotations()
@@ -271,7 +255,7 @@ func updateAwsAccount(ctx context.Context, client dynamic.Interface, account *AW
 
 		_, err = client.Resource(gvr).Update(ctx, data, metav1.UpdateOptions{})
 		if err != nil {
-			klog.Error("update terminus s3 lables error, ", err)
+			logger.Error("update terminus s3 lables error, ", err)
 			return err
 		}
 
@@ -2,31 +2,29 @@ package controllers
 
 import (
 	"context"
-	"fmt"
-	"os"
-	"os/exec"
-	"path/filepath"
-	"strings"
-	"syscall"
+	"sync"
 	"time"
 
+	"bytetrade.io/web3os/osnode-init/pkg/juicefs"
 	"bytetrade.io/web3os/osnode-init/pkg/log"
+	"bytetrade.io/web3os/osnode-init/pkg/schedule"
+	"bytetrade.io/web3os/osnode-init/pkg/task"
+	"bytetrade.io/web3os/osnode-init/pkg/tracing"
+	"github.com/google/uuid"
 	"github.com/pkg/errors"
-	"github.com/robfig/cron/v3"
-	appsv1 "k8s.io/api/apps/v1"
+	"go.opentelemetry.io/otel/attribute"
 	corev1 "k8s.io/api/core/v1"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
-	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
-	"k8s.io/klog/v2"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/clock"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
-	"sigs.k8s.io/controller-runtime/pkg/event"
 	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 	"sigs.k8s.io/controller-runtime/pkg/source"
@@ -36,82 +34,50 @@ import (
 type NodeInitController struct {
 	client.Client
 	scheme *runtime.Scheme
-	cron   *cron.Cron
+	config *rest.Config
+	clock  clock.Clock
+	// refresher schedules the credential refresh, on the master node only
+	refresher *schedule.Scheduler
+	// refreshMu is held while credentials are refreshed
+	refreshMu sync.Mutex
+	// juicefs is the client found on the master node, see juicefsClient
+	juicefsMu sync.Mutex
+	juicefs   *juicefs.Binary
+	settings  *SettingsAccountClient
+	status    *statusTracker
+	recorder  record.EventRecorder
+	// dynamicClient is only set on the master node
+	dynamicClient dynamic.Interface
+	tasks         *task.Registry
+	// apiReader reads objects the cache does not watch, e.g. ConfigMaps.
+	apiReader client.Reader
+	fs        FileSystem
+	// migrations run the data migrations in the background
+	migrations *migrationRunner
+
+	nodeMu sync.Mutex
+	node   *corev1.Node
 }
 
-func NewNodeInitController(c client.Client, schema *runtime.Scheme, config *rest.Config) *NodeInitController {
-	nic := &NodeInitController{Client: c, scheme: schema, cron: cron.New()}
-	schedule := os.Getenv("SCHEDULE")
-	if schedule == "" {
-		// random timer schedule, to avoid too much concurrent api requets
-		schedule = fmt.Sprintf("%d */8 * * *", time.Now().Minute())
-	}
-
-	if isMaster, _, err := nic.isMasterNode(config); err != nil {
-		log.Fatal("get master node info error, ", err)
-		panic(err)
-	} else {
-		if isMaster {
-			// add job to master node
-			nic.cron.AddFunc(schedule, func() {
-				ctx := context.Background()
-				dynamicClient, err := dynamic.NewForConfig(config)
-				if err != nil {
-					klog.Error("create kube client error, ", err)
-					return
-				}
-
-				bucket := os.Getenv("S3_BUCKET")
-				if bucket == "" {
-					klog.Error("bucket is unknown")
-					return
-				}
-
-				if bucket == "none" {
-					return
-				}
-
-				klog.Info("get refresh session token from cloud")
-				account, err := GetAwsAccountFromCloud(ctx, dynamicClient, bucket)
-				if err != nil {
-					klog.Error("get token from cloud error, ", err)
-					return
-				}
-
-				// exec juice command
-				klog.Info("find jiucefs redis ip and password")
-				ip, pwd, err := getRedisIpAndPassword()
-				if err != nil {
-					klog.Error(err)
-					return
-				}
+// Option configures a NodeInitController.
+type Option func(*NodeInitController)
 
-				args := []string{
-					"config",
-					"redis://:" + pwd + "@" + ip + ":6379/1",
-					"--access-key",
-					account.Key,
-					"--secret-key",
-					account.Secret,
-					"--session-token",
-					account.Token,
-				}
-
-				klog.Info("refresh juicefs config with ", args)
-				out, err := exec.Command("/usr/local/bin/juicefs", args...).CombinedOutput()
-				if err != nil {
-					klog.Errorf("%s, %v", string(out), err)
-				} else {
-					klog.Info("refresh succeed, update temrinus s3 labels")
-					updateAwsAccount(ctx, dynamicClient, account)
-				}
-
-			})
-		}
+// WithClock replaces the real clock, for tests.
+func WithClock(c clock.Clock) Option {
+	return func(r *NodeInitController) {
+		r.clock = c
 	}
+}
 
-	nic.cron.Start()
-
+// NewNodeInitController only builds the controller. Which node it runs on
+// is found out and the refresh job is scheduled by SetupWithManager.
+func NewNodeInitController(c client.Client, schema *runtime.Scheme, config *rest.Config, opts ...Option) *NodeInitController {
+	nic := &NodeInitController{Client: c, scheme: schema, config: config, clock: clock.RealClock{},
+		status: newStatusTracker(), tasks: task.NewRegistry(), fs: hostFS, migrations: newMigrationRunner()}
+	for _, opt := range opts {
+		opt(nic)
+	}
+	nic.tasks.MustRegister(&dataDirsTask{r: nic}, &credentialsTask{r: nic}, kernelModulesTask{}, sysctlTask{})
 	return nic
 }
 
@@ -124,106 +90,180 @@ func NewNodeInitController(c client.Client, schema *runtime.Scheme, config *rest
 //
 // For more details, check Reconcile and its Result here:
 // - https://pkg.go.dev/sigs.k8s.io/controller-runtime@v0.12.2/pkg/reconcile
-func (r *NodeInitController) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
-	log.Infof("received nodeinit request, namespace: %q, name: %q", req.Namespace, req.Name)
+func (r *NodeInitController) Reconcile(ctx context.Context, req ctrl.Request) (_ ctrl.Result, err error) {
+	ctx, span := tracing.Start(ctx, "Reconcile",
+		attribute.String("request.namespace", req.Namespace), attribute.String("request.name", req.Name))
+	defer func() { tracing.End(span, err) }()
+
+	ctx = log.NewContext(ctx, log.FromContext(ctx).Named(log.ComponentController).
+		With("reconcileID", uuid.New().String()))
+	logger := log.FromContext(ctx)
+	logger.Infof("received nodeinit request, namespace: %q, name: %q", req.Namespace, req.Name)
 
-	var (
-		err      error
-		nodeList corev1.NodeList
-	)
+	var nodeList corev1.NodeList
 
 	if err = r.List(ctx, &nodeList); err != nil {
 		return ctrl.Result{Requeue: true, RequeueAfter: 10 * time.Second}, errors.WithStack(err)
 	}
-	if !r.isCurrentNode(nodeList) {
-		log.Warnf("not current node %q, ignore", NodeIP)
+	node := currentNode(nodeList)
+	if node == nil {
+		logger.Warnf("not current node %q, ignore", NodeIP)
 		return ctrl.Result{}, nil
 	}
 	nodeList.Items = nil
 
-	var statefulSets appsv1.StatefulSetList
+	r.nodeMu.Lock()
+	r.node = node
+	r.nodeMu.Unlock()
 
-	if err = r.List(ctx, &statefulSets, client.MatchingLabels{"tier": "bfl"}); err != nil {
-		return ctrl.Result{Requeue: true, RequeueAfter: 10 * time.Second}, errors.WithStack(err)
-	} else {
-		for _, sts := range statefulSets.Items {
-			if !isUserNamespaceBfl(sts.Namespace, sts.Name) {
-				continue
-			}
-			log.Debugf("creating %q bfl userdata dirs", sts.Namespace)
-			if !hasAllAnnotations(sts.Annotations, BflAnnotationAppCache, BflAnnotationDbData) {
-				return ctrl.Result{}, errors.Errorf("namespace %q bfl has no userdata annotation", sts.Namespace)
-			}
-			if err = createDataDirs(&sts); err != nil {
-				return ctrl.Result{}, errors.Errorf("creating %q bfl userdata dirs, %v", sts.Namespace, err)
-			}
+	taskNode := r.taskNode()
+	err = r.tasks.RunAll(ctx, taskNode)
+
+	// drift still there after the tasks repaired what they could
+	for _, s := range r.tasks.VerifyAll(ctx, taskNode) {
+		if s.Drift != "" && s.State == task.StateSucceeded {
+			logger.Warnf("task %s drifted, %s", s.Name, s.Drift)
+			r.event(node, corev1.EventTypeWarning, EventReasonTaskDrift, "%s drifted: %s", s.Name, s.Drift)
 		}
 	}
+	if err != nil {
+		return ctrl.Result{}, err
+	}
 
 	return ctrl.Result{}, nil
 }
 
-func createDataDirs(sts *appsv1.StatefulSet) error {
-	var err error
-
-	mkDirs := func(perm []int, dirs ...string) (err error) {
-		for _, dir := range dirs {
-			if !filePathExists(dir) {
-				err = os.MkdirAll(dir, 0755)
-				if err != nil {
-					return errors.WithStack(err)
-				}
-			}
+// Tasks is the registry of the node init tasks, more tasks can be
+// registered before the manager starts.
+func (r *NodeInitController) Tasks() *task.Registry {
+	return r.tasks
+}
 
-			var di os.FileInfo
-			di, err = os.Stat(dir)
-			if err != nil {
-				return errors.WithStack(err)
-			} else {
-				stat := di.Sys().(*syscall.Stat_t)
-				if stat.Uid == uint32(perm[0]) && stat.Gid == uint32(perm[1]) {
-					return
-				}
-				if err = os.Chown(dir, perm[0], perm[1]); err != nil {
-					return errors.WithStack(err)
-				}
-				log.Debugf("%q created, and set uid: %v, gid: %v ", dir, perm[0], perm[1])
-			}
-		}
-		return
+func (r *NodeInitController) reader() client.Reader {
+	if r.apiReader != nil {
+		return r.apiReader
 	}
+	return r.Client
+}
 
-	appDir, dbDir := sts.Annotations[BflAnnotationAppCache], sts.Annotations[BflAnnotationDbData]
+func (r *NodeInitController) taskNode() *task.Node {
+	r.nodeMu.Lock()
+	defer r.nodeMu.Unlock()
+	return &task.Node{IP: NodeIP, Master: r.status.isMaster(), Object: r.node}
+}
 
-	// appdata
-	for name, perm := range AppSubDirs {
-		if err = mkDirs(perm, filepath.Join(appDir, name)); err != nil {
-			return err
+// Status returns what the controller has done on this node so far.
+func (r *NodeInitController) Status() Status {
+	status := r.status.snapshot(r.fs)
+	status.Tasks = r.tasks.Statuses()
+	if r.refresher != nil && status.Credentials != nil {
+		if next := r.refresher.Next(); !next.IsZero() {
+			status.Credentials.NextRefresh = &next
 		}
 	}
+	return status
+}
 
-	// create dbData sub dirs and set permissions
-	for name, perm := range DbDataSubDirs {
-		if err = mkDirs(perm, filepath.Join(dbDir, name)); err != nil {
-			return err
+// TriggerProvision provisions the data dirs of namespace immediately.
+func (r *NodeInitController) TriggerProvision(ctx context.Context, namespace string) ([]*ProvisionResult, error) {
+	results, err := provisionNamespace(ctx, r.reader(), r.fs, r.taskNode().Object, namespace)
+	for _, result := range results {
+		if result.Skipped != "" {
+			r.status.recordSkip(result.TargetRef, result.Skipped)
+			continue
+		}
+		var dirs []DataDir
+		for _, d := range result.Dirs {
+			dirs = append(dirs, d.DataDir)
 		}
+		var resultErr error
+		if result.Error != "" {
+			resultErr = errors.New(result.Error)
+		}
+		r.status.recordProvision(result.TargetRef, dirs, resultErr)
 	}
+	return results, err
+}
 
-	return nil
+// ExportManifest lists the data dirs of every user on this node.
+func (r *NodeInitController) ExportManifest(ctx context.Context) (*Manifest, error) {
+	return exportManifest(ctx, r.reader(), r.fs, r.taskNode().Object)
+}
+
+// RestoreManifest restores the data dirs of m on this node.
+func (r *NodeInitController) RestoreManifest(ctx context.Context, m *Manifest, opts RestoreOptions) (*RestoreResult, error) {
+	return restoreManifest(ctx, r.reader(), r.fs, m, opts)
 }
 
-func (r *NodeInitController) isCurrentNode(nodeList corev1.NodeList) bool {
-	if nodeList.Items == nil || len(nodeList.Items) == 0 {
-		return false
+// ErrRefreshRunning is returned by TriggerRefresh while another refresh
+// is still running.
+var ErrRefreshRunning = errors.New("a credential refresh is already running")
+
+// TriggerRefresh rotates the S3 credentials immediately. It only runs on
+// the master node, which owns the rotation, and not while another refresh
+// runs.
+func (r *NodeInitController) TriggerRefresh(ctx context.Context) (*RefreshResult, error) {
+	if !r.status.isMaster() {
+		return nil, errors.New("credential rotation only runs on the master node")
+	}
+	if !r.refreshMu.TryLock() {
+		return nil, ErrRefreshRunning
 	}
+	defer r.refreshMu.Unlock()
 
-	for _, node := range nodeList.Items {
-		if node.Status.Addresses != nil {
-			for _, addr := range node.Status.Addresses {
-				if addr.Type == corev1.NodeInternalIP && addr.Address == NodeIP {
-					return true
-				}
+	err := r.tasks.Run(ctx, TaskCredentials, r.taskNode())
+	return r.status.lastRefresh(), err
+}
+
+// createDataDirs returns how many dirs were created or chowned. Dirs with
+// a template are seeded from it when they do not exist yet.
+func createDataDirs(ctx context.Context, c client.Reader, fsys FileSystem, o targetObject) (changed int, err error) {
+	ref := o.ref()
+	ctx, span := tracing.Start(ctx, "createDataDirs", attribute.String("namespace", ref.Namespace),
+		attribute.String("target", ref.Target), attribute.String("name", ref.Name))
+	defer func() {
+		span.SetAttributes(attribute.Int("dirs.changed", changed))
+		tracing.End(span, err)
+	}()
+
+	logger := log.FromContext(ctx).Named(log.ComponentFilesystem)
+
+	for _, dir := range o.dataDirs() {
+		seeded := false
+		if dir.Template != nil && !pathExists(fsys, dir.Path) {
+			if err = seedDir(ctx, c, dir); err != nil {
+				return changed, err
 			}
+			seeded = true
+		}
+
+		var dirChanged bool
+		if dirChanged, err = ensureDir(fsys, dir.Path, dir.Uid, dir.Gid); err != nil {
+			return changed, err
+		}
+		if seeded || dirChanged {
+			changed++
+			logger.Debugf("%q created, and set uid: %v, gid: %v ", dir.Path, dir.Uid, dir.Gid)
+		}
+	}
+
+	return changed, nil
+}
+
+// currentNode returns the node with NodeIP, or nil.
+func currentNode(nodeList corev1.NodeList) *corev1.Node {
+	for i := range nodeList.Items {
+		if isCurrentNode(&nodeList.Items[i]) {
+			return nodeList.Items[i].DeepCopy()
+		}
+	}
+	return nil
+}
+
+func isCurrentNode(node *corev1.Node) bool {
+	for _, addr := range node.Status.Addresses {
+		if addr.Type == corev1.NodeInternalIP && addr.Address == NodeIP {
+			return true
 		}
 	}
 	return false
@@ -257,53 +297,45 @@ func (r *NodeInitController) isMasterNode(config *rest.Config) (bool, string, er
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *NodeInitController) SetupWithManager(mgr ctrl.Manager) error {
-	c, err := ctrl.NewControllerManagedBy(mgr).For(&corev1.Node{},
-		builder.WithPredicates(newCreateOnlyPredicate(nil))).Build(r)
+	r.recorder = newDedupRecorder(mgr.GetEventRecorderFor("osnode-init"), eventDedupWindow)
+	r.apiReader = mgr.GetAPIReader()
+
+	isMaster, _, err := r.isMasterNode(r.config)
 	if err != nil {
-		return errors.WithStack(err)
+		return errors.Errorf("get master node info: %v", err)
 	}
-
-	return c.Watch(&source.Kind{Type: &appsv1.StatefulSet{}},
-		handler.EnqueueRequestsFromMapFunc(func(o client.Object) []reconcile.Request {
-			return []reconcile.Request{{NamespacedName: types.NamespacedName{
-				Namespace: o.GetNamespace(),
-				Name:      o.GetName()}},
-			}
-		}), newCreateOnlyPredicate(func(e event.CreateEvent) bool {
-			sts, ok := e.Object.(*appsv1.StatefulSet)
-			if ok && isUserNamespaceBfl(sts.Namespace, sts.Name) {
-				return true
-			}
-			return false
-		}),
-	)
-}
-
-func filePathExists(name string) bool {
-	_, err := os.Stat(name)
-	if err != nil && os.IsNotExist(err) {
-		return false
+	r.status.setMaster(isMaster)
+	if isMaster {
+		if err = r.setupRefresh(mgr); err != nil {
+			return err
+		}
 	}
-	return true
-}
 
-func isUserNamespaceBfl(namespace, name string) bool {
-	return name == BflStatefulSetName && strings.HasPrefix(namespace, "user-space")
-}
-
-func hasAllAnnotations(annotations map[string]string, keys ...string) bool {
-	if annotations == nil {
-		return false
+	c, err := ctrl.NewControllerManagedBy(mgr).For(&corev1.Node{},
+		builder.WithPredicates(newNodePredicate())).Build(r)
+	if err != nil {
+		return errors.WithStack(err)
 	}
 
-	sb := sets.NewByte()
-
-	for _, key := range keys {
-		if v, ok := annotations[key]; ok && v != "" {
-			sb.Insert('y')
-		} else {
-			sb.Insert('n')
+	// a new target object, or a hostpath change of one, triggers a
+	// reconcile, which provisions them all
+	for _, kind := range targetKinds() {
+		err = c.Watch(&source.Kind{Type: newTargetObject(kind)},
+			handler.EnqueueRequestsFromMapFunc(func(o client.Object) []reconcile.Request {
+				return []reconcile.Request{{NamespacedName: types.NamespacedName{
+					Namespace: o.GetNamespace(),
+					Name:      o.GetName()}},
+				}
+			}), newTargetPredicate(),
+		)
+		if err != nil {
+			return errors.WithStack(err)
 		}
 	}
-	return sb.HasAll('y')
+
+	// a finished data migration lets its object be provisioned
+	if err = c.Watch(&source.Channel{Source: r.migrations.done}, &handler.EnqueueRequestForObject{}); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(mgr.Add(r.migrations))
 }
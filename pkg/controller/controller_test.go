@@ -1,7 +1,24 @@
 package controllers
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
 	"testing"
+	"time"
+
+	"bytetrade.io/web3os/osnode-init/pkg/cloud"
+	"bytetrade.io/web3os/osnode-init/pkg/nonce"
+	"github.com/pkg/errors"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/clock"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
 )
 
 func TestRand(t *testing.T) {
@@ -9,3 +26,132 @@ func TestRand(t *testing.T) {
 	println("schedule")
 
 }
+
+func TestAccountValueExpired(t *testing.T) {
+	want := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	for _, expired := range []string{
+		`1704164645`,
+		`1704164645000`,
+		`"1704164645000"`,
+		`"2024-01-02T03:04:05Z"`,
+	} {
+		var v AccountValue
+		if err := json.Unmarshal([]byte(`{"expired":`+expired+`}`), &v); err != nil {
+			t.Fatalf("%s: %v", expired, err)
+		}
+		if !v.Expired.Equal(want) {
+			t.Errorf("%s: got %v, want %v", expired, v.Expired, want)
+		}
+	}
+
+	var v AccountValue
+	if err := json.Unmarshal([]byte(`{"expired":null}`), &v); err != nil || !v.Expired.IsZero() {
+		t.Errorf("null expired: %v, %v", v.Expired, err)
+	}
+}
+
+func TestSetupTerminusNonceVersion(t *testing.T) {
+	old := terminusNonce
+	defer func() { terminusNonce = old }()
+	t.Setenv(nonce.EnvKey, "0123456789abcdef")
+
+	for env, v2 := range map[string]bool{"": false, "1": false, "2": true} {
+		t.Setenv("TERMINUS_NONCE_VERSION", env)
+		if err := SetupTerminusNonce(clock.RealClock{}); err != nil {
+			t.Fatal(err)
+		}
+		got, err := GenTerminusNonce()
+		if err != nil || !strings.HasPrefix(got, nonce.Prefix) || strings.HasPrefix(got, nonce.Prefix+"v2:") != v2 {
+			t.Errorf("TERMINUS_NONCE_VERSION=%q: nonce %q, %v", env, got, err)
+		}
+	}
+
+	t.Setenv("TERMINUS_NONCE_VERSION", "3")
+	if err := SetupTerminusNonce(clock.RealClock{}); err == nil {
+		t.Error("unknown nonce version accepted")
+	}
+}
+
+func TestRetryRevokedOwner(t *testing.T) {
+	revoked := fmt.Errorf("status 401: %w", cloud.ErrCredentialsRevoked)
+	stale, fresh := &AccountValue{Token: "stale"}, &AccountValue{Token: "fresh"}
+
+	for _, tc := range []struct {
+		name      string
+		refreshed *AccountValue
+		accepts   func(owner *AccountValue) bool
+		tokens    string
+		revoked   bool
+	}{
+		{"fresh owner", fresh, func(o *AccountValue) bool { return o == fresh }, "fresh", false},
+		{"owner is the problem", stale, func(o *AccountValue) bool { return o == nil }, "", false},
+		{"identity is the problem", fresh, func(*AccountValue) bool { return false }, "fresh,", true},
+	} {
+		var tokens []string
+		account, owner, err := retryRevokedOwner(context.Background(), stale,
+			func(context.Context) (*AccountValue, error) { return tc.refreshed, nil },
+			func(o *AccountValue) (*AWSAccount, error) {
+				if o != nil {
+					tokens = append(tokens, o.Token)
+				} else {
+					tokens = append(tokens, "")
+				}
+				if tc.accepts(o) {
+					return &AWSAccount{}, nil
+				}
+				return nil, revoked
+			})
+		if got := strings.Join(tokens, ","); got != tc.tokens {
+			t.Errorf("%s: requests with tokens %q, want %q", tc.name, got, tc.tokens)
+		}
+		if errors.Is(err, cloud.ErrCredentialsRevoked) != tc.revoked || (err == nil) != (account != nil) {
+			t.Errorf("%s: account %v, err %v", tc.name, account, err)
+		}
+		if owner != tc.refreshed {
+			t.Errorf("%s: owner %v, want the refreshed one", tc.name, owner)
+		}
+	}
+}
+
+func TestReconcileNewTargetIsNoDrift(t *testing.T) {
+	oldNodeIP, oldStateDir := NodeIP, migrationStateDir
+	defer func() { NodeIP, migrationStateDir = oldNodeIP, oldStateDir }()
+	NodeIP, migrationStateDir = "10.0.0.1", t.TempDir()
+
+	node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1"}, Status: corev1.NodeStatus{
+		Addresses: []corev1.NodeAddress{{Type: corev1.NodeInternalIP, Address: NodeIP}}}}
+	c := fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).WithObjects(node).Build()
+	recorder := record.NewFakeRecorder(20)
+	r := NewNodeInitController(c, nil, nil)
+	r.fs, r.recorder = newMemFS(), recorder
+	ctx := context.Background()
+
+	if _, err := r.Reconcile(ctx, ctrl.Request{}); err != nil {
+		t.Fatal(err)
+	}
+	// a new user, and one whose annotations are not set yet
+	for _, user := range []string{"alice", "bob"} {
+		sts := &appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{
+			Namespace: "user-space-" + user, Name: BflStatefulSetName, Labels: map[string]string{"tier": "bfl"}}}
+		if user == "alice" {
+			sts.Annotations = map[string]string{
+				BflAnnotationAppCache: "/olares/userdata/alice/appcache",
+				BflAnnotationDbData:   "/olares/userdata/alice/dbdata",
+			}
+		}
+		if err := c.Create(ctx, sts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		_, _ = r.Reconcile(ctx, ctrl.Request{})
+	}
+
+	close(recorder.Events)
+	for e := range recorder.Events {
+		if strings.Contains(e, EventReasonTaskDrift) {
+			t.Errorf("event %q", e)
+		}
+	}
+}
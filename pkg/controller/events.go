@@ -0,0 +1,172 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+)
+
+const (
+	EventReasonCredentialsFetched     = "CredentialsFetched"
+	EventReasonCredentialsApplied     = "CredentialsApplied"
+	EventReasonCredentialsFailed      = "CredentialsRotationFailed"
+	EventReasonDataDirsProvisioned    = "DataDirsProvisioned"
+	EventReasonDataDirsProvisionError = "DataDirsProvisionFailed"
+	EventReasonNodeProvisioned        = "NodeProvisioned"
+	EventReasonTaskDrift              = "TaskDrift"
+	EventReasonDataMigrationStarted   = "DataMigrationStarted"
+	EventReasonDataMigrationCompleted = "DataMigrationCompleted"
+	EventReasonDataMigrationFailed    = "DataMigrationFailed"
+	EventReasonDataMigrationSkipped   = "DataMigrationSkipped"
+
+	// eventDedupWindow is how long an identical event is suppressed.
+	eventDedupWindow = 30 * time.Minute
+)
+
+// dedupRecorder drops events identical to one sent within window, so a
+// failure repeating on every resync does not flood the API server.
+type dedupRecorder struct {
+	record.EventRecorder
+	window time.Duration
+
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+func newDedupRecorder(recorder record.EventRecorder, window time.Duration) *dedupRecorder {
+	return &dedupRecorder{EventRecorder: recorder, window: window, seen: map[string]time.Time{}}
+}
+
+func (d *dedupRecorder) Event(object runtime.Object, eventtype, reason, message string) {
+	if d.suppress(object, eventtype, reason, message) {
+		return
+	}
+	d.EventRecorder.Event(object, eventtype, reason, message)
+}
+
+func (d *dedupRecorder) Eventf(object runtime.Object, eventtype, reason, messageFmt string, args ...interface{}) {
+	d.Event(object, eventtype, reason, fmt.Sprintf(messageFmt, args...))
+}
+
+func (d *dedupRecorder) AnnotatedEventf(object runtime.Object, annotations map[string]string,
+	eventtype, reason, messageFmt string, args ...interface{}) {
+	message := fmt.Sprintf(messageFmt, args...)
+	if d.suppress(object, eventtype, reason, message) {
+		return
+	}
+	d.EventRecorder.AnnotatedEventf(object, annotations, eventtype, reason, "%s", message)
+}
+
+// requestIDPattern matches the uuids that make every Space error unique.
+var requestIDPattern = regexp.MustCompile(`[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}`)
+
+func (d *dedupRecorder) suppress(object runtime.Object, eventtype, reason, message string) bool {
+	// the same failure of another request is still the same event
+	message = requestIDPattern.ReplaceAllString(message, "<id>")
+	key := fmt.Sprintf("%s/%s/%s/%s", objectKey(object), eventtype, reason, message)
+	now := time.Now()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for k, t := range d.seen {
+		if now.Sub(t) > d.window {
+			delete(d.seen, k)
+		}
+	}
+	if t, ok := d.seen[key]; ok && now.Sub(t) <= d.window {
+		return true
+	}
+	d.seen[key] = now
+	return false
+}
+
+func objectKey(object runtime.Object) string {
+	if ref, ok := object.(*corev1.ObjectReference); ok {
+		return fmt.Sprintf("%s/%s/%s", ref.Kind, ref.Namespace, ref.Name)
+	}
+	m, err := meta.Accessor(object)
+	if err != nil {
+		return fmt.Sprintf("%T", object)
+	}
+	// typed objects from the cache have no kind set
+	kind := fmt.Sprintf("%T", object)
+	if gvk, err := apiutil.GVKForObject(object, clientgoscheme.Scheme); err == nil {
+		kind = gvk.Kind
+	}
+	return fmt.Sprintf("%s/%s/%s", kind, m.GetNamespace(), m.GetName())
+}
+
+// event is a nil safe shortcut, the recorder is only set once the
+// controller is registered with the manager.
+func (r *NodeInitController) event(object runtime.Object, eventtype, reason, messageFmt string, args ...interface{}) {
+	if r.recorder == nil || object == nil {
+		return
+	}
+	r.recorder.Eventf(object, eventtype, reason, messageFmt, args...)
+}
+
+// terminusRef references the cluster scoped Terminus object, which
+// credential rotation events are attached to.
+func terminusRef(ctx context.Context, client dynamic.Interface) *corev1.ObjectReference {
+	ref := &corev1.ObjectReference{
+		APIVersion: gvr.GroupVersion().String(),
+		Kind:       "Terminus",
+		Name:       "terminus",
+	}
+	if client != nil {
+		if data, err := client.Resource(gvr).Get(ctx, "terminus", metav1.GetOptions{}); err == nil {
+			ref.UID, ref.ResourceVersion = data.GetUID(), data.GetResourceVersion()
+		}
+	}
+	return ref
+}
+
+// recordRefreshEvents reports the outcome of a credential rotation.
+func (r *NodeInitController) recordRefreshEvents(ctx context.Context, result *RefreshResult, err error) {
+	if result == nil || result.Skipped || result.DryRun {
+		return
+	}
+	ref := terminusRef(ctx, r.dynamicClient)
+
+	if result.Fetched {
+		r.event(ref, corev1.EventTypeNormal, EventReasonCredentialsFetched,
+			"fetched s3 credentials for bucket %s from olares space, expire at %s", result.Bucket, result.Expiration)
+	}
+	if result.Applied {
+		r.event(ref, corev1.EventTypeNormal, EventReasonCredentialsApplied, "applied s3 credentials to juicefs")
+	}
+	if err != nil {
+		r.event(ref, corev1.EventTypeWarning, EventReasonCredentialsFailed, "credential rotation failed: %v", err)
+	}
+}
+
+// recordProvisionEvents reports provisioning on the target object, and
+// summarizes it on the node. Nothing is sent when all dirs were in place.
+func (r *NodeInitController) recordProvisionEvents(o targetObject, node *corev1.Node, changed int, err error) {
+	if err != nil {
+		r.event(o.Object, corev1.EventTypeWarning, EventReasonDataDirsProvisionError,
+			"provisioning data dirs on node %s failed: %v", NodeIP, err)
+		r.event(node, corev1.EventTypeWarning, EventReasonDataDirsProvisionError,
+			"provisioning data dirs of %s failed: %v", o.ref(), err)
+		return
+	}
+	if changed == 0 {
+		return
+	}
+	r.event(o.Object, corev1.EventTypeNormal, EventReasonDataDirsProvisioned,
+		"provisioned %d data dirs on node %s", changed, NodeIP)
+	r.event(node, corev1.EventTypeNormal, EventReasonNodeProvisioned,
+		"provisioned %d data dirs of %s", changed, o.ref())
+}
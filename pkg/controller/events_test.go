@@ -0,0 +1,42 @@
+package controllers
+
+import (
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestDedupRecorderIgnoresRequestIDs(t *testing.T) {
+	fake := record.NewFakeRecorder(10)
+	recorder := newDedupRecorder(fake, eventDedupWindow)
+	ref := &corev1.ObjectReference{Kind: "Terminus", Name: "terminus"}
+
+	for _, id := range []string{"0b8e4c1a-5f0e-4d8a-9c0b-6a1f2e3d4c5b", "9d2f7e6a-1b3c-4e5f-8a9b-0c1d2e3f4a5b"} {
+		recorder.Eventf(ref, corev1.EventTypeWarning, EventReasonCredentialsFailed,
+			"credential rotation failed: olares space request %s failed, status: 503", id)
+	}
+	recorder.Eventf(ref, corev1.EventTypeWarning, EventReasonCredentialsFailed,
+		"credential rotation failed: olares space request %s failed, status: 401", "9d2f7e6a-1b3c-4e5f-8a9b-0c1d2e3f4a5b")
+
+	if n := len(fake.Events); n != 2 {
+		t.Fatalf("%d events recorded, want 2", n)
+	}
+}
+
+func TestDedupRecorderKeysOnKind(t *testing.T) {
+	fake := record.NewFakeRecorder(10)
+	recorder := newDedupRecorder(fake, eventDedupWindow)
+
+	// typed objects as read from the cache, without their kind set
+	meta := metav1.ObjectMeta{Namespace: "user-space-alice", Name: "files"}
+	for _, object := range []runtime.Object{&appsv1.StatefulSet{ObjectMeta: meta}, &appsv1.Deployment{ObjectMeta: meta}} {
+		recorder.Event(object, corev1.EventTypeNormal, EventReasonDataDirsProvisioned, "created 1 data dirs")
+	}
+	if n := len(fake.Events); n != 2 {
+		t.Fatalf("%d events recorded, want one per kind", n)
+	}
+}
@@ -0,0 +1,87 @@
+package controllers
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// FileStat is what provisioning needs to know about a path.
+type FileStat struct {
+	Mode os.FileMode
+	Uid  int
+	Gid  int
+}
+
+// FileSystem is the part of the host filesystem that provisioning
+// touches. Seeding dirs from templates still writes through os directly.
+type FileSystem interface {
+	// Stat follows symlinks, like os.Stat. A missing path returns an
+	// error matching os.IsNotExist.
+	Stat(path string) (FileStat, error)
+	MkdirAll(path string, perm os.FileMode) error
+	Chown(path string, uid, gid int) error
+	Chmod(path string, mode os.FileMode) error
+}
+
+// hostFS is the filesystem of the node. It takes host paths, see
+// HostPaths.
+var hostFS FileSystem = osFS{}
+
+type osFS struct{}
+
+func (osFS) Stat(path string) (FileStat, error) {
+	fi, err := os.Stat(localPath(path))
+	if err != nil {
+		return FileStat{}, err
+	}
+	stat := fi.Sys().(*syscall.Stat_t)
+	return FileStat{Mode: fi.Mode(), Uid: int(stat.Uid), Gid: int(stat.Gid)}, nil
+}
+
+func (osFS) MkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(localPath(path), perm)
+}
+
+func (osFS) Chown(path string, uid, gid int) error {
+	return os.Chown(localPath(path), uid, gid)
+}
+
+func (osFS) Chmod(path string, mode os.FileMode) error {
+	return os.Chmod(localPath(path), mode)
+}
+
+// pathExists reports whether path exists. Errors other than not exist
+// count as existing, so the caller's next operation reports them.
+func pathExists(fsys FileSystem, path string) bool {
+	_, err := fsys.Stat(path)
+	return err == nil || !os.IsNotExist(err)
+}
+
+// ensureDir makes dir exist as a directory owned by uid:gid, and reports
+// whether anything was changed.
+func ensureDir(fsys FileSystem, dir string, uid, gid int) (changed bool, err error) {
+	stat, err := fsys.Stat(dir)
+	if os.IsNotExist(err) {
+		if err = fsys.MkdirAll(dir, 0755); err != nil {
+			return false, errors.WithStack(err)
+		}
+		changed = true
+		stat, err = fsys.Stat(dir)
+	}
+	if err != nil {
+		return changed, errors.WithStack(err)
+	}
+	if !stat.Mode.IsDir() {
+		return changed, errors.Errorf("%q exists and is not a directory", dir)
+	}
+
+	if stat.Uid == uid && stat.Gid == gid {
+		return changed, nil
+	}
+	if err = fsys.Chown(dir, uid, gid); err != nil {
+		return changed, errors.WithStack(err)
+	}
+	return true, nil
+}
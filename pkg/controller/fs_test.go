@@ -0,0 +1,125 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestEnsureDir(t *testing.T) {
+	const dir = "/olares/userdata/alice/appcache/launcher"
+	errDenied := os.ErrPermission
+
+	tests := []struct {
+		name    string
+		fs      *memFS
+		changed bool
+		wantErr bool
+	}{
+		{name: "missing", fs: newMemFS().dir("/olares/userdata/alice/appcache", 0, 0), changed: true},
+		{name: "missing parents", fs: newMemFS(), changed: true},
+		{name: "owner matches", fs: newMemFS().dir(dir, 1000, 1000)},
+		{name: "wrong uid", fs: newMemFS().dir(dir, 0, 1000), changed: true},
+		{name: "wrong gid", fs: newMemFS().dir(dir, 1000, 0), changed: true},
+		{name: "wrong owner", fs: newMemFS().dir(dir, 0, 0), changed: true},
+		{name: "is a file", fs: newMemFS().file(dir, 1000, 1000), wantErr: true},
+		{name: "parent is a file", fs: newMemFS().file("/olares/userdata", 0, 0), wantErr: true},
+		{name: "stat fails", fs: newMemFS().fail("stat", dir, errDenied), wantErr: true},
+		{name: "mkdir fails", fs: newMemFS().fail("mkdir", dir, errDenied), wantErr: true},
+		{name: "chown fails", fs: newMemFS().dir(dir, 0, 0).fail("chown", dir, errDenied), wantErr: true},
+		{name: "chown of new dir fails", fs: newMemFS().fail("chown", dir, errDenied), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			changed, err := ensureDir(tt.fs, dir, 1000, 1000)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if changed != tt.changed {
+				t.Fatalf("changed = %v, want %v", changed, tt.changed)
+			}
+			stat, err := tt.fs.Stat(dir)
+			if err != nil || !stat.Mode.IsDir() || stat.Uid != 1000 || stat.Gid != 1000 {
+				t.Fatalf("stat = %+v, %v", stat, err)
+			}
+		})
+	}
+}
+
+func TestCreateDataDirs(t *testing.T) {
+	oldTemplates := DirTemplates
+	defer func() { DirTemplates = oldTemplates }()
+	DirTemplates = map[string]*TemplateSource{}
+
+	sts := &appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{
+		Namespace: "user-space-alice",
+		Name:      BflStatefulSetName,
+		Annotations: map[string]string{
+			BflAnnotationAppCache: "/olares/userdata/alice/appcache",
+			BflAnnotationDbData:   "/olares/userdata/alice/dbdata",
+		},
+	}}
+	o := bflObject(sts)
+	dirs := o.dataDirs()
+	if len(dirs) < 2 {
+		t.Fatalf("want at least two dirs, got %v", dirs)
+	}
+
+	fsys := newMemFS()
+	// one dir is already right, one has the wrong owner
+	fsys.dir(dirs[0].Path, dirs[0].Uid, dirs[0].Gid)
+	fsys.dir(dirs[1].Path, dirs[1].Uid+1, dirs[1].Gid)
+
+	changed, err := createDataDirs(context.Background(), nil, fsys, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed != len(dirs)-1 {
+		t.Fatalf("changed = %d, want %d", changed, len(dirs)-1)
+	}
+	for _, state := range inspectDirs(fsys, dirs) {
+		if !state.Exists || !state.OwnerMatch {
+			t.Fatalf("%s not provisioned, %+v", state.Path, state)
+		}
+	}
+
+	// nothing left to do
+	if changed, err = createDataDirs(context.Background(), nil, fsys, o); err != nil || changed != 0 {
+		t.Fatalf("second run changed %d, %v", changed, err)
+	}
+
+	// a failure stops at the failing dir
+	fsys.dir(dirs[1].Path, 0, 0).fail("chown", dirs[1].Path, os.ErrPermission)
+	if _, err = createDataDirs(context.Background(), nil, fsys, o); !errors.Is(err, os.ErrPermission) {
+		t.Fatalf("err = %v, want permission denied", err)
+	}
+}
+
+func TestInspectDirs(t *testing.T) {
+	fsys := newMemFS().
+		dir("/data/ok", 1000, 1000).
+		dir("/data/owner", 0, 0).
+		file("/data/file", 1000, 1000)
+
+	dirs := []DataDir{
+		{Path: "/data/ok", Uid: 1000, Gid: 1000},
+		{Path: "/data/owner", Uid: 1000, Gid: 1000},
+		{Path: "/data/file", Uid: 1000, Gid: 1000},
+		{Path: filepath.Join("/data", "missing"), Uid: 1000, Gid: 1000},
+	}
+	want := []struct{ exists, ownerMatch bool }{{true, true}, {true, false}, {false, true}, {false, false}}
+
+	for i, state := range inspectDirs(fsys, dirs) {
+		if state.Exists != want[i].exists || state.OwnerMatch != want[i].ownerMatch {
+			t.Errorf("%s: exists %v ownerMatch %v, want %+v", state.Path, state.Exists, state.OwnerMatch, want[i])
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package controllers
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/healthz"
+)
+
+type HealthOptions struct {
+	// ReconcileFailureThreshold is how long a namespace may keep failing
+	// before the pod reports not ready.
+	ReconcileFailureThreshold time.Duration
+}
+
+// AddHealthChecks registers the named liveness and readiness checks, so
+// /readyz?verbose tells which one fails.
+func (r *NodeInitController) AddHealthChecks(mgr ctrl.Manager, opts HealthOptions) error {
+	// the host may be mounted above the Olares dir, e.g. its root at /host
+	root, mountPoint := localPath(HostRoot), localPath(HostRoot)
+	if mount, ok := HostPaths.MountOf(HostRoot); ok {
+		mountPoint = mount.Local
+	}
+	readyz := map[string]healthz.Checker{
+		"host-volume":    hostVolumeCheck(root, mountPoint),
+		"informer-cache": cacheSyncCheck(mgr.GetCache()),
+		"reconcile":      r.reconcileCheck(opts.ReconcileFailureThreshold),
+		"credentials":    r.credentialsCheck(),
+		"juicefs-config": r.juicefsConfigCheck(),
+	}
+	for name, check := range readyz {
+		if err := mgr.AddReadyzCheck(name, check); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	livez := map[string]healthz.Checker{
+		"ping":      healthz.Ping,
+		"scheduler": r.schedulerCheck(),
+	}
+	for name, check := range livez {
+		if err := mgr.AddHealthzCheck(name, check); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+// hostVolumeCheck fails when mountPoint is not mounted or root is not
+// writable.
+func hostVolumeCheck(root, mountPoint string) healthz.Checker {
+	return func(_ *http.Request) error {
+		mounted, err := isMountPoint(mountPoint)
+		if err != nil {
+			return err
+		}
+		if !mounted {
+			return errors.Errorf("%s is not mounted", mountPoint)
+		}
+
+		probe := filepath.Join(root, ".osnode-init-healthz")
+		if err = os.WriteFile(probe, []byte(time.Now().String()), 0600); err != nil {
+			return errors.Errorf("%s is not writable, %v", root, err)
+		}
+		return os.Remove(probe)
+	}
+}
+
+func isMountPoint(path string) (bool, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	defer f.Close()
+
+	path = filepath.Clean(path)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 4 && fields[4] == path {
+			return true, nil
+		}
+	}
+	return false, errors.WithStack(scanner.Err())
+}
+
+func cacheSyncCheck(c cache.Cache) healthz.Checker {
+	return func(req *http.Request) error {
+		ctx, cancel := context.WithTimeout(req.Context(), time.Second)
+		defer cancel()
+		if !c.WaitForCacheSync(ctx) {
+			return errors.New("informer caches are not synced")
+		}
+		return nil
+	}
+}
+
+func (r *NodeInitController) reconcileCheck(threshold time.Duration) healthz.Checker {
+	return func(_ *http.Request) error {
+		if threshold <= 0 {
+			return nil
+		}
+		var failing []string
+		for _, ns := range r.status.failingSince(time.Now().Add(-threshold)) {
+			failing = append(failing, ns.String()+": "+ns.Error)
+		}
+		if len(failing) > 0 {
+			return errors.Errorf("reconcile failing for more than %v, %s", threshold, strings.Join(failing, "; "))
+		}
+		return nil
+	}
+}
+
+// credentialsCheck only matters on the master node, which rotates them.
+func (r *NodeInitController) credentialsCheck() healthz.Checker {
+	return func(_ *http.Request) error {
+		expiresAt, ok := r.status.credentialsExpireAt()
+		if !ok {
+			return nil
+		}
+		if r.clock.Now().After(expiresAt) {
+			return errors.Errorf("s3 credentials expired at %v", expiresAt)
+		}
+		return nil
+	}
+}
+
+// juicefsConfigCheck fails on the master node when no supported juicefs
+// client was found or the juicefs redis config the credential rotation
+// needs cannot be read.
+func (r *NodeInitController) juicefsConfigCheck() healthz.Checker {
+	return func(_ *http.Request) error {
+		if !r.status.isMaster() || os.Getenv("S3_BUCKET") == "none" {
+			return nil
+		}
+		if err := r.status.juicefsError(); err != nil {
+			return err
+		}
+		_, _, err := getRedisIpAndPassword()
+		return err
+	}
+}
+
+// schedulerCheck fails when the refresh job is overdue, e.g. because the
+// scheduler stopped.
+func (r *NodeInitController) schedulerCheck() healthz.Checker {
+	return func(_ *http.Request) error {
+		if r.refresher == nil {
+			return nil
+		}
+		next := r.refresher.Next()
+		if !next.IsZero() && r.clock.Since(next) > schedulerGracePeriod {
+			return fmt.Errorf("refresh scheduled at %v did not start", next)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,217 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"bytetrade.io/web3os/osnode-init/pkg/log"
+	"bytetrade.io/web3os/osnode-init/pkg/task"
+	"github.com/pkg/errors"
+)
+
+// EnvHostPrerequisites points to the JSON file HostPrereqs is loaded from.
+const EnvHostPrerequisites = "HOST_PREREQUISITES"
+
+// sysctlMinPrefix marks a sysctl value as a minimum.
+const sysctlMinPrefix = "min:"
+
+// Built in host tasks.
+const (
+	TaskKernelModules = "kernel-modules"
+	TaskSysctls       = "sysctls"
+)
+
+// HostPrerequisites are the host settings user workloads rely on.
+type HostPrerequisites struct {
+	// Sysctls maps a key like vm.max_map_count to its value, which the host
+	// must have exactly. A value like "min:262144" is a minimum instead, a
+	// host with a larger value is left alone.
+	Sysctls map[string]string `json:"sysctls,omitempty"`
+	// KernelModules must be loaded, e.g. fuse for juicefs.
+	KernelModules []string `json:"kernelModules,omitempty"`
+}
+
+var (
+	// HostPrereqs is applied on every node, empty unless loaded with
+	// LoadHostPrerequisites, as changing the host needs a privileged pod.
+	HostPrereqs HostPrerequisites
+
+	procSysRoot    = "/proc/sys"
+	sysModuleRoot  = "/sys/module"
+	modprobeBinary = "modprobe"
+)
+
+// LoadHostPrerequisites replaces HostPrereqs with the content of a JSON
+// file.
+func LoadHostPrerequisites(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	var prereqs HostPrerequisites
+	if err = json.Unmarshal(data, &prereqs); err != nil {
+		return errors.Errorf("parse %s, %v", path, err)
+	}
+	for key, value := range prereqs.Sysctls {
+		if _, err = sysctlPath(key); err != nil {
+			return err
+		}
+		if strings.HasPrefix(value, sysctlMinPrefix) {
+			if _, err = strconv.ParseInt(sysctlValue(value), 10, 64); err != nil {
+				return errors.Errorf("sysctl %s, minimum %q is not a number", key, value)
+			}
+		}
+	}
+	HostPrereqs = prereqs
+	return nil
+}
+
+func sysctlPath(key string) (string, error) {
+	if key == "" || strings.Contains(key, "..") || strings.HasPrefix(key, "/") {
+		return "", errors.Errorf("invalid sysctl %q", key)
+	}
+	return filepath.Join(procSysRoot, strings.ReplaceAll(key, ".", "/")), nil
+}
+
+func readSysctl(key string) (string, error) {
+	path, err := sysctlPath(key)
+	if err != nil {
+		return "", err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return strings.Join(strings.Fields(string(data)), " "), nil
+}
+
+// sysctlValue is what is written for want.
+func sysctlValue(want string) string {
+	return strings.Join(strings.Fields(strings.TrimPrefix(want, sysctlMinPrefix)), " ")
+}
+
+// sysctlSatisfied compares like sysctl does, ignoring whitespace, and
+// accepts a larger value for a minimum.
+func sysctlSatisfied(actual, want string) bool {
+	if actual == sysctlValue(want) {
+		return true
+	}
+	if !strings.HasPrefix(want, sysctlMinPrefix) {
+		return false
+	}
+	a, errA := strconv.ParseInt(actual, 10, 64)
+	w, errW := strconv.ParseInt(sysctlValue(want), 10, 64)
+	return errA == nil && errW == nil && a >= w
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+type sysctlTask struct {
+	task.Base
+}
+
+func (sysctlTask) Name() string { return TaskSysctls }
+
+// DependsOn kernel modules, as some keys only exist once their module is
+// loaded, e.g. net.bridge.* with br_netfilter.
+func (sysctlTask) DependsOn() []string { return []string{TaskKernelModules} }
+
+func (sysctlTask) Run(ctx context.Context, _ *task.Node) error {
+	logger := log.FromContext(ctx)
+	var failed []string
+	for _, key := range sortedKeys(HostPrereqs.Sysctls) {
+		want := HostPrereqs.Sysctls[key]
+		actual, err := readSysctl(key)
+		if err == nil && sysctlSatisfied(actual, want) {
+			continue
+		}
+
+		path, _ := sysctlPath(key)
+		if err = os.WriteFile(path, []byte(sysctlValue(want)), 0644); err != nil {
+			failed = append(failed, key+": "+err.Error())
+			continue
+		}
+		logger.Infof("sysctl %s set to %s, was %q", key, sysctlValue(want), actual)
+	}
+	if len(failed) > 0 {
+		return errors.Errorf("set sysctls, %s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+func (sysctlTask) Verify(context.Context, *task.Node) error {
+	var drift []string
+	for _, key := range sortedKeys(HostPrereqs.Sysctls) {
+		want := HostPrereqs.Sysctls[key]
+		actual, err := readSysctl(key)
+		if err != nil {
+			drift = append(drift, key+" is unreadable")
+			continue
+		}
+		if !sysctlSatisfied(actual, want) {
+			drift = append(drift, key+"="+actual+", want "+want)
+		}
+	}
+	if len(drift) > 0 {
+		return errors.New(strings.Join(drift, "; "))
+	}
+	return nil
+}
+
+type kernelModulesTask struct {
+	task.Base
+}
+
+func (kernelModulesTask) Name() string { return TaskKernelModules }
+
+func moduleLoaded(name string) bool {
+	// built in modules show up in /sys/module as well, with - as _
+	_, err := os.Stat(filepath.Join(sysModuleRoot, strings.ReplaceAll(name, "-", "_")))
+	return err == nil
+}
+
+func (kernelModulesTask) Run(ctx context.Context, _ *task.Node) error {
+	logger := log.FromContext(ctx)
+	var failed []string
+	for _, name := range HostPrereqs.KernelModules {
+		if moduleLoaded(name) {
+			continue
+		}
+		out, err := exec.CommandContext(ctx, modprobeBinary, name).CombinedOutput()
+		if err != nil {
+			failed = append(failed, name+": "+strings.TrimSpace(string(out))+" "+err.Error())
+			continue
+		}
+		logger.Infof("kernel module %s loaded", name)
+	}
+	if len(failed) > 0 {
+		return errors.Errorf("load kernel modules, %s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+func (kernelModulesTask) Verify(context.Context, *task.Node) error {
+	var missing []string
+	for _, name := range HostPrereqs.KernelModules {
+		if !moduleLoaded(name) {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return errors.Errorf("kernel modules %s are not loaded", strings.Join(missing, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package controllers
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSysctlTask(t *testing.T) {
+	root := t.TempDir()
+	oldRoot, oldPrereqs := procSysRoot, HostPrereqs
+	defer func() { procSysRoot, HostPrereqs = oldRoot, oldPrereqs }()
+	procSysRoot = root
+
+	write := func(key, value string) {
+		path, _ := sysctlPath(key)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(value+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("vm.max_map_count", "65530")
+	write("fs.inotify.max_user_watches", "1048576")
+	write("net.ipv4.ip_local_port_range", "32768\t60999")
+	write("vm.swappiness", "60")
+
+	HostPrereqs = HostPrerequisites{Sysctls: map[string]string{
+		"vm.max_map_count":             "min:262144",
+		"fs.inotify.max_user_watches":  "min:524288",
+		"net.ipv4.ip_local_port_range": "32768 60999",
+		"vm.swappiness":                "10",
+	}}
+
+	task := sysctlTask{}
+	if err := task.Verify(context.Background(), nil); err == nil {
+		t.Fatal("vm.max_map_count should drift")
+	}
+	if err := task.Run(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := task.Verify(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// a larger value than wanted is kept
+	if v, _ := readSysctl("fs.inotify.max_user_watches"); v != "1048576" {
+		t.Fatalf("max_user_watches = %s, want it untouched", v)
+	}
+	if v, _ := readSysctl("vm.swappiness"); v != "10" {
+		t.Fatalf("swappiness = %s, want it lowered", v)
+	}
+}
+
+func TestSysctlSatisfied(t *testing.T) {
+	for _, tc := range []struct {
+		actual, want string
+		satisfied    bool
+	}{
+		{"262144", "262144", true},
+		{"1048576", "524288", false},
+		{"60", "10", false},
+		{"1", "0", false},
+		{"0", "0", true},
+		{"32768 60999", "32768  60999", true},
+		{"1048576", "min:524288", true},
+		{"65530", "min:262144", false},
+		{"0", "min:0", true},
+		{"abc", "min:1", false},
+	} {
+		if got := sysctlSatisfied(tc.actual, tc.want); got != tc.satisfied {
+			t.Errorf("sysctlSatisfied(%q, %q) = %v, want %v", tc.actual, tc.want, got, tc.satisfied)
+		}
+	}
+}
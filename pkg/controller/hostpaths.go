@@ -0,0 +1,36 @@
+package controllers
+
+import (
+	"path/filepath"
+
+	"bytetrade.io/web3os/osnode-init/pkg/hostpath"
+)
+
+// Env vars of the host path settings, see SetHostPaths.
+const (
+	EnvHostRoot   = "HOST_ROOT"
+	EnvHostMounts = "HOST_MOUNTS"
+)
+
+var (
+	// HostRoot is the Olares dir on the host.
+	HostRoot = "/olares"
+
+	// HostPaths maps host paths, e.g. from annotations, to where they are
+	// mounted in the pod. Without it they are used as they are.
+	HostPaths *hostpath.Mapper
+)
+
+// SetHostPaths sets the Olares dir on the host and how the host is mounted
+// into the pod, and derives the paths of the files the controller reads
+// and keeps there.
+func SetHostPaths(root string, paths *hostpath.Mapper) {
+	HostRoot, HostPaths = root, paths
+	migrationStateDir = localPath(filepath.Join(root, ".osnode-init", "migrations"))
+	redisConfPath = localPath(filepath.Join(root, "data/redis/etc/redis.conf"))
+}
+
+// localPath is where the host path p is in the pod.
+func localPath(p string) string {
+	return HostPaths.Local(p)
+}
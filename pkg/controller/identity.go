@@ -0,0 +1,174 @@
+package controllers
+
+import (
+	"context"
+	"crypto/ed25519"
+	"os"
+
+	"bytetrade.io/web3os/osnode-init/pkg/cloud"
+	"bytetrade.io/web3os/osnode-init/pkg/log"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	identitySecretName = "osnode-init-cluster-identity"
+
+	identityKeyClusterID      = "cluster-id"
+	identityKeyPrivateKey     = "private-key"
+	identityKeySpacePublicKey = "space-public-key"
+	// identityKeyBootstrapToken holds an optional one-time token from Space,
+	// put there by hand to recover a cluster whose STS credentials are lost.
+	identityKeyBootstrapToken = "bootstrap-token"
+)
+
+// identityStore keeps the cluster identity in a Secret, so it survives pod
+// restarts and is shared by every replica.
+type identityStore struct {
+	kubeClient kubernetes.Interface
+	namespace  string
+}
+
+func newIdentityStore(kubeClient kubernetes.Interface) *identityStore {
+	namespace := os.Getenv("POD_NAMESPACE")
+	if namespace == "" {
+		namespace = "os-system"
+	}
+	return &identityStore{kubeClient: kubeClient, namespace: namespace}
+}
+
+// load returns the stored identity, generating and saving a new one on
+// first run or when the cluster id has changed.
+func (s *identityStore) load(ctx context.Context, clusterId string) (*cloud.Identity, *corev1.Secret, error) {
+	logger := log.FromContext(ctx)
+	secret, err := s.kubeClient.CoreV1().Secrets(s.namespace).Get(ctx, identitySecretName, metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return nil, nil, errors.WithStack(err)
+	}
+
+	if err == nil && string(secret.Data[identityKeyClusterID]) == clusterId &&
+		len(secret.Data[identityKeyPrivateKey]) == ed25519.PrivateKeySize {
+		identity := &cloud.Identity{
+			ClusterID:  clusterId,
+			PrivateKey: secret.Data[identityKeyPrivateKey],
+		}
+		if v := secret.Data[identityKeySpacePublicKey]; len(v) == ed25519.PublicKeySize {
+			identity.SpacePublicKey = v
+		}
+		return identity, secret, nil
+	}
+
+	logger.Infof("generating cluster identity for %q", clusterId)
+	identity, err := cloud.NewIdentity(clusterId)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+	if secret, err = s.save(ctx, secret, identity); err != nil {
+		return nil, nil, err
+	}
+	return identity, secret, nil
+}
+
+// save writes identity into secret, creating the Secret if it is nil.
+func (s *identityStore) save(ctx context.Context, secret *corev1.Secret, identity *cloud.Identity) (*corev1.Secret, error) {
+	if secret == nil || secret.Name == "" {
+		secret = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: identitySecretName, Namespace: s.namespace},
+			Type:       corev1.SecretTypeOpaque,
+		}
+	}
+	if secret.Data == nil {
+		secret.Data = map[string][]byte{}
+	}
+	secret.Data[identityKeyClusterID] = []byte(identity.ClusterID)
+	secret.Data[identityKeyPrivateKey] = identity.PrivateKey
+	if identity.Registered() {
+		secret.Data[identityKeySpacePublicKey] = identity.SpacePublicKey
+		// the bootstrap token is single use
+		delete(secret.Data, identityKeyBootstrapToken)
+	} else {
+		delete(secret.Data, identityKeySpacePublicKey)
+	}
+
+	secrets := s.kubeClient.CoreV1().Secrets(s.namespace)
+	var err error
+	if secret.ResourceVersion == "" {
+		secret, err = secrets.Create(ctx, secret, metav1.CreateOptions{})
+	} else {
+		secret, err = secrets.Update(ctx, secret, metav1.UpdateOptions{})
+	}
+	return secret, errors.WithStack(err)
+}
+
+// ensureRegistered registers identity with Space if it is not yet. The
+// legacy STS credentials are used as proof first, then the owner's Space
+// account if known. The bootstrap token from the Secret is the last resort
+// when both have been lost or expired.
+func (s *identityStore) ensureRegistered(ctx context.Context, secret *corev1.Secret,
+	identity *cloud.Identity, ak, sk, st string, owner *AccountValue) (*corev1.Secret, error) {
+	logger := log.FromContext(ctx)
+	if identity.Registered() {
+		return secret, nil
+	}
+
+	spaceClient := cloud.NewClient(cloud.WithIdentity(identity), cloud.WithLogger(logger.Named(log.ComponentCloud)))
+	req := &cloud.RegisterIdentityRequest{Identity: identity, AccessKey: ak, SecretKey: sk, SessionToken: st}
+
+	var (
+		spaceKey ed25519.PublicKey
+		err      error
+	)
+	if ak != "" {
+		logger.Infof("registering cluster identity %s with olares space", identity.KeyID())
+		spaceKey, err = spaceClient.RegisterIdentity(ctx, req)
+	} else {
+		err = cloud.ErrCredentialsRevoked
+	}
+
+	if errors.Is(err, cloud.ErrCredentialsRevoked) && owner != nil {
+		logger.Warn("cluster credentials rejected, registering cluster identity with the owner space account")
+		spaceKey, err = spaceClient.RegisterIdentity(ctx, &cloud.RegisterIdentityRequest{
+			Identity:  identity,
+			UserID:    owner.Userid,
+			UserToken: owner.Token,
+		})
+	}
+
+	if errors.Is(err, cloud.ErrCredentialsRevoked) {
+		token := string(secret.Data[identityKeyBootstrapToken])
+		if token == "" {
+			token = os.Getenv("OLARES_SPACE_BOOTSTRAP_TOKEN")
+		}
+		if token == "" {
+			return secret, errors.Errorf("cluster credentials are not accepted by olares space, "+
+				"put a bootstrap token into secret %s/%s key %q to recover",
+				s.namespace, identitySecretName, identityKeyBootstrapToken)
+		}
+
+		logger.Warn("cluster credentials rejected, registering cluster identity with bootstrap token")
+		spaceKey, err = spaceClient.RegisterIdentity(ctx, &cloud.RegisterIdentityRequest{
+			Identity:       identity,
+			BootstrapToken: token,
+		})
+	}
+	if err != nil {
+		return secret, err
+	}
+
+	identity.SpacePublicKey = spaceKey
+	return s.save(ctx, secret, identity)
+}
+
+// reset drops the registration, so the next refresh re-registers a newly
+// generated key.
+func (s *identityStore) reset(ctx context.Context, secret *corev1.Secret, clusterId string) (*cloud.Identity, *corev1.Secret, error) {
+	identity, err := cloud.NewIdentity(clusterId)
+	if err != nil {
+		return nil, secret, errors.WithStack(err)
+	}
+	secret, err = s.save(ctx, secret, identity)
+	return identity, secret, err
+}
@@ -0,0 +1,326 @@
+package controllers
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"bytetrade.io/web3os/osnode-init/pkg/cloud"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/dynamic"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func requireRoot(t *testing.T) {
+	t.Helper()
+	if os.Geteuid() != 0 {
+		t.Skip("provisioning chowns dirs, run as root")
+	}
+}
+
+func (h *hostEnv) createBfl(namespace string, annotations map[string]string) *appsv1.StatefulSet {
+	h.t.Helper()
+	h.createNamespace(namespace)
+
+	labels := map[string]string{"tier": "bfl", "app": "bfl"}
+	sts := &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   namespace,
+			Name:        BflStatefulSetName,
+			Labels:      labels,
+			Annotations: annotations,
+		},
+		Spec: appsv1.StatefulSetSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: labels},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: labels},
+				Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "bfl", Image: "bfl"}}},
+			},
+		},
+	}
+	if err := h.client.Create(h.ctx, sts); err != nil {
+		h.t.Fatal(err)
+	}
+	h.t.Cleanup(func() { _ = h.client.Delete(context.Background(), sts) })
+	return sts
+}
+
+func (h *hostEnv) bflAnnotations(user string) map[string]string {
+	return map[string]string{
+		BflAnnotationAppCache: filepath.Join(h.root, "userdata", user, "appcache"),
+		BflAnnotationDbData:   filepath.Join(h.root, "userdata", user, "dbdata"),
+	}
+}
+
+func ownedBy(path string, uid, gid int) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	stat := fi.Sys().(*syscall.Stat_t)
+	if int(stat.Uid) != uid || int(stat.Gid) != gid {
+		return fmt.Errorf("%s is owned by %d:%d, want %d:%d", path, stat.Uid, stat.Gid, uid, gid)
+	}
+	return nil
+}
+
+func TestIntegrationProvisionOnBflCreate(t *testing.T) {
+	h := newHostEnv(t)
+	requireRoot(t)
+	h.createNode(false)
+	h.startManager()
+
+	annotations := h.bflAnnotations("alice")
+	h.createBfl("user-space-alice", annotations)
+
+	eventually(t, 10*time.Second, func() error {
+		for name, perm := range AppSubDirs {
+			if err := ownedBy(filepath.Join(annotations[BflAnnotationAppCache], name), perm[0], perm[1]); err != nil {
+				return err
+			}
+		}
+		for name, perm := range DbDataSubDirs {
+			if err := ownedBy(filepath.Join(annotations[BflAnnotationDbData], name), perm[0], perm[1]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func TestIntegrationHostpathUpdate(t *testing.T) {
+	h := newHostEnv(t)
+	requireRoot(t)
+	h.createNode(false)
+	h.startManager()
+
+	provisioned := func(annotations map[string]string) func() error {
+		return func() error {
+			for name, perm := range AppSubDirs {
+				if err := ownedBy(filepath.Join(annotations[BflAnnotationAppCache], name), perm[0], perm[1]); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+	sts := h.createBfl("user-space-carol", h.bflAnnotations("carol"))
+	eventually(t, 10*time.Second, provisioned(h.bflAnnotations("carol")))
+
+	// changing the hostpath of the live bfl alone reconciles
+	moved := h.bflAnnotations("carol-moved")
+	if err := h.client.Get(h.ctx, client.ObjectKeyFromObject(sts), sts); err != nil {
+		t.Fatal(err)
+	}
+	sts.Annotations = moved
+	if err := h.client.Update(h.ctx, sts); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, 10*time.Second, provisioned(moved))
+}
+
+func TestIntegrationMissingAnnotations(t *testing.T) {
+	h := newHostEnv(t)
+	h.createNode(false)
+	r := h.startManager()
+
+	h.createBfl("user-space-bob", nil)
+
+	eventually(t, 10*time.Second, func() error {
+		for _, ns := range r.Status().Namespaces {
+			if ns.Namespace == "user-space-bob" && strings.Contains(ns.Error, "no userdata annotation") {
+				return nil
+			}
+		}
+		return fmt.Errorf("no annotation error recorded, %+v", r.Status().Namespaces)
+	})
+}
+
+func TestIntegrationOwnershipCorrection(t *testing.T) {
+	h := newHostEnv(t)
+	requireRoot(t)
+	h.createNode(false)
+
+	annotations := h.bflAnnotations("carol")
+	launcher := filepath.Join(annotations[BflAnnotationAppCache], "launcher")
+	if err := os.MkdirAll(launcher, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chown(launcher, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(launcher, "keep"), []byte("user data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	h.startManager()
+	h.createBfl("user-space-carol", annotations)
+
+	perm := AppSubDirs["launcher"]
+	eventually(t, 10*time.Second, func() error { return ownedBy(launcher, perm[0], perm[1]) })
+	if data, err := os.ReadFile(filepath.Join(launcher, "keep")); err != nil || string(data) != "user data" {
+		t.Fatalf("existing data changed, %q, %v", data, err)
+	}
+}
+
+func TestIntegrationMasterDetection(t *testing.T) {
+	for _, master := range []bool{true, false} {
+		t.Run(fmt.Sprintf("master=%v", master), func(t *testing.T) {
+			h := newHostEnv(t)
+			h.createNode(master)
+			r := h.startManager()
+
+			if got := r.Status().Master; got != master {
+				t.Fatalf("master = %v, want %v", got, master)
+			}
+			if _, err := r.TriggerRefresh(h.ctx); !master && err == nil {
+				t.Fatal("refresh should be refused on a worker node")
+			}
+		})
+	}
+}
+
+// fakeSpace answers identity registration and STS token requests, and
+// signs its responses like Olares Space.
+type fakeSpace struct {
+	*httptest.Server
+	key     ed25519.PrivateKey
+	account cloud.AWSAccount
+}
+
+func newFakeSpace(t *testing.T, account cloud.AWSAccount) *fakeSpace {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeSpace{key: key, account: account}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *fakeSpace) serve(w http.ResponseWriter, r *http.Request) {
+	_, _ = io.Copy(io.Discard, r.Body)
+
+	var body []byte
+	switch r.URL.Path {
+	case "/v1/resource/cluster/identity/register":
+		pub := s.key.Public().(ed25519.PublicKey)
+		body, _ = json.Marshal(map[string]interface{}{
+			"code": http.StatusOK,
+			"data": map[string]string{"spacePublicKey": base64.StdEncoding.EncodeToString(pub)},
+		})
+	case "/v1/resource/stsToken/setup":
+		body, _ = json.Marshal(map[string]interface{}{"code": http.StatusOK, "data": s.account})
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	requestID := r.Header.Get(cloud.HeaderRequestID)
+	sum := sha256.Sum256(body)
+	sig := ed25519.Sign(s.key, []byte(requestID+"\n"+hex.EncodeToString(sum[:])))
+	w.Header().Set(cloud.HeaderRequestID, requestID)
+	w.Header().Set(cloud.HeaderSpaceSignature, base64.StdEncoding.EncodeToString(sig))
+	_, _ = w.Write(body)
+}
+
+func TestIntegrationCredentialRefresh(t *testing.T) {
+	h := newHostEnv(t)
+	h.createNode(true)
+	h.createNamespace("os-system")
+	t.Setenv("POD_NAMESPACE", "os-system")
+	t.Setenv("S3_BUCKET", "olares-test")
+
+	space := newFakeSpace(t, cloud.AWSAccount{
+		Bucket:     "olares-test",
+		Prefix:     "custom-prefix",
+		Key:        "new-ak",
+		Secret:     "new-sk",
+		Token:      "new-st",
+		Expiration: fmt.Sprint(time.Now().Add(12 * time.Hour).UnixMilli()),
+	})
+	t.Setenv(cloud.EnvBaseURL, space.URL)
+
+	// the fake juicefs records how it was called
+	juicefsArgs := filepath.Join(h.root, "juicefs.args")
+	script := "#!/bin/sh\n[ \"$1\" = --version ] && echo \"juicefs version 1.1.0\" && exit 0\n" +
+		"echo \"$@\" > " + juicefsArgs + "\n"
+	if err := os.WriteFile(JuicefsSearchPaths[0], []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(redisConfPath, []byte("bind 127.0.0.1\nrequirepass secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	dc, err := dynamic.NewForConfig(testConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	terminus := &unstructured.Unstructured{}
+	terminus.SetAPIVersion(gvr.GroupVersion().String())
+	terminus.SetKind("Terminus")
+	terminus.SetName("terminus")
+	terminus.SetLabels(map[string]string{LABEL_CLUSTER_ID: "cluster-1"})
+	terminus.SetAnnotations(map[string]string{
+		LABEL_ACCESS_KEY:    "old-ak",
+		LABEL_SECRET_KEY:    "old-sk",
+		LABEL_SESSION_TOKEN: "old-st",
+	})
+	if _, err = dc.Resource(gvr).Create(h.ctx, terminus, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = dc.Resource(gvr).Delete(context.Background(), "terminus", metav1.DeleteOptions{}) })
+
+	r := h.startManager()
+	result, err := r.TriggerRefresh(h.ctx)
+	if err != nil {
+		t.Fatalf("refresh: %v, %+v", err, result)
+	}
+	if !result.Applied {
+		t.Fatalf("credentials not applied, %+v", result)
+	}
+	if result.ClusterId != "cluster-1" || result.Prefix != "custom-prefix" {
+		t.Fatalf("cluster id %q, prefix %q", result.ClusterId, result.Prefix)
+	}
+
+	updated, err := dc.Resource(gvr).Get(h.ctx, "terminus", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := updated.GetAnnotations()
+	if a[LABEL_ACCESS_KEY] != "new-ak" || a[LABEL_SECRET_KEY] != "new-sk" || a[LABEL_SESSION_TOKEN] != "new-st" {
+		t.Fatalf("terminus annotations not updated, %v", a)
+	}
+
+	args, err := os.ReadFile(juicefsArgs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(args), "--access-key new-ak") ||
+		!strings.Contains(string(args), "redis://:secret@127.0.0.1:6379/1") ||
+		!strings.HasSuffix(strings.TrimSpace(string(args)), "--yes") {
+		t.Fatalf("juicefs called with %q", args)
+	}
+
+	if expiresAt, ok := r.status.credentialsExpireAt(); !ok || expiresAt.Before(time.Now()) {
+		t.Fatalf("credential expiry not recorded, %v %v", expiresAt, ok)
+	}
+}
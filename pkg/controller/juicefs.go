@@ -0,0 +1,62 @@
+package controllers
+
+import (
+	"context"
+	"time"
+
+	"bytetrade.io/web3os/osnode-init/pkg/juicefs"
+	"bytetrade.io/web3os/osnode-init/pkg/log"
+	"github.com/pkg/errors"
+)
+
+// JuicefsStatus is the juicefs client the credentials are applied with, or
+// why there is none.
+type JuicefsStatus struct {
+	*juicefs.Binary `json:",omitempty"`
+	DetectedAt      time.Time `json:"detectedAt"`
+	Error           string    `json:"error,omitempty"`
+	// Unsupported is set when a client was found but of a version the
+	// credentials cannot be applied with.
+	Unsupported bool `json:"unsupported,omitempty"`
+}
+
+// juicefsClient returns the client found before, or looks for it again
+// until one is found, e.g. after juicefs is installed or upgraded.
+func (r *NodeInitController) juicefsClient(ctx context.Context) (*juicefs.Binary, error) {
+	r.juicefsMu.Lock()
+	defer r.juicefsMu.Unlock()
+	if r.juicefs != nil {
+		return r.juicefs, nil
+	}
+
+	binary, err := findJuicefs(ctx)
+	r.status.recordJuicefs(binary, err)
+	if err != nil {
+		return nil, err
+	}
+	r.juicefs = binary
+	return binary, nil
+}
+
+// forgetJuicefs makes the next refresh look for the client again, after
+// it rejected the flags its version should have.
+func (r *NodeInitController) forgetJuicefs() {
+	r.juicefsMu.Lock()
+	defer r.juicefsMu.Unlock()
+	r.juicefs = nil
+}
+
+// detectJuicefs looks for the client at startup, so an unusable one shows
+// in the status and health before the first refresh.
+func (r *NodeInitController) detectJuicefs(ctx context.Context) {
+	logger := log.FromContext(ctx).Named(log.ComponentController)
+	binary, err := r.juicefsClient(ctx)
+	switch {
+	case errors.Is(err, juicefs.ErrUnsupportedVersion):
+		logger.Errorf("credentials will not be refreshed until juicefs is upgraded, %v", err)
+	case err != nil:
+		logger.Warnf("credentials will not be refreshed until juicefs is found, %v", err)
+	default:
+		logger.Infof("found juicefs %s at %s, capabilities %+v", binary.Version, binary.Path, binary.Capabilities)
+	}
+}
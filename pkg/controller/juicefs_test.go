@@ -0,0 +1,50 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"bytetrade.io/web3os/osnode-init/pkg/juicefs"
+	"k8s.io/client-go/rest"
+)
+
+func TestRefreshRefusesUnsupportedJuicefs(t *testing.T) {
+	oldPaths := JuicefsSearchPaths
+	defer func() { JuicefsSearchPaths = oldPaths }()
+	JuicefsSearchPaths = []string{filepath.Join(t.TempDir(), "juicefs")}
+	install := func(version string) {
+		script := "#!/bin/sh\necho \"juicefs version " + version + "\"\n"
+		if err := os.WriteFile(JuicefsSearchPaths[0], []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := NewNodeInitController(nil, nil, nil)
+	r.status.setMaster(true)
+	install("0.17.5")
+
+	// Space is never asked for a token the client cannot apply
+	result, err := RefreshCredentials(context.Background(), &rest.Config{Host: "http://127.0.0.1:1"}, nil,
+		RefreshOptions{Bucket: "olares-test", FindJuicefs: r.juicefsClient})
+	if !errors.Is(err, juicefs.ErrUnsupportedVersion) || result.Fetched || result.Error == "" {
+		t.Fatalf("result %+v, err %v", result, err)
+	}
+	if s := r.status.snapshot(newMemFS()).Credentials.Juicefs; s == nil || !s.Unsupported || s.Binary != nil {
+		t.Fatalf("juicefs status %+v", s)
+	}
+	if r.juicefsConfigCheck()(nil) == nil {
+		t.Fatal("health check passed with an unsupported juicefs")
+	}
+
+	install("1.1.0")
+	binary, err := r.juicefsClient(context.Background())
+	if err != nil || binary.Version != (juicefs.Version{Major: 1, Minor: 1}) || !binary.Capabilities.Yes {
+		t.Fatalf("found %+v, %v", binary, err)
+	}
+	if s := r.status.snapshot(newMemFS()).Credentials.Juicefs; s.Unsupported || s.Error != "" || s.Path != JuicefsSearchPaths[0] {
+		t.Fatalf("juicefs status %+v", s)
+	}
+}
@@ -0,0 +1,313 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"bytetrade.io/web3os/osnode-init/pkg/log"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	ManifestVersion = 1
+	// ManifestKey is the ConfigMap key a manifest is stored under.
+	ManifestKey = "manifest.json"
+)
+
+// ManifestDir is a user data dir as exported from a node.
+type ManifestDir struct {
+	Namespace string `json:"namespace"`
+	Path      string `json:"path"`
+	Uid       int    `json:"uid"`
+	Gid       int    `json:"gid"`
+	// Mode is the octal permission, e.g. "0755".
+	Mode string `json:"mode"`
+}
+
+func (d *ManifestDir) perm() (os.FileMode, error) {
+	mode, err := strconv.ParseUint(d.Mode, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, errors.Errorf("invalid mode %q of %q", d.Mode, d.Path)
+	}
+	return os.FileMode(mode), nil
+}
+
+// Manifest lists the user data dirs of a node with their owner and mode,
+// so they can be restored after the raw files were, e.g. on a rebuilt
+// node.
+type Manifest struct {
+	Version   int           `json:"version"`
+	Node      string        `json:"node"`
+	CreatedAt time.Time     `json:"createdAt"`
+	Dirs      []ManifestDir `json:"dirs"`
+}
+
+// ExportManifest lists the data dirs of every user on this node. Dirs that
+// exist are exported as they are, missing ones with the owner they should
+// have.
+func ExportManifest(ctx context.Context, c client.Reader) (*Manifest, error) {
+	node, err := findNode(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	return exportManifest(ctx, c, hostFS, node)
+}
+
+func exportManifest(ctx context.Context, c client.Reader, fsys FileSystem, node *corev1.Node) (*Manifest, error) {
+	results, err := verifyNode(ctx, c, fsys, node)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Manifest{Version: ManifestVersion, Node: NodeIP, CreatedAt: time.Now().UTC()}
+	for _, result := range results {
+		if result.Error != "" {
+			log.FromContext(ctx).Warnf("skip %q in manifest, %s", result.Namespace, result.Error)
+			continue
+		}
+		for _, d := range result.Dirs {
+			dir := ManifestDir{Namespace: result.Namespace, Path: d.Path, Uid: d.Uid, Gid: d.Gid, Mode: "0755"}
+			if stat, err := fsys.Stat(d.Path); err == nil && stat.Mode.IsDir() {
+				dir.Uid, dir.Gid = stat.Uid, stat.Gid
+				dir.Mode = fmt.Sprintf("%04o", stat.Mode.Perm())
+			}
+			m.Dirs = append(m.Dirs, dir)
+		}
+	}
+	sort.Slice(m.Dirs, func(i, j int) bool { return m.Dirs[i].Path < m.Dirs[j].Path })
+	return m, nil
+}
+
+// RestoreOptions tunes RestoreManifest.
+type RestoreOptions struct {
+	// DryRun only reports what would change.
+	DryRun bool
+	// AnyNode restores a manifest exported from another node, e.g. when
+	// the rebuilt node got a new IP.
+	AnyNode bool
+	// Namespace restores only the dirs of this user namespace.
+	Namespace string
+}
+
+// RestoredDir is what RestoreManifest did to a dir.
+type RestoredDir struct {
+	ManifestDir
+	Created bool   `json:"created,omitempty"`
+	Chowned bool   `json:"chowned,omitempty"`
+	Chmoded bool   `json:"chmoded,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// RestoreResult describes a manifest restore.
+type RestoreResult struct {
+	Node   string        `json:"node"`
+	DryRun bool          `json:"dryRun,omitempty"`
+	Dirs   []RestoredDir `json:"dirs"`
+}
+
+// Changed counts the dirs that were, or in a dry run would be, changed.
+func (r *RestoreResult) Changed() int {
+	var n int
+	for _, d := range r.Dirs {
+		if d.Created || d.Chowned || d.Chmoded {
+			n++
+		}
+	}
+	return n
+}
+
+// RestoreManifest recreates the missing dirs of m and resets the owner and
+// mode of the others. Only the data dirs of the current target objects are
+// touched, other dirs of m fail. It goes on after a dir fails and returns
+// an error naming how many did.
+func RestoreManifest(ctx context.Context, c client.Reader, m *Manifest, opts RestoreOptions) (*RestoreResult, error) {
+	return restoreManifest(ctx, c, hostFS, m, opts)
+}
+
+func restoreManifest(ctx context.Context, c client.Reader, fsys FileSystem, m *Manifest, opts RestoreOptions) (*RestoreResult, error) {
+	if m.Version != ManifestVersion {
+		return nil, errors.Errorf("unsupported manifest version %d", m.Version)
+	}
+	if m.Node != NodeIP && !opts.AnyNode {
+		return nil, errors.Errorf("manifest is of node %s, not %s", m.Node, NodeIP)
+	}
+	// a manifest can be posted to the admin api, it must not chown just
+	// any path as root
+	allowed, err := targetDataDirs(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+
+	logger := log.FromContext(ctx).Named(log.ComponentFilesystem)
+	result := &RestoreResult{Node: NodeIP, DryRun: opts.DryRun}
+	var failed int
+	for _, dir := range m.Dirs {
+		if opts.Namespace != "" && dir.Namespace != opts.Namespace {
+			continue
+		}
+		restored := RestoredDir{ManifestDir: dir}
+		if !allowed[filepath.Clean(dir.Path)] {
+			restored.Error = "not a data dir of a current target object"
+			logger.Warnf("refuse to restore %q, %s", dir.Path, restored.Error)
+			failed++
+		} else if err := restoreDir(fsys, &restored, opts.DryRun); err != nil {
+			restored.Error = err.Error()
+			logger.Errorf("restore %q, %v", dir.Path, err)
+			failed++
+		} else if restored.Created || restored.Chowned || restored.Chmoded {
+			logger.Infof("restored %q, uid: %d, gid: %d, mode: %s", dir.Path, dir.Uid, dir.Gid, dir.Mode)
+		}
+		result.Dirs = append(result.Dirs, restored)
+	}
+
+	if failed > 0 {
+		return result, errors.Errorf("%d of %d dirs failed to restore", failed, len(result.Dirs))
+	}
+	return result, nil
+}
+
+// targetDataDirs are the data dirs of every target object, wherever its
+// pods run.
+func targetDataDirs(ctx context.Context, c client.Reader) (map[string]bool, error) {
+	objects, err := listTargets(ctx, c, "")
+	if err != nil {
+		return nil, err
+	}
+	dirs := map[string]bool{}
+	for _, o := range objects {
+		if len(o.missingAnnotations()) > 0 {
+			continue
+		}
+		for _, d := range o.dataDirs() {
+			dirs[filepath.Clean(d.Path)] = true
+		}
+	}
+	return dirs, nil
+}
+
+func restoreDir(fsys FileSystem, dir *RestoredDir, dryRun bool) error {
+	perm, err := dir.perm()
+	if err != nil {
+		return err
+	}
+
+	stat, err := fsys.Stat(dir.Path)
+	switch {
+	case os.IsNotExist(err):
+		dir.Created, dir.Chowned, dir.Chmoded = true, true, true
+	case err != nil:
+		return errors.WithStack(err)
+	case !stat.Mode.IsDir():
+		return errors.Errorf("%q exists and is not a directory", dir.Path)
+	default:
+		dir.Chowned = stat.Uid != dir.Uid || stat.Gid != dir.Gid
+		dir.Chmoded = stat.Mode.Perm() != perm
+	}
+	if dryRun {
+		return nil
+	}
+
+	if _, err = ensureDir(fsys, dir.Path, dir.Uid, dir.Gid); err != nil {
+		return err
+	}
+	if dir.Chmoded {
+		return errors.WithStack(fsys.Chmod(dir.Path, perm))
+	}
+	return nil
+}
+
+// ReadManifestFile reads a manifest written by WriteManifestFile.
+func ReadManifestFile(path string) (*Manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return decodeManifest(data)
+}
+
+// WriteManifestFile writes m as JSON to path.
+func WriteManifestFile(path string, m *Manifest) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.WriteFile(path, append(data, '\n'), 0600))
+}
+
+// ReadManifestConfigMap reads a manifest saved by SaveManifestConfigMap,
+// ref is "namespace/name".
+func ReadManifestConfigMap(ctx context.Context, c client.Reader, ref string) (*Manifest, error) {
+	key, err := parseConfigMapRef(ref)
+	if err != nil {
+		return nil, err
+	}
+	var cm corev1.ConfigMap
+	if err = c.Get(ctx, key, &cm); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	data, ok := cm.Data[ManifestKey]
+	if !ok {
+		return nil, errors.Errorf("configmap %s has no %s", ref, ManifestKey)
+	}
+	return decodeManifest([]byte(data))
+}
+
+// SaveManifestConfigMap creates or updates the ConfigMap ref,
+// "namespace/name", with m.
+func SaveManifestConfigMap(ctx context.Context, c client.Client, ref string, m *Manifest) error {
+	key, err := parseConfigMapRef(ref)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	var cm corev1.ConfigMap
+	err = c.Get(ctx, key, &cm)
+	if apierrors.IsNotFound(err) {
+		cm = corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: key.Namespace, Name: key.Name,
+				Labels: map[string]string{"app": "osnode-init"}},
+			Data: map[string]string{ManifestKey: string(data)},
+		}
+		return errors.WithStack(c.Create(ctx, &cm))
+	}
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if cm.Data == nil {
+		cm.Data = map[string]string{}
+	}
+	cm.Data[ManifestKey] = string(data)
+	return errors.WithStack(c.Update(ctx, &cm))
+}
+
+func decodeManifest(data []byte) (*Manifest, error) {
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, errors.Errorf("decode manifest, %v", err)
+	}
+	return &m, nil
+}
+
+func parseConfigMapRef(ref string) (types.NamespacedName, error) {
+	parts := strings.Split(ref, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return types.NamespacedName{}, errors.Errorf("configmap %q is not namespace/name", ref)
+	}
+	return types.NamespacedName{Namespace: parts[0], Name: parts[1]}, nil
+}
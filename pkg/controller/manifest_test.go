@@ -0,0 +1,138 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestManifestExportAndRestore(t *testing.T) {
+	oldNodeIP, oldTemplates := NodeIP, DirTemplates
+	defer func() { NodeIP, DirTemplates = oldNodeIP, oldTemplates }()
+	NodeIP, DirTemplates = "10.0.0.1", map[string]*TemplateSource{}
+
+	sts := &appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{
+		Namespace: "user-space-alice",
+		Name:      BflStatefulSetName,
+		Labels:    map[string]string{"tier": "bfl"},
+		Annotations: map[string]string{
+			BflAnnotationAppCache: "/olares/userdata/alice/appcache",
+			BflAnnotationDbData:   "/olares/userdata/alice/dbdata",
+		},
+	}}
+	c := fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).WithObjects(sts).Build()
+	ctx := context.Background()
+
+	// the node before the disaster, one dir has a custom mode
+	dirs := bflObject(sts).dataDirs()
+	before := newMemFS()
+	if _, err := createDataDirs(ctx, nil, before, bflObject(sts)); err != nil {
+		t.Fatal(err)
+	}
+	if err := before.Chmod(dirs[0].Path, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := exportManifest(ctx, c, before, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Dirs) != len(dirs) || m.Node != NodeIP {
+		t.Fatalf("manifest = %+v", m)
+	}
+	if m.Dirs[0].Mode != "0700" || m.Dirs[1].Mode != "0755" {
+		t.Fatalf("modes %s %s", m.Dirs[0].Mode, m.Dirs[1].Mode)
+	}
+
+	// the files came back from a backup owned by root
+	after := newMemFS().dir(dirs[0].Path, 0, 0)
+
+	dry, err := restoreManifest(ctx, c, after, m, RestoreOptions{DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dry.Changed() != len(dirs) {
+		t.Fatalf("dry run changes %d dirs, want %d", dry.Changed(), len(dirs))
+	}
+	if _, err = after.Stat(dirs[1].Path); !os.IsNotExist(err) {
+		t.Fatal("dry run changed the filesystem")
+	}
+
+	if _, err = restoreManifest(ctx, c, after, m, RestoreOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range m.Dirs {
+		stat, err := after.Stat(d.Path)
+		if err != nil || stat.Uid != d.Uid || stat.Gid != d.Gid || d.Mode != fmt.Sprintf("%04o", stat.Mode.Perm()) {
+			t.Fatalf("%s restored as %+v, %v, want %+v", d.Path, stat, err, d)
+		}
+	}
+
+	again, err := restoreManifest(ctx, c, after, m, RestoreOptions{})
+	if err != nil || again.Changed() != 0 {
+		t.Fatalf("second restore changed %d dirs, %v", again.Changed(), err)
+	}
+
+	// a manifest of another node needs AnyNode
+	NodeIP = "10.0.0.2"
+	if _, err = restoreManifest(ctx, c, after, m, RestoreOptions{}); err == nil {
+		t.Fatal("restore of another node's manifest should fail")
+	}
+	if _, err = restoreManifest(ctx, c, after, m, RestoreOptions{AnyNode: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	// failing dirs do not stop the others
+	m.Dirs[0].Mode = "rwx"
+	result, err := restoreManifest(ctx, c, newMemFS(), m, RestoreOptions{AnyNode: true})
+	if err == nil || result.Dirs[0].Error == "" || result.Dirs[1].Error != "" {
+		t.Fatalf("result = %+v, %v", result, err)
+	}
+
+	// only the data dirs of target objects are restored
+	m.Dirs[0].Mode = "0700"
+	m.Dirs = append(m.Dirs, ManifestDir{Namespace: "user-space-alice", Path: "/etc/../etc/cron.d", Mode: "0777"})
+	fsys := newMemFS()
+	result, err = restoreManifest(ctx, c, fsys, m, RestoreOptions{AnyNode: true})
+	if err == nil || result.Dirs[len(m.Dirs)-1].Error == "" || result.Dirs[0].Error != "" {
+		t.Fatalf("result = %+v, %v", result, err)
+	}
+	if _, err = fsys.Stat("/etc/cron.d"); !os.IsNotExist(err) {
+		t.Fatal("restored a dir outside the target objects")
+	}
+}
+
+func TestManifestStorage(t *testing.T) {
+	m := &Manifest{Version: ManifestVersion, Node: "10.0.0.1",
+		Dirs: []ManifestDir{{Namespace: "user-space-alice", Path: "/data/a", Uid: 1000, Gid: 1000, Mode: "0755"}}}
+
+	path := filepath.Join(t.TempDir(), "manifest.json")
+	if err := WriteManifestFile(path, m); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ReadManifestFile(path); err != nil || got.Dirs[0] != m.Dirs[0] {
+		t.Fatalf("read %+v, %v", got, err)
+	}
+
+	ctx := context.Background()
+	c := fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).Build()
+	for i := 0; i < 2; i++ {
+		// created, then updated
+		if err := SaveManifestConfigMap(ctx, c, "os-system/node-manifest", m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, err := ReadManifestConfigMap(ctx, c, "os-system/node-manifest"); err != nil || got.Node != m.Node {
+		t.Fatalf("read %+v, %v", got, err)
+	}
+	if err := SaveManifestConfigMap(ctx, c, "node-manifest", m); err == nil {
+		t.Fatal("ref without namespace should fail")
+	}
+}
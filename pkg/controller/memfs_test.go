@@ -0,0 +1,105 @@
+package controllers
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// memFS is an in-memory FileSystem. New dirs are owned by root, like
+// dirs the controller creates on a node.
+type memFS struct {
+	mu    sync.Mutex
+	files map[string]FileStat
+	// errs fails an operation on a path, keyed by "op path", e.g.
+	// "chown /a/b".
+	errs map[string]error
+}
+
+func newMemFS() *memFS {
+	return &memFS{files: map[string]FileStat{"/": {Mode: os.ModeDir | 0755}}, errs: map[string]error{}}
+}
+
+func (m *memFS) dir(path string, uid, gid int) *memFS {
+	m.files[filepath.Clean(path)] = FileStat{Mode: os.ModeDir | 0755, Uid: uid, Gid: gid}
+	return m
+}
+
+func (m *memFS) file(path string, uid, gid int) *memFS {
+	m.files[filepath.Clean(path)] = FileStat{Mode: 0644, Uid: uid, Gid: gid}
+	return m
+}
+
+func (m *memFS) fail(op, path string, err error) *memFS {
+	m.errs[op+" "+filepath.Clean(path)] = err
+	return m
+}
+
+func (m *memFS) Stat(path string) (FileStat, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	path = filepath.Clean(path)
+	if err := m.errs["stat "+path]; err != nil {
+		return FileStat{}, &os.PathError{Op: "stat", Path: path, Err: err}
+	}
+	stat, ok := m.files[path]
+	if !ok {
+		return FileStat{}, &os.PathError{Op: "stat", Path: path, Err: os.ErrNotExist}
+	}
+	return stat, nil
+}
+
+func (m *memFS) MkdirAll(path string, perm os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	path = filepath.Clean(path)
+	if err := m.errs["mkdir "+path]; err != nil {
+		return &os.PathError{Op: "mkdir", Path: path, Err: err}
+	}
+	var missing []string
+	for p := path; ; p = filepath.Dir(p) {
+		if stat, ok := m.files[p]; ok {
+			if !stat.Mode.IsDir() {
+				return &os.PathError{Op: "mkdir", Path: p, Err: os.ErrExist}
+			}
+			break
+		}
+		missing = append(missing, p)
+	}
+	for _, p := range missing {
+		m.files[p] = FileStat{Mode: os.ModeDir | perm}
+	}
+	return nil
+}
+
+func (m *memFS) Chown(path string, uid, gid int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	path = filepath.Clean(path)
+	if err := m.errs["chown "+path]; err != nil {
+		return &os.PathError{Op: "chown", Path: path, Err: err}
+	}
+	stat, ok := m.files[path]
+	if !ok {
+		return &os.PathError{Op: "chown", Path: path, Err: os.ErrNotExist}
+	}
+	stat.Uid, stat.Gid = uid, gid
+	m.files[path] = stat
+	return nil
+}
+
+func (m *memFS) Chmod(path string, mode os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	path = filepath.Clean(path)
+	if err := m.errs["chmod "+path]; err != nil {
+		return &os.PathError{Op: "chmod", Path: path, Err: err}
+	}
+	stat, ok := m.files[path]
+	if !ok {
+		return &os.PathError{Op: "chmod", Path: path, Err: os.ErrNotExist}
+	}
+	stat.Mode = stat.Mode&os.ModeType | mode.Perm()
+	m.files[path] = stat
+	return nil
+}
@@ -0,0 +1,816 @@
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"bytetrade.io/web3os/osnode-init/pkg/log"
+	"bytetrade.io/web3os/osnode-init/pkg/tracing"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/sys/unix"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+)
+
+// Data migration modes, see DataMigrationMode.
+const (
+	MigrationOff  = "off"
+	MigrationCopy = "copy"
+	// MigrationMove removes the old dirs once the copy is verified and the
+	// old pods are gone.
+	MigrationMove = "move"
+)
+
+// Migration phases.
+const (
+	MigrationPhaseCopying   = "Copying"
+	MigrationPhaseVerifying = "Verifying"
+	// MigrationPhaseRemoving means the copy is verified, the old dirs are
+	// removed once no pod on the node mounts them anymore.
+	MigrationPhaseRemoving  = "Removing"
+	MigrationPhaseCompleted = "Completed"
+	MigrationPhaseFailed    = "Failed"
+	// MigrationPhaseDetected means the hostpath changed while migration is
+	// off, the old data stays where it is.
+	MigrationPhaseDetected = "Detected"
+)
+
+var (
+	// DataMigrationMode decides what happens when the hostpath annotations
+	// of a target object change.
+	DataMigrationMode = MigrationOff
+
+	// migrationStateDir keeps the state of each target object on the host,
+	// so an interrupted migration resumes after a restart.
+	migrationStateDir = localPath(filepath.Join(HostRoot, ".osnode-init", "migrations"))
+
+	// migrationSaveEvery is how many files are copied between state saves.
+	migrationSaveEvery int64 = 500
+
+	// migrationRetryDelay is how long a failed migration waits before it is
+	// run again.
+	migrationRetryDelay = 5 * time.Minute
+)
+
+// DirMove is one data dir moving to a new parent.
+type DirMove struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// MigrationStatus is the progress of the data migration of a target
+// object.
+type MigrationStatus struct {
+	Mode          string    `json:"mode"`
+	Phase         string    `json:"phase"`
+	Moves         []DirMove `json:"moves"`
+	TotalFiles    int64     `json:"totalFiles"`
+	FilesCopied   int64     `json:"filesCopied"`
+	BytesCopied   int64     `json:"bytesCopied"`
+	FilesVerified int64     `json:"filesVerified"`
+	StartedAt     time.Time `json:"startedAt"`
+	UpdatedAt     time.Time `json:"updatedAt"`
+	Error         string    `json:"error,omitempty"`
+}
+
+// migrationState is persisted per target object under migrationStateDir.
+type migrationState struct {
+	// Paths are the hostpath annotations the dirs were last provisioned at.
+	Paths     map[string]string `json:"paths"`
+	Migration *MigrationStatus  `json:"migration,omitempty"`
+}
+
+// migrationStateName names the state file of ref. The bfl keeps the name
+// of its namespace, which its state was saved under before other targets
+// existed.
+func migrationStateName(ref TargetRef) string {
+	if ref.Kind == KindStatefulSet && ref.Name == BflStatefulSetName {
+		return ref.Namespace
+	}
+	if ref.Kind == KindNamespace {
+		return "namespace_" + ref.Name
+	}
+	return strings.ToLower(ref.Kind) + "_" + ref.Namespace + "_" + ref.Name
+}
+
+func migrationStatePath(name string) string {
+	return filepath.Join(migrationStateDir, name+".json")
+}
+
+func loadMigrationState(name string) (*migrationState, error) {
+	data, err := os.ReadFile(migrationStatePath(name))
+	if os.IsNotExist(err) {
+		return &migrationState{}, nil
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var state migrationState
+	if err = json.Unmarshal(data, &state); err != nil {
+		return nil, errors.Errorf("parse migration state of %s, %v", name, err)
+	}
+	return &state, nil
+}
+
+func (s *migrationState) save(name string) error {
+	if err := os.MkdirAll(migrationStateDir, 0700); err != nil {
+		return errors.WithStack(err)
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	tmp := migrationStatePath(name) + ".tmp"
+	if err = os.WriteFile(tmp, data, 0600); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Rename(tmp, migrationStatePath(name)))
+}
+
+// plannedMoves lists the existing data dirs under the old hostpaths which
+// are not under the new ones.
+func plannedMoves(dirs []TargetDir, old, current map[string]string) ([]DirMove, error) {
+	var moves []DirMove
+	for _, dir := range dirs {
+		annotation := dir.Annotation
+		from, to := filepath.Clean(old[annotation]), filepath.Clean(current[annotation])
+		if old[annotation] == "" || from == to {
+			continue
+		}
+		if strings.HasPrefix(to+"/", from+"/") || strings.HasPrefix(from+"/", to+"/") {
+			return nil, errors.Errorf("%s moved from %s to %s, one is inside the other", annotation, from, to)
+		}
+		for _, name := range sortedSubDirs(dir.SubDirs) {
+			if pathExists(hostFS, filepath.Join(from, name)) {
+				moves = append(moves, DirMove{From: filepath.Join(from, name), To: filepath.Join(to, name)})
+			}
+		}
+	}
+	return moves, nil
+}
+
+func sortedSubDirs(dirs map[string][]int) []string {
+	names := make([]string, 0, len(dirs))
+	for name := range dirs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// migrateDataDirs migrates the data dirs of o when its hostpaths changed
+// since they were last provisioned, or resumes an unfinished migration. It
+// returns an error while the data is not at the new place yet, so that the
+// new dirs are not provisioned empty meanwhile.
+func (r *NodeInitController) migrateDataDirs(ctx context.Context, o targetObject) error {
+	state, err := r.planMigration(ctx, o)
+	if err != nil || state == nil || !r.removalDue(ctx, o, state.Migration) {
+		return err
+	}
+	return r.runMigration(ctx, o, state)
+}
+
+// planMigration records the hostpaths of o the first time and detects when
+// they change. It returns the state of the migration still to run, nil
+// when the data is where the hostpaths say.
+func (r *NodeInitController) planMigration(ctx context.Context, o targetObject) (*migrationState, error) {
+	logger := log.FromContext(ctx).Named(log.ComponentFilesystem)
+	ref := o.ref()
+	name := migrationStateName(ref)
+
+	state, err := loadMigrationState(name)
+	if err != nil {
+		return nil, err
+	}
+	current := o.hostPaths()
+
+	if state.Migration != nil && state.Migration.Phase == MigrationPhaseRemoving {
+		return state, nil
+	}
+	if state.Migration == nil || state.Migration.Phase == MigrationPhaseCompleted ||
+		state.Migration.Phase == MigrationPhaseDetected {
+		if state.Paths == nil {
+			state.Paths = current
+			return nil, state.save(name)
+		}
+		if mapsEqual(state.Paths, current) {
+			// keep showing how the last migration ended
+			r.status.recordMigration(ref, state.Migration)
+			return nil, nil
+		}
+
+		moves, err := plannedMoves(o.target.Dirs, state.Paths, current)
+		if err != nil {
+			return nil, err
+		}
+		if len(moves) == 0 {
+			state.Paths, state.Migration = current, nil
+			return nil, state.save(name)
+		}
+
+		now := time.Now()
+		state.Migration = &MigrationStatus{Mode: DataMigrationMode, Moves: moves, StartedAt: now, UpdatedAt: now}
+		if DataMigrationMode == MigrationOff {
+			state.Migration.Phase = MigrationPhaseDetected
+			r.status.recordMigration(ref, state.Migration)
+			r.event(o.Object, corev1.EventTypeWarning, EventReasonDataMigrationSkipped,
+				"hostpath changed, data stays at the old place as data migration is off: %v", moves)
+			logger.Warnf("hostpath of %s changed, data migration is off, %v", ref, moves)
+			// remember the new paths, the detection is reported once
+			state.Paths = current
+			return nil, state.save(name)
+		}
+		// the copy would overwrite what the workload wrote at the new place
+		// already, so it is left to the admin. Nothing is saved, the next
+		// reconcile checks again.
+		for _, move := range moves {
+			if used, err := dirHasEntries(localPath(move.To)); err != nil || used {
+				if err == nil {
+					err = errors.Errorf("%s is not empty", move.To)
+				}
+				state.Migration.Phase, state.Migration.Error = MigrationPhaseFailed, err.Error()
+				r.status.recordMigration(ref, state.Migration)
+				r.event(o.Object, corev1.EventTypeWarning, EventReasonDataMigrationFailed,
+					"data migration refused: %v", err)
+				return nil, errors.Errorf("migrate data dirs of %s, %v", ref, err)
+			}
+		}
+		state.Migration.Phase = MigrationPhaseCopying
+		r.event(o.Object, corev1.EventTypeNormal, EventReasonDataMigrationStarted, "migrating data dirs: %v", moves)
+	}
+
+	return state, nil
+}
+
+// runMigration copies and verifies the data dirs of the migration in
+// state, resuming from its phase.
+func (r *NodeInitController) runMigration(ctx context.Context, o targetObject, state *migrationState) (err error) {
+	logger := log.FromContext(ctx).Named(log.ComponentFilesystem)
+	ref := o.ref()
+	name := migrationStateName(ref)
+	current := o.hostPaths()
+
+	m := state.Migration
+	ctx, span := tracing.Start(ctx, "migrateDataDirs",
+		attribute.String("namespace", ref.Namespace), attribute.String("name", ref.Name),
+		attribute.String("mode", m.Mode))
+	defer func() { tracing.End(span, err) }()
+
+	progress := func() error {
+		m.UpdatedAt = time.Now()
+		r.status.recordMigration(ref, m)
+		return state.save(name)
+	}
+	fail := func(e error) error {
+		m.Phase, m.Error = MigrationPhaseFailed, e.Error()
+		_ = progress()
+		r.event(o.Object, corev1.EventTypeWarning, EventReasonDataMigrationFailed, "data migration failed: %v", e)
+		return errors.Errorf("migrate data dirs of %s, %v", ref, e)
+	}
+
+	if m.Phase == MigrationPhaseFailed {
+		// retry from the copy, which skips what is done already
+		m.Phase, m.Error = MigrationPhaseCopying, ""
+	}
+
+	if m.Phase == MigrationPhaseCopying {
+		m.TotalFiles, m.FilesCopied, m.BytesCopied = 0, 0, 0
+		for _, move := range m.Moves {
+			n, err := countFiles(localPath(move.From))
+			if err != nil {
+				return fail(err)
+			}
+			m.TotalFiles += n
+		}
+		if err = progress(); err != nil {
+			return err
+		}
+
+		for _, move := range m.Moves {
+			logger.Infof("copying %s to %s", move.From, move.To)
+			err = copyTree(ctx, localPath(move.From), localPath(move.To), func(bytes int64) {
+				m.FilesCopied++
+				m.BytesCopied += bytes
+				if m.FilesCopied%migrationSaveEvery == 0 {
+					_ = progress()
+				}
+			})
+			if err != nil {
+				return fail(err)
+			}
+		}
+		m.Phase = MigrationPhaseVerifying
+		if err = progress(); err != nil {
+			return err
+		}
+	}
+
+	if m.Phase == MigrationPhaseVerifying {
+		m.FilesVerified = 0
+		for _, move := range m.Moves {
+			err = verifyTree(ctx, localPath(move.From), localPath(move.To), func() {
+				m.FilesVerified++
+				if m.FilesVerified%migrationSaveEvery == 0 {
+					_ = progress()
+				}
+			})
+			if err != nil {
+				return fail(err)
+			}
+		}
+
+		m.Phase = MigrationPhaseCompleted
+		if m.Mode == MigrationMove {
+			m.Phase = MigrationPhaseRemoving
+		}
+		state.Paths = current
+		if err = progress(); err != nil {
+			return err
+		}
+		logger.Infof("data dirs of %s migrated, %d files, %d bytes", ref, m.FilesCopied, m.BytesCopied)
+		r.event(o.Object, corev1.EventTypeNormal, EventReasonDataMigrationCompleted,
+			"migrated %d files, %d bytes: %v", m.FilesCopied, m.BytesCopied, m.Moves)
+		return nil
+	}
+
+	if m.Phase == MigrationPhaseRemoving {
+		// the old pods may have written after the copy, what they wrote is
+		// not lost but left to the admin
+		for _, move := range m.Moves {
+			if err = verifyTree(ctx, localPath(move.From), localPath(move.To), func() {}); err != nil {
+				m.Phase, m.Error = MigrationPhaseCompleted, "old dirs changed after the copy and are left in place, "+err.Error()
+				_ = progress()
+				r.event(o.Object, corev1.EventTypeWarning, EventReasonDataMigrationFailed,
+					"old data dirs changed after the copy, remove them by hand once checked: %v", err)
+				return errors.Errorf("migrate data dirs of %s, %s", ref, m.Error)
+			}
+		}
+		for _, move := range m.Moves {
+			if err = os.RemoveAll(localPath(move.From)); err != nil {
+				return fail(errors.WithStack(err))
+			}
+		}
+		m.Phase = MigrationPhaseCompleted
+		if err = progress(); err != nil {
+			return err
+		}
+		logger.Infof("old data dirs of %s removed, %v", ref, m.Moves)
+	}
+	return nil
+}
+
+// removalDue is false while m waits for the pods using its old dirs to go.
+func (r *NodeInitController) removalDue(ctx context.Context, o targetObject, m *MigrationStatus) bool {
+	if m.Phase != MigrationPhaseRemoving {
+		return true
+	}
+	r.status.recordMigration(o.ref(), m)
+	pods, err := r.podsUsing(ctx, o, m.Moves)
+	switch {
+	case err != nil:
+		log.FromContext(ctx).Warnf("find the pods using the old data dirs of %s, %v", o.ref(), err)
+		return false
+	case len(pods) > 0:
+		log.FromContext(ctx).Infof("old data dirs of %s are still used by pods %v", o.ref(), pods)
+		return false
+	}
+	return true
+}
+
+// podsUsing lists the pods on this node that still run with a hostPath
+// volume on one of the old dirs of moves, or on a parent of one.
+func (r *NodeInitController) podsUsing(ctx context.Context, o targetObject, moves []DirMove) ([]string, error) {
+	var pods corev1.PodList
+	if err := r.reader().List(ctx, &pods, client.InNamespace(o.ref().Namespace)); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	node := r.taskNode().Object
+	var using []string
+	for _, pod := range pods.Items {
+		if node != nil && pod.Spec.NodeName != node.Name ||
+			pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+			continue
+		}
+	volumes:
+		for _, v := range pod.Spec.Volumes {
+			if v.HostPath == nil {
+				continue
+			}
+			for _, move := range moves {
+				if pathsOverlap(v.HostPath.Path, move.From) {
+					using = append(using, pod.Name)
+					break volumes
+				}
+			}
+		}
+	}
+	return using, nil
+}
+
+// pathsOverlap is true when a and b are the same path or one is inside the
+// other.
+func pathsOverlap(a, b string) bool {
+	a, b = filepath.Clean(a)+"/", filepath.Clean(b)+"/"
+	return strings.HasPrefix(a, b) || strings.HasPrefix(b, a)
+}
+
+// migrationRunner runs data migrations in the background, one at a time
+// per target object, so a copy that takes hours holds up neither the
+// reconcile nor the other targets.
+type migrationRunner struct {
+	mu  sync.Mutex
+	ctx context.Context
+	// running is keyed by TargetRef.key
+	running map[string]bool
+	// done gets the target object of each finished migration, to reconcile
+	// it again
+	done chan event.GenericEvent
+}
+
+func newMigrationRunner() *migrationRunner {
+	return &migrationRunner{running: map[string]bool{}, done: make(chan event.GenericEvent, 16)}
+}
+
+// Start keeps the context of the manager, which cancels the migrations
+// running on shutdown. Progress is saved, they resume after a restart.
+func (m *migrationRunner) Start(ctx context.Context) error {
+	m.mu.Lock()
+	m.ctx = ctx
+	m.mu.Unlock()
+	<-ctx.Done()
+	return nil
+}
+
+// NeedLeaderElection is false, every node migrates its own dirs.
+func (m *migrationRunner) NeedLeaderElection() bool {
+	return false
+}
+
+func (m *migrationRunner) context() context.Context {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.ctx == nil {
+		return context.Background()
+	}
+	return m.ctx
+}
+
+// begin marks key running, it fails when it already was.
+func (m *migrationRunner) begin(key string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.running[key] {
+		return false
+	}
+	m.running[key] = true
+	return true
+}
+
+func (m *migrationRunner) end(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.running, key)
+}
+
+func (m *migrationRunner) isRunning(key string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.running[key]
+}
+
+// migrateInBackground starts the pending migration of o, if any, and
+// reports whether one is running. It fails while a failed migration waits
+// for migrationRetryDelay.
+func (r *NodeInitController) migrateInBackground(ctx context.Context, o targetObject) (bool, error) {
+	ref := o.ref()
+	key := ref.key()
+	if !r.migrations.begin(key) {
+		return true, nil
+	}
+	state, err := r.planMigration(ctx, o)
+	if err != nil || state == nil {
+		r.migrations.end(key)
+		return false, err
+	}
+	if !r.removalDue(ctx, o, state.Migration) {
+		// the data is at the new place already, the target is provisioned
+		// while the old pods wind down
+		r.migrations.end(key)
+		return false, nil
+	}
+	if m := state.Migration; m.Phase == MigrationPhaseFailed && r.clock.Since(m.UpdatedAt) < migrationRetryDelay {
+		r.migrations.end(key)
+		r.status.recordMigration(ref, m)
+		return false, errors.Errorf("migrate data dirs of %s, %s, retrying after %v",
+			ref, m.Error, m.UpdatedAt.Add(migrationRetryDelay).Format(time.RFC3339))
+	}
+
+	logger := log.FromContext(ctx)
+	runCtx := log.NewContext(r.migrations.context(), logger)
+	go func() {
+		err := r.runMigration(runCtx, o, state)
+		// before the reconcile below, which must not find it running
+		r.migrations.end(key)
+		if err != nil {
+			logger.Errorf("data migration of %s failed, %v", ref, err)
+		}
+		select {
+		case r.migrations.done <- event.GenericEvent{Object: o.Object}:
+		default:
+			// a reconcile is pending already
+		}
+	}()
+	return true, nil
+}
+
+// dirHasEntries reports whether dir exists and is not empty.
+func dirHasEntries(dir string) (bool, error) {
+	f, err := os.Open(dir)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	defer f.Close()
+	names, err := f.Readdirnames(1)
+	if err == io.EOF {
+		return false, nil
+	}
+	return len(names) > 0, errors.WithStack(err)
+}
+
+func mapsEqual(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if b[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func countFiles(root string) (int64, error) {
+	var n int64
+	err := filepath.WalkDir(root, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			n++
+		}
+		return nil
+	})
+	return n, errors.WithStack(err)
+}
+
+// copyTree copies src into dst keeping ownership, modes, xattrs and file
+// mtimes. Files already in dst with the same size and mtime are skipped,
+// which makes an interrupted copy resumable, dst is empty when a migration
+// starts. Special files are skipped.
+func copyTree(ctx context.Context, src, dst string, copied func(bytes int64)) error {
+	// the walked dirs get the owner and mode of their source, the parents
+	// of dst are created like any other dir
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return errors.WithStack(err)
+	}
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		target := filepath.Join(dst, rel)
+
+		fi, err := os.Lstat(path)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		stat := fi.Sys().(*syscall.Stat_t)
+
+		switch {
+		case fi.IsDir():
+			if err = os.Mkdir(target, 0700); err != nil && !os.IsExist(err) {
+				return errors.WithStack(err)
+			}
+		case fi.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			if current, err := os.Readlink(target); err == nil && current == link {
+				return nil
+			}
+			_ = os.Remove(target)
+			if err = os.Symlink(link, target); err != nil {
+				return errors.WithStack(err)
+			}
+		case fi.Mode().IsRegular():
+			if ti, err := os.Lstat(target); err == nil && ti.Mode().IsRegular() &&
+				ti.Size() == fi.Size() && ti.ModTime().Equal(fi.ModTime()) {
+				copied(0)
+				break
+			}
+			if err = copyFile(path, target, fi); err != nil {
+				return err
+			}
+			copied(fi.Size())
+		default:
+			log.FromContext(ctx).Warnf("skip special file %s", path)
+			return nil
+		}
+
+		if err = os.Lchown(target, int(stat.Uid), int(stat.Gid)); err != nil {
+			return errors.WithStack(err)
+		}
+		// after chown, which clears the setuid and setgid bits
+		if fi.Mode()&os.ModeSymlink == 0 {
+			if err = os.Chmod(target, fi.Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+				return errors.WithStack(err)
+			}
+		}
+		return copyXattrs(path, target)
+	})
+}
+
+// copyFile writes next to dst and renames, so dst is never half written.
+func copyFile(src, dst string, fi os.FileInfo) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer in.Close()
+
+	tmp := dst + ".osnode-init-tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, fi.Mode().Perm())
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return errors.WithStack(err)
+	}
+	if err = out.Close(); err != nil {
+		os.Remove(tmp)
+		return errors.WithStack(err)
+	}
+	if err = os.Chtimes(tmp, fi.ModTime(), fi.ModTime()); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Rename(tmp, dst))
+}
+
+func copyXattrs(src, dst string) error {
+	names, err := listXattrs(src)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		value, err := getXattr(src, name)
+		if err != nil {
+			return err
+		}
+		if err = unix.Lsetxattr(dst, name, value, 0); err != nil {
+			return errors.Errorf("set xattr %s on %s, %v", name, dst, err)
+		}
+	}
+	return nil
+}
+
+func listXattrs(path string) ([]string, error) {
+	size, err := unix.Llistxattr(path, nil)
+	if err == unix.ENOTSUP || size == 0 {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Errorf("list xattrs of %s, %v", path, err)
+	}
+	buf := make([]byte, size)
+	if size, err = unix.Llistxattr(path, buf); err != nil {
+		return nil, errors.Errorf("list xattrs of %s, %v", path, err)
+	}
+	var names []string
+	for _, name := range strings.Split(string(buf[:size]), "\x00") {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+func getXattr(path, name string) ([]byte, error) {
+	size, err := unix.Lgetxattr(path, name, nil)
+	if err != nil {
+		return nil, errors.Errorf("get xattr %s of %s, %v", name, path, err)
+	}
+	value := make([]byte, size)
+	if size, err = unix.Lgetxattr(path, name, value); err != nil {
+		return nil, errors.Errorf("get xattr %s of %s, %v", name, path, err)
+	}
+	return value[:size], nil
+}
+
+// verifyTree checks that every entry of src is in dst with the same owner,
+// mode, xattrs and, for files, the same sha256.
+func verifyTree(ctx context.Context, src, dst string, verified func()) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		rel, _ := filepath.Rel(src, path)
+		target := filepath.Join(dst, rel)
+
+		fi, err := os.Lstat(path)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if !fi.IsDir() && !fi.Mode().IsRegular() && fi.Mode()&os.ModeSymlink == 0 {
+			return nil
+		}
+		ti, err := os.Lstat(target)
+		if err != nil {
+			return errors.Errorf("%s is missing, %v", target, err)
+		}
+
+		s, t := fi.Sys().(*syscall.Stat_t), ti.Sys().(*syscall.Stat_t)
+		if s.Uid != t.Uid || s.Gid != t.Gid {
+			return errors.Errorf("%s is owned by %d:%d, want %d:%d", target, t.Uid, t.Gid, s.Uid, s.Gid)
+		}
+		if fi.Mode()&os.ModeSymlink == 0 && fi.Mode() != ti.Mode() {
+			return errors.Errorf("%s has mode %v, want %v", target, ti.Mode(), fi.Mode())
+		}
+		if err = verifyXattrs(path, target); err != nil {
+			return err
+		}
+
+		if fi.Mode().IsRegular() {
+			want, err := fileChecksum(path)
+			if err != nil {
+				return err
+			}
+			got, err := fileChecksum(target)
+			if err != nil {
+				return err
+			}
+			if want != got {
+				return errors.Errorf("checksum of %s does not match %s", target, path)
+			}
+			verified()
+		}
+		return nil
+	})
+}
+
+func verifyXattrs(src, dst string) error {
+	names, err := listXattrs(src)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		want, err := getXattr(src, name)
+		if err != nil {
+			return err
+		}
+		got, err := getXattr(dst, name)
+		if err != nil || string(got) != string(want) {
+			return errors.Errorf("xattr %s of %s does not match", name, dst)
+		}
+	}
+	return nil
+}
+
+func fileChecksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", errors.WithStack(err)
+	}
+	return string(h.Sum(nil)), nil
+}
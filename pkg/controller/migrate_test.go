@@ -0,0 +1,270 @@
+package controllers
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"bytetrade.io/web3os/osnode-init/pkg/task"
+	"golang.org/x/sys/unix"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestCopyAndVerifyTree(t *testing.T) {
+	parent := filepath.Join(t.TempDir(), "new")
+	src, dst := t.TempDir(), filepath.Join(parent, "appcache", "dst")
+
+	if err := os.MkdirAll(filepath.Join(src, "sub"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(src, "sub", "data")
+	if err := os.WriteFile(file, []byte("user data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("sub/data", filepath.Join(src, "link")); err != nil {
+		t.Fatal(err)
+	}
+	xattrs := unix.Lsetxattr(file, "user.olares", []byte("1"), 0) == nil
+
+	var files int
+	if err := copyTree(context.Background(), src, dst, func(int64) { files++ }); err != nil {
+		t.Fatal(err)
+	}
+	if files != 1 {
+		t.Fatalf("copied %d files, want 1", files)
+	}
+	if err := verifyTree(context.Background(), src, dst, func() {}); err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Stat(filepath.Join(dst, "sub"))
+	if err != nil || fi.Mode().Perm() != 0750 {
+		t.Fatalf("dir mode = %v, %v, want 0750", fi.Mode().Perm(), err)
+	}
+	if fi, err = os.Stat(parent); err != nil || fi.Mode().Perm() != 0755 {
+		t.Fatalf("parent mode = %v, %v, want 0755", fi.Mode().Perm(), err)
+	}
+	if link, err := os.Readlink(filepath.Join(dst, "link")); err != nil || link != "sub/data" {
+		t.Fatalf("link = %q, %v", link, err)
+	}
+	if xattrs {
+		if v, err := getXattr(filepath.Join(dst, "sub", "data"), "user.olares"); err != nil || string(v) != "1" {
+			t.Fatalf("xattr = %q, %v", v, err)
+		}
+	}
+
+	// a second run resumes, nothing is copied again
+	var bytes int64
+	if err := copyTree(context.Background(), src, dst, func(n int64) { bytes += n }); err != nil {
+		t.Fatal(err)
+	}
+	if bytes != 0 {
+		t.Fatalf("copied %d bytes again", bytes)
+	}
+
+	if err := os.WriteFile(filepath.Join(dst, "sub", "data"), []byte("corrupt!!"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyTree(context.Background(), src, dst, func() {}); err == nil {
+		t.Fatal("corrupted copy should fail verification")
+	}
+}
+
+func TestMigrateDataDirs(t *testing.T) {
+	root := t.TempDir()
+	oldStateDir, oldMode := migrationStateDir, DataMigrationMode
+	defer func() { migrationStateDir, DataMigrationMode = oldStateDir, oldMode }()
+	migrationStateDir = filepath.Join(root, "state")
+	DataMigrationMode = MigrationMove
+
+	sts := &appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{
+		Namespace: "user-space-alice",
+		Name:      BflStatefulSetName,
+		Annotations: map[string]string{
+			BflAnnotationAppCache: filepath.Join(root, "old/appcache"),
+			BflAnnotationDbData:   filepath.Join(root, "old/dbdata"),
+		},
+	}}
+	// an old pod still runs on the old dirs
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: sts.Namespace, Name: "bfl-0"},
+		Spec: corev1.PodSpec{Volumes: []corev1.Volume{{Name: "appcache", VolumeSource: corev1.VolumeSource{
+			HostPath: &corev1.HostPathVolumeSource{Path: filepath.Join(root, "old/appcache")}}}}}}
+	c := fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).WithObjects(pod).Build()
+	r := NewNodeInitController(c, nil, nil)
+
+	// the first run only records the paths
+	if err := r.migrateDataDirs(context.Background(), bflObject(sts)); err != nil {
+		t.Fatal(err)
+	}
+	launcher := filepath.Join(root, "old/appcache/launcher")
+	if err := os.MkdirAll(launcher, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(launcher, "config.json"), []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	sts.Annotations[BflAnnotationAppCache] = filepath.Join(root, "new/appcache")
+	if err := r.migrateDataDirs(context.Background(), bflObject(sts)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(root, "new/appcache/launcher/config.json")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(launcher); err != nil {
+		t.Fatalf("old dir removed while a pod uses it, %v", err)
+	}
+	if err := r.migrateDataDirs(context.Background(), bflObject(sts)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(launcher); err != nil {
+		t.Fatalf("old dir removed while a pod uses it, %v", err)
+	}
+
+	if err := c.Delete(context.Background(), pod); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.migrateDataDirs(context.Background(), bflObject(sts)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(launcher); !os.IsNotExist(err) {
+		t.Fatalf("old dir should be removed in move mode, %v", err)
+	}
+
+	state, err := loadMigrationState(sts.Namespace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Migration == nil || state.Migration.Phase != MigrationPhaseCompleted || state.Migration.FilesCopied != 1 {
+		t.Fatalf("migration = %+v", state.Migration)
+	}
+	if state.Paths[BflAnnotationAppCache] != sts.Annotations[BflAnnotationAppCache] {
+		t.Fatalf("paths = %v", state.Paths)
+	}
+}
+
+func TestMigrateInBackground(t *testing.T) {
+	root := t.TempDir()
+	oldStateDir, oldMode := migrationStateDir, DataMigrationMode
+	defer func() { migrationStateDir, DataMigrationMode = oldStateDir, oldMode }()
+	migrationStateDir = filepath.Join(root, "state")
+	DataMigrationMode = MigrationCopy
+
+	bfl := func(user, appCache string) *appsv1.StatefulSet {
+		return &appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{
+			Namespace: "user-space-" + user, Name: BflStatefulSetName, Labels: map[string]string{"tier": "bfl"},
+			Annotations: map[string]string{
+				BflAnnotationAppCache: filepath.Join(root, user, appCache),
+				BflAnnotationDbData:   filepath.Join(root, user, "dbdata"),
+			},
+		}}
+	}
+	alice, bob := bfl("alice", "old"), bfl("bob", "appcache")
+	c := fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).WithObjects(alice, bob).Build()
+	r := NewNodeInitController(c, nil, nil)
+	r.fs = newMemFS()
+	dataDirs := &dataDirsTask{r: r}
+	node := &task.Node{Object: &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1"}}}
+
+	// the first run records the paths
+	if err := dataDirs.Run(context.Background(), node); err != nil {
+		t.Fatal(err)
+	}
+	launcher := filepath.Join(root, "alice/old/launcher")
+	if err := os.MkdirAll(launcher, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(launcher, "config.json"), []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// bob is provisioned while the migration of alice runs
+	moved := bfl("alice", "new")
+	if err := c.Update(context.Background(), moved); err != nil {
+		t.Fatal(err)
+	}
+	aliceKey := bflObject(moved).ref().key()
+	r.migrations.begin(aliceKey)
+	if err := dataDirs.Run(context.Background(), node); err != nil {
+		t.Fatal(err)
+	}
+	for _, ns := range r.Status().Namespaces {
+		if ns.Namespace == "user-space-alice" && ns.Skipped == "" || ns.Namespace == "user-space-bob" && len(ns.Dirs) == 0 {
+			t.Fatalf("status %+v", ns)
+		}
+	}
+	r.migrations.end(aliceKey)
+
+	if err := dataDirs.Run(context.Background(), node); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case e := <-r.migrations.done:
+		if e.Object.GetNamespace() != "user-space-alice" {
+			t.Fatalf("reconcile of %s", e.Object.GetNamespace())
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("migration did not finish")
+	}
+	if _, err := os.Stat(filepath.Join(root, "alice/new/launcher/config.json")); err != nil {
+		t.Fatal(err)
+	}
+	if migrating, err := r.migrateInBackground(context.Background(), bflObject(moved)); migrating || err != nil {
+		t.Fatalf("migration still pending, %v", err)
+	}
+}
+
+func TestMigrationRefusesUsedTarget(t *testing.T) {
+	root := t.TempDir()
+	oldStateDir, oldMode := migrationStateDir, DataMigrationMode
+	defer func() { migrationStateDir, DataMigrationMode = oldStateDir, oldMode }()
+	migrationStateDir = filepath.Join(root, "state")
+	DataMigrationMode = MigrationCopy
+
+	sts := &appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{
+		Namespace: "user-space-alice",
+		Name:      BflStatefulSetName,
+		Annotations: map[string]string{
+			BflAnnotationAppCache: filepath.Join(root, "old/appcache"),
+			BflAnnotationDbData:   filepath.Join(root, "old/dbdata"),
+		},
+	}}
+	r := &NodeInitController{status: newStatusTracker()}
+	if err := r.migrateDataDirs(context.Background(), bflObject(sts)); err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{"old/appcache/launcher", "new/appcache/launcher"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(root, dir, "config.json"), []byte(dir), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sts.Annotations[BflAnnotationAppCache] = filepath.Join(root, "new/appcache")
+	if err := r.migrateDataDirs(context.Background(), bflObject(sts)); err == nil {
+		t.Fatal("migration into a used dir should fail")
+	}
+	if b, _ := os.ReadFile(filepath.Join(root, "new/appcache/launcher/config.json")); string(b) != "new/appcache/launcher" {
+		t.Fatalf("data at the new place overwritten with %q", b)
+	}
+
+	// once the admin cleared it, the migration runs
+	if err := os.RemoveAll(filepath.Join(root, "new/appcache/launcher")); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.migrateDataDirs(context.Background(), bflObject(sts)); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := os.ReadFile(filepath.Join(root, "new/appcache/launcher/config.json")); string(b) != "old/appcache/launcher" {
+		t.Fatalf("migrated %q", b)
+	}
+}
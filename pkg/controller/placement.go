@@ -0,0 +1,172 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// ProvisionAllNodes provisions every target object on every node, even
+// where its pods cannot be scheduled.
+var ProvisionAllNodes bool
+
+// conditionTaintPrefix marks the taints the node controller sets for node
+// conditions, e.g. not-ready or a cordon. They come and go, so they do not
+// decide where dirs are provisioned.
+const conditionTaintPrefix = "node.kubernetes.io/"
+
+var nodeSelectorOps = map[corev1.NodeSelectorOperator]selection.Operator{
+	corev1.NodeSelectorOpIn:           selection.In,
+	corev1.NodeSelectorOpNotIn:        selection.NotIn,
+	corev1.NodeSelectorOpExists:       selection.Exists,
+	corev1.NodeSelectorOpDoesNotExist: selection.DoesNotExist,
+	corev1.NodeSelectorOpGt:           selection.GreaterThan,
+	corev1.NodeSelectorOpLt:           selection.LessThan,
+}
+
+// podSpec is the pod template of o, nil for namespaces, which have no pods.
+func (o targetObject) podSpec() *corev1.PodSpec {
+	switch obj := o.Object.(type) {
+	case *appsv1.StatefulSet:
+		return &obj.Spec.Template.Spec
+	case *appsv1.Deployment:
+		return &obj.Spec.Template.Spec
+	case *appsv1.DaemonSet:
+		return &obj.Spec.Template.Spec
+	}
+	return nil
+}
+
+// skipReason tells why o is not provisioned on node, it is empty when the
+// pods of o can run there. Without a node everything is provisioned.
+func (o targetObject) skipReason(node *corev1.Node) string {
+	if ProvisionAllNodes || o.target.AllNodes || node == nil {
+		return ""
+	}
+	spec := o.podSpec()
+	if spec == nil {
+		return ""
+	}
+	return unschedulableReason(spec, node)
+}
+
+// unschedulableReason checks the node name, node selector, required node
+// affinity and tolerations of spec against node, like the scheduler does.
+func unschedulableReason(spec *corev1.PodSpec, node *corev1.Node) string {
+	if spec.NodeName != "" && spec.NodeName != node.Name {
+		return fmt.Sprintf("pods run on node %s", spec.NodeName)
+	}
+	for key, value := range spec.NodeSelector {
+		if node.Labels[key] != value {
+			return fmt.Sprintf("node selector %s=%s does not match", key, value)
+		}
+	}
+	if a := spec.Affinity; a != nil && a.NodeAffinity != nil &&
+		a.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution != nil {
+		terms := a.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms
+		matched, err := matchNodeSelectorTerms(terms, node)
+		if err != nil {
+			return fmt.Sprintf("invalid node affinity, %v", err)
+		}
+		if !matched {
+			return "required node affinity does not match"
+		}
+	}
+	for i := range node.Spec.Taints {
+		taint := &node.Spec.Taints[i]
+		if taint.Effect == corev1.TaintEffectPreferNoSchedule || strings.HasPrefix(taint.Key, conditionTaintPrefix) {
+			continue
+		}
+		if !toleratesTaint(spec.Tolerations, taint) {
+			return fmt.Sprintf("taint %s is not tolerated", taint.ToString())
+		}
+	}
+	return ""
+}
+
+func toleratesTaint(tolerations []corev1.Toleration, taint *corev1.Taint) bool {
+	for i := range tolerations {
+		if tolerations[i].ToleratesTaint(taint) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchNodeSelectorTerms matches when any term does. A term without
+// requirements matches nothing.
+func matchNodeSelectorTerms(terms []corev1.NodeSelectorTerm, node *corev1.Node) (bool, error) {
+	for _, term := range terms {
+		if len(term.MatchExpressions) == 0 && len(term.MatchFields) == 0 {
+			continue
+		}
+		matched, err := matchExpressions(term.MatchExpressions, labels.Set(node.Labels))
+		if err != nil {
+			return false, err
+		}
+		if matched {
+			if matched, err = matchFields(term.MatchFields, node); err != nil {
+				return false, err
+			}
+		}
+		if matched {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func matchExpressions(reqs []corev1.NodeSelectorRequirement, nodeLabels labels.Set) (bool, error) {
+	for _, req := range reqs {
+		op, ok := nodeSelectorOps[req.Operator]
+		if !ok {
+			return false, errors.Errorf("unknown operator %q", req.Operator)
+		}
+		requirement, err := labels.NewRequirement(req.Key, op, req.Values)
+		if err != nil {
+			return false, errors.WithStack(err)
+		}
+		if !requirement.Matches(nodeLabels) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// matchFields supports metadata.name only, as the scheduler does.
+func matchFields(reqs []corev1.NodeSelectorRequirement, node *corev1.Node) (bool, error) {
+	for _, req := range reqs {
+		if req.Key != "metadata.name" {
+			return false, errors.Errorf("unsupported field %q", req.Key)
+		}
+		switch req.Operator {
+		case corev1.NodeSelectorOpIn:
+			if !containsString(req.Values, node.Name) {
+				return false, nil
+			}
+		case corev1.NodeSelectorOpNotIn:
+			if containsString(req.Values, node.Name) {
+				return false, nil
+			}
+		default:
+			return false, errors.Errorf("unsupported operator %q for %s", req.Operator, req.Key)
+		}
+	}
+	return true, nil
+}
+
+// findNode returns the Node with NodeIP, or nil when there is none.
+func findNode(ctx context.Context, c client.Reader) (*corev1.Node, error) {
+	var nodeList corev1.NodeList
+	if err := c.List(ctx, &nodeList); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return currentNode(nodeList), nil
+}
@@ -0,0 +1,93 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestUnschedulableReason(t *testing.T) {
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node1", Labels: map[string]string{"zone": "a", "gpu": "2"}},
+		Spec: corev1.NodeSpec{Taints: []corev1.Taint{
+			{Key: "dedicated", Value: "ml", Effect: corev1.TaintEffectNoSchedule},
+			{Key: "node.kubernetes.io/unschedulable", Effect: corev1.TaintEffectNoSchedule},
+			{Key: "soft", Effect: corev1.TaintEffectPreferNoSchedule},
+		}},
+	}
+	tolerateML := []corev1.Toleration{{Key: "dedicated", Operator: corev1.TolerationOpEqual, Value: "ml"}}
+	affinity := func(terms ...corev1.NodeSelectorTerm) *corev1.Affinity {
+		return &corev1.Affinity{NodeAffinity: &corev1.NodeAffinity{
+			RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{NodeSelectorTerms: terms}}}
+	}
+	expr := func(key string, op corev1.NodeSelectorOperator, values ...string) corev1.NodeSelectorTerm {
+		return corev1.NodeSelectorTerm{MatchExpressions: []corev1.NodeSelectorRequirement{
+			{Key: key, Operator: op, Values: values}}}
+	}
+
+	for _, tc := range []struct {
+		name     string
+		spec     corev1.PodSpec
+		schedule bool
+	}{
+		{"untolerated taint", corev1.PodSpec{}, false},
+		{"tolerated", corev1.PodSpec{Tolerations: tolerateML}, true},
+		{"tolerate all", corev1.PodSpec{Tolerations: []corev1.Toleration{{Operator: corev1.TolerationOpExists}}}, true},
+		{"node selector", corev1.PodSpec{Tolerations: tolerateML, NodeSelector: map[string]string{"zone": "a"}}, true},
+		{"other zone", corev1.PodSpec{Tolerations: tolerateML, NodeSelector: map[string]string{"zone": "b"}}, false},
+		{"node name", corev1.PodSpec{Tolerations: tolerateML, NodeName: "node2"}, false},
+		{"affinity in", corev1.PodSpec{Tolerations: tolerateML,
+			Affinity: affinity(expr("zone", corev1.NodeSelectorOpIn, "a", "b"))}, true},
+		{"affinity any term", corev1.PodSpec{Tolerations: tolerateML,
+			Affinity: affinity(expr("zone", corev1.NodeSelectorOpIn, "b"), expr("gpu", corev1.NodeSelectorOpGt, "1"))}, true},
+		{"affinity not in", corev1.PodSpec{Tolerations: tolerateML,
+			Affinity: affinity(expr("zone", corev1.NodeSelectorOpNotIn, "a"))}, false},
+		{"affinity field", corev1.PodSpec{Tolerations: tolerateML,
+			Affinity: affinity(corev1.NodeSelectorTerm{MatchFields: []corev1.NodeSelectorRequirement{
+				{Key: "metadata.name", Operator: corev1.NodeSelectorOpIn, Values: []string{"node1"}}}})}, true},
+		{"affinity empty term", corev1.PodSpec{Tolerations: tolerateML, Affinity: affinity(corev1.NodeSelectorTerm{})}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			reason := unschedulableReason(&tc.spec, node)
+			if (reason == "") != tc.schedule {
+				t.Fatalf("reason = %q, want schedulable %v", reason, tc.schedule)
+			}
+		})
+	}
+}
+
+func TestVerifyNodeSkipsUnschedulable(t *testing.T) {
+	oldAll := ProvisionAllNodes
+	defer func() { ProvisionAllNodes = oldAll }()
+
+	bfl := func(user, zone string) *appsv1.StatefulSet {
+		sts := &appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{
+			Namespace: "user-space-" + user, Name: BflStatefulSetName, Labels: map[string]string{"tier": "bfl"},
+			Annotations: map[string]string{BflAnnotationAppCache: "/" + user + "/a", BflAnnotationDbData: "/" + user + "/d"},
+		}}
+		sts.Spec.Template.Spec.NodeSelector = map[string]string{"zone": zone}
+		return sts
+	}
+	c := fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).
+		WithObjects(bfl("alice", "a"), bfl("bob", "b")).Build()
+	node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1", Labels: map[string]string{"zone": "a"}}}
+
+	results, err := verifyNode(context.Background(), c, newMemFS(), node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || results[0].Skipped != "" || len(results[0].Dirs) == 0 ||
+		results[1].Skipped == "" || len(results[1].Dirs) != 0 || !results[1].Ready() {
+		t.Fatalf("results = %+v %+v", results[0], results[1])
+	}
+
+	ProvisionAllNodes = true
+	if results, err = verifyNode(context.Background(), c, newMemFS(), node); err != nil || results[1].Skipped != "" {
+		t.Fatalf("bob skipped with ProvisionAllNodes, %+v, %v", results[1], err)
+	}
+}
@@ -1,23 +1,68 @@
 package controllers
 
 import (
+	"reflect"
+
+	corev1 "k8s.io/api/core/v1"
 	"sigs.k8s.io/controller-runtime/pkg/event"
 	"sigs.k8s.io/controller-runtime/pkg/predicate"
 )
 
-func newCreateOnlyPredicate(f func(e event.CreateEvent) bool) predicate.Predicate {
+// newTargetPredicate passes created target objects, updates of the hostpath
+// annotations of one, whose data may have to be migrated before its pods
+// start on the new dirs, and updates of where its pods may run.
+func newTargetPredicate() predicate.Predicate {
 	return predicate.Funcs{
 		CreateFunc: func(createEvent event.CreateEvent) bool {
-			if f != nil {
-				return f(createEvent)
+			_, ok := matchTarget(createEvent.Object)
+			return ok
+		},
+		DeleteFunc: func(deleteEvent event.DeleteEvent) bool {
+			return false
+		},
+		UpdateFunc: func(updateEvent event.UpdateEvent) bool {
+			o, ok := matchTarget(updateEvent.ObjectNew)
+			if !ok || updateEvent.ObjectOld == nil {
+				return false
 			}
+			old := targetObject{Object: updateEvent.ObjectOld, target: o.target}
+			return !mapsEqual(old.hostPaths(), o.hostPaths()) || !samePlacement(old.podSpec(), o.podSpec())
+		},
+		GenericFunc: func(genericEvent event.GenericEvent) bool {
+			return false
+		},
+	}
+}
+
+// samePlacement compares the fields of two pod specs skipReason looks at.
+func samePlacement(a, b *corev1.PodSpec) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.NodeName == b.NodeName &&
+		reflect.DeepEqual(a.NodeSelector, b.NodeSelector) &&
+		reflect.DeepEqual(a.Affinity, b.Affinity) &&
+		reflect.DeepEqual(a.Tolerations, b.Tolerations)
+}
+
+// newNodePredicate passes created nodes, and updates of the labels or taints
+// of this node, which decide the target objects it provisions.
+func newNodePredicate() predicate.Predicate {
+	return predicate.Funcs{
+		CreateFunc: func(createEvent event.CreateEvent) bool {
 			return true
 		},
 		DeleteFunc: func(deleteEvent event.DeleteEvent) bool {
 			return false
 		},
 		UpdateFunc: func(updateEvent event.UpdateEvent) bool {
-			return false
+			oldNode, ok := updateEvent.ObjectOld.(*corev1.Node)
+			newNode, ok2 := updateEvent.ObjectNew.(*corev1.Node)
+			if !ok || !ok2 || !isCurrentNode(newNode) {
+				return false
+			}
+			return !reflect.DeepEqual(oldNode.Labels, newNode.Labels) ||
+				!reflect.DeepEqual(oldNode.Spec.Taints, newNode.Spec.Taints)
 		},
 		GenericFunc: func(genericEvent event.GenericEvent) bool {
 			return false
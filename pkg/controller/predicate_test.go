@@ -0,0 +1,50 @@
+package controllers
+
+import (
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+)
+
+func TestTargetPredicate(t *testing.T) {
+	bfl := func(appCache, revision string) *appsv1.StatefulSet {
+		return &appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{
+			Namespace: "user-space-alice", Name: BflStatefulSetName, Labels: map[string]string{"tier": "bfl"},
+			Annotations: map[string]string{BflAnnotationAppCache: appCache, BflAnnotationDbData: "/d", "revision": revision},
+		}}
+	}
+	p := newTargetPredicate()
+
+	if !p.Create(event.CreateEvent{Object: bfl("/a", "1")}) {
+		t.Error("created bfl filtered")
+	}
+	if !p.Update(event.UpdateEvent{ObjectOld: bfl("/a", "1"), ObjectNew: bfl("/b", "1")}) {
+		t.Error("hostpath change filtered")
+	}
+	if p.Update(event.UpdateEvent{ObjectOld: bfl("/a", "1"), ObjectNew: bfl("/a", "2")}) {
+		t.Error("update of another annotation passed")
+	}
+	moved := bfl("/a", "1")
+	moved.Spec.Template.Spec.NodeSelector = map[string]string{"zone": "a"}
+	if !p.Update(event.UpdateEvent{ObjectOld: bfl("/a", "1"), ObjectNew: moved}) {
+		t.Error("node selector change filtered")
+	}
+	tolerating := bfl("/a", "1")
+	tolerating.Spec.Template.Spec.Tolerations = []corev1.Toleration{{Key: "dedicated", Operator: corev1.TolerationOpExists}}
+	if !p.Update(event.UpdateEvent{ObjectOld: bfl("/a", "1"), ObjectNew: tolerating}) {
+		t.Error("toleration change filtered")
+	}
+	upgraded := bfl("/a", "1")
+	upgraded.Spec.Template.Spec.Containers = []corev1.Container{{Name: "bfl", Image: "bfl:2"}}
+	if p.Update(event.UpdateEvent{ObjectOld: bfl("/a", "1"), ObjectNew: upgraded}) {
+		t.Error("update of the containers passed")
+	}
+	other := bfl("/a", "1")
+	other.Labels = nil
+	if p.Update(event.UpdateEvent{ObjectOld: bfl("/a", "1"), ObjectNew: other}) {
+		t.Error("update of a non target passed")
+	}
+}
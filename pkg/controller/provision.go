@@ -0,0 +1,155 @@
+package controllers
+
+import (
+	"context"
+	"strings"
+
+	"bytetrade.io/web3os/osnode-init/pkg/log"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// DataDir is a user data directory and the owner it should have.
+type DataDir struct {
+	Path string `json:"path"`
+	Uid  int    `json:"uid"`
+	Gid  int    `json:"gid"`
+	// Template seeds the dir when it is created.
+	Template *TemplateSource `json:"template,omitempty"`
+}
+
+// DirState is the observed state of a DataDir on this node.
+type DirState struct {
+	DataDir
+	Exists     bool `json:"exists"`
+	OwnerMatch bool `json:"ownerMatch"`
+	ActualUid  int  `json:"actualUid,omitempty"`
+	ActualGid  int  `json:"actualGid,omitempty"`
+}
+
+// ProvisionResult describes the data dirs of one target object.
+type ProvisionResult struct {
+	TargetRef
+	Dirs []DirState `json:"dirs,omitempty"`
+	// Skipped tells why the object is not provisioned on this node.
+	Skipped string `json:"skipped,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Ready reports whether every dir exists with the expected owner.
+func (p *ProvisionResult) Ready() bool {
+	if p.Error != "" {
+		return false
+	}
+	for _, d := range p.Dirs {
+		if !d.Exists || !d.OwnerMatch {
+			return false
+		}
+	}
+	return true
+}
+
+func inspectDirs(fsys FileSystem, dirs []DataDir) []DirState {
+	var states []DirState
+	for _, dir := range dirs {
+		state := DirState{DataDir: dir}
+		if stat, err := fsys.Stat(dir.Path); err == nil {
+			state.Exists = stat.Mode.IsDir()
+			state.ActualUid, state.ActualGid = stat.Uid, stat.Gid
+			state.OwnerMatch = state.ActualUid == dir.Uid && state.ActualGid == dir.Gid
+		}
+		states = append(states, state)
+	}
+	return states
+}
+
+// provisionTarget creates the data dirs of o and returns how many of them
+// were created or chowned. c reads the ConfigMaps of dir templates.
+func provisionTarget(ctx context.Context, c client.Reader, fsys FileSystem, o targetObject) (int, error) {
+	log.FromContext(ctx).Debugf("creating data dirs of %s", o.ref())
+	if missing := o.missingAnnotations(); len(missing) > 0 {
+		return 0, errors.Errorf("%s has no userdata annotation %s", o.ref(), strings.Join(missing, ", "))
+	}
+	changed, err := createDataDirs(ctx, c, fsys, o)
+	if err != nil {
+		return changed, errors.Errorf("creating data dirs of %s, %v", o.ref(), err)
+	}
+	return changed, nil
+}
+
+// ProvisionNamespace creates the data dirs of every target object in
+// namespace on this node, the same way Reconcile does.
+func ProvisionNamespace(ctx context.Context, c client.Reader, namespace string) ([]*ProvisionResult, error) {
+	node, err := findNode(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	return provisionNamespace(ctx, c, hostFS, node, namespace)
+}
+
+func provisionNamespace(ctx context.Context, c client.Reader, fsys FileSystem, node *corev1.Node, namespace string) ([]*ProvisionResult, error) {
+	objects, err := listTargets(ctx, c, namespace)
+	if err != nil {
+		return nil, err
+	}
+	if len(objects) == 0 {
+		return nil, errors.Errorf("nothing to provision in namespace %q", namespace)
+	}
+
+	var results []*ProvisionResult
+	var failed int
+	for _, o := range objects {
+		result := &ProvisionResult{TargetRef: o.ref()}
+		if result.Skipped = o.skipReason(node); result.Skipped != "" {
+			results = append(results, result)
+			continue
+		}
+		_, err := provisionTarget(log.WithValues(ctx, "namespace", namespace), c, fsys, o)
+		if err != nil {
+			result.Error = err.Error()
+			failed++
+		}
+		if len(o.missingAnnotations()) == 0 {
+			result.Dirs = inspectDirs(fsys, o.dataDirs())
+		}
+		results = append(results, result)
+	}
+	if failed > 0 {
+		return results, errors.Errorf("%d of %d objects in %q failed to provision", failed, len(results), namespace)
+	}
+	return results, nil
+}
+
+// VerifyNode inspects the data dirs of every target object on this node
+// without changing anything.
+func VerifyNode(ctx context.Context, c client.Reader) ([]*ProvisionResult, error) {
+	node, err := findNode(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	return verifyNode(ctx, c, hostFS, node)
+}
+
+func verifyNode(ctx context.Context, c client.Reader, fsys FileSystem, node *corev1.Node) ([]*ProvisionResult, error) {
+	objects, err := listTargets(ctx, c, "")
+	if err != nil {
+		return nil, err
+	}
+
+	var results []*ProvisionResult
+	for _, o := range objects {
+		result := &ProvisionResult{TargetRef: o.ref()}
+		result.Skipped = o.skipReason(node)
+		missing := o.missingAnnotations()
+		switch {
+		case result.Skipped != "":
+		case len(missing) > 0:
+			result.Error = "no userdata annotation " + strings.Join(missing, ", ")
+		default:
+			result.Dirs = inspectDirs(fsys, o.dataDirs())
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
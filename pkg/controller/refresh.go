@@ -0,0 +1,182 @@
+package controllers
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"bytetrade.io/web3os/osnode-init/pkg/cloud"
+	"bytetrade.io/web3os/osnode-init/pkg/juicefs"
+	"bytetrade.io/web3os/osnode-init/pkg/log"
+	"bytetrade.io/web3os/osnode-init/pkg/tracing"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// EnvJuicefsSearchPaths overrides JuicefsSearchPaths, comma separated.
+const EnvJuicefsSearchPaths = "JUICEFS_SEARCH_PATHS"
+
+// JuicefsSearchPaths are where the juicefs client is looked for, in order.
+// Absolute paths are host paths, see HostPaths, names are looked up in
+// $PATH.
+var JuicefsSearchPaths = []string{"/usr/local/bin/juicefs", "/usr/bin/juicefs", "juicefs"}
+
+// findJuicefs returns the first juicefs client on the search paths of a
+// supported version.
+func findJuicefs(ctx context.Context) (*juicefs.Binary, error) {
+	candidates := make([]string, 0, len(JuicefsSearchPaths))
+	for _, p := range JuicefsSearchPaths {
+		candidates = append(candidates, localPath(p))
+	}
+	return juicefs.Find(ctx, candidates)
+}
+
+// RefreshOptions tunes a single credential refresh.
+type RefreshOptions struct {
+	// Bucket defaults to $S3_BUCKET.
+	Bucket string
+	// DryRun resolves everything the refresh needs without calling Space,
+	// juicefs or updating the Terminus object.
+	DryRun bool
+	// FindJuicefs returns the client to apply the credentials with,
+	// findJuicefs by default.
+	FindJuicefs func(context.Context) (*juicefs.Binary, error)
+}
+
+// RefreshResult describes what a credential refresh did.
+type RefreshResult struct {
+	Bucket string `json:"bucket"`
+	// ClusterId is the cluster the credentials are requested for.
+	ClusterId string `json:"clusterId,omitempty"`
+	// Prefix is the bucket prefix of the credentials, by default the
+	// cluster id.
+	Prefix     string `json:"prefix,omitempty"`
+	DryRun     bool   `json:"dryRun,omitempty"`
+	Skipped    bool   `json:"skipped,omitempty"`
+	Reason     string `json:"reason,omitempty"`
+	Expiration string `json:"expiration,omitempty"`
+	Fetched    bool   `json:"fetched"`
+	Applied    bool   `json:"applied"`
+	Error      string `json:"error,omitempty"`
+	// Juicefs is the client the credentials are applied with.
+	Juicefs *juicefs.Binary `json:"juicefs,omitempty"`
+	// NextRefresh is when Olares Space asked for the next refresh.
+	NextRefresh *time.Time `json:"nextRefresh,omitempty"`
+	// RetryAt is the earliest Olares Space accepts a retry after a
+	// failure, from its Retry-After header.
+	RetryAt *time.Time `json:"retryAt,omitempty"`
+}
+
+// RefreshCredentials fetches a new S3 session token from Olares Space,
+// applies it to juicefs and records it on the Terminus object.
+func RefreshCredentials(ctx context.Context, config *rest.Config,
+	settings *SettingsAccountClient, opts RefreshOptions) (_ *RefreshResult, err error) {
+	ctx, span := tracing.Start(ctx, "RefreshCredentials", attribute.Bool("dry_run", opts.DryRun))
+	defer func() { tracing.End(span, err) }()
+
+	ctx = log.NewContext(ctx, log.FromContext(ctx).Named(log.ComponentController).
+		With("rotationID", uuid.New().String()))
+	logger := log.FromContext(ctx)
+
+	result := &RefreshResult{Bucket: opts.Bucket, DryRun: opts.DryRun}
+	if result.Bucket == "" {
+		result.Bucket = os.Getenv("S3_BUCKET")
+	}
+
+	fail := func(e error) (*RefreshResult, error) {
+		result.Error = e.Error()
+		return result, e
+	}
+
+	if result.Bucket == "" {
+		return fail(errors.New("bucket is unknown"))
+	}
+	if result.Bucket == "none" {
+		result.Skipped, result.Reason = true, "no s3 bucket is used"
+		return result, nil
+	}
+
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return fail(errors.Errorf("create kube client error, %v", err))
+	}
+	kubeClient, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return fail(errors.Errorf("create kube client error, %v", err))
+	}
+
+	// an unusable client fails the refresh before Space hands out a token
+	// it cannot apply
+	if opts.FindJuicefs == nil {
+		opts.FindJuicefs = findJuicefs
+	}
+	binary, err := opts.FindJuicefs(ctx)
+	if err != nil {
+		return fail(err)
+	}
+	result.Juicefs = binary
+
+	if result.ClusterId, _, _, _, err = getClusterId(ctx, dynamicClient); err != nil {
+		return fail(err)
+	}
+	if opts.DryRun {
+		if _, _, err = getRedisIpAndPassword(); err != nil {
+			return fail(errors.Errorf("find juicefs redis, %v", err))
+		}
+		result.Reason = "credentials would be refreshed"
+		return result, nil
+	}
+
+	logger.Info("get refresh session token from cloud")
+	account, err := GetAwsAccountFromCloud(ctx, kubeClient, dynamicClient, settings, result.Bucket)
+	if err != nil {
+		if d, ok := cloud.RetryAfter(err); ok {
+			retryAt := time.Now().Add(d)
+			result.RetryAt = &retryAt
+		}
+		return fail(errors.Errorf("get token from cloud error, %v", err))
+	}
+	result.Prefix, result.Expiration = account.Prefix, account.Expiration
+	if next, ok := account.NextRefreshAt(); ok {
+		result.NextRefresh = &next
+	}
+	result.Fetched = true
+
+	if err = applyJuicefsCredentials(ctx, binary, account); err != nil {
+		return fail(err)
+	}
+
+	logger.Info("refresh succeed, update terminus s3 labels")
+	if err = updateAwsAccount(ctx, dynamicClient, account); err != nil {
+		return fail(errors.Errorf("update terminus s3 labels error, %v", err))
+	}
+	result.Applied = true
+
+	return result, nil
+}
+
+// applyJuicefsCredentials writes the new session token into the juicefs
+// volume config. A failure of juicefs is a *juicefs.CommandError.
+func applyJuicefsCredentials(ctx context.Context, binary *juicefs.Binary, account *AWSAccount) (err error) {
+	ctx, span := tracing.Start(ctx, "applyJuicefsCredentials", attribute.String("juicefs.version", binary.Version.String()))
+	defer func() { tracing.End(span, err) }()
+
+	logger := log.FromContext(ctx)
+
+	logger.Info("find juicefs redis ip and password")
+	ip, pwd, err := getRedisIpAndPassword()
+	if err != nil {
+		return errors.Errorf("find juicefs redis, %v", err)
+	}
+
+	logger.Infof("refresh juicefs config of %s with juicefs %s", ip, binary.Version)
+	return binary.Config(ctx, "redis://:"+pwd+"@"+ip+":6379/1", juicefs.Credentials{
+		AccessKey:    account.Key,
+		SecretKey:    account.Secret,
+		SessionToken: account.Token,
+	})
+}
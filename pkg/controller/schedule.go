@@ -0,0 +1,115 @@
+package controllers
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"bytetrade.io/web3os/osnode-init/pkg/log"
+	"bytetrade.io/web3os/osnode-init/pkg/schedule"
+	"github.com/pkg/errors"
+	"k8s.io/client-go/dynamic"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+const (
+	refreshInterval = 8 * time.Hour
+	// refreshBefore renews credentials this long before they expire, when
+	// that comes before the next scheduled run.
+	refreshBefore     = time.Hour
+	refreshMinBackoff = time.Minute
+	refreshMaxBackoff = time.Hour
+	// refreshJitter delays each refresh by up to this much.
+	refreshJitter = 10 * time.Minute
+
+	// schedulerGracePeriod is how late the refresh job may start before
+	// the scheduler check fails.
+	schedulerGracePeriod = 5 * time.Minute
+)
+
+// refreshPolicy runs at $SCHEDULE, a cron spec, or every 8 hours at an
+// offset derived from the cluster id. The offset is stable across
+// restarts, so installs restarted together, e.g. by an upgrade, do not
+// call Olares Space at the same time. Without a cluster id, the offset is
+// random.
+func (r *NodeInitController) refreshPolicy(clusterId string) (schedule.Policy, error) {
+	var base schedule.Policy
+	if spec := os.Getenv("SCHEDULE"); spec != "" {
+		var err error
+		if base, err = schedule.Cron(spec); err != nil {
+			return nil, errors.Errorf("invalid SCHEDULE %q, %v", spec, err)
+		}
+	} else {
+		offset := schedule.RandomOffset(refreshInterval)
+		if clusterId != "" {
+			offset = schedule.OffsetOf(clusterId, refreshInterval)
+		}
+		base = schedule.Spread{Interval: refreshInterval, Offset: offset}
+	}
+	return &schedule.Refresh{
+		Base:          base,
+		RefreshBefore: refreshBefore,
+		MinBackoff:    refreshMinBackoff,
+		MaxBackoff:    refreshMaxBackoff,
+		Jitter:        refreshJitter,
+	}, nil
+}
+
+// setupRefresh schedules the credential refresh with mgr, on the master
+// node.
+func (r *NodeInitController) setupRefresh(mgr ctrl.Manager) error {
+	dynamicClient, err := dynamic.NewForConfig(r.config)
+	if err != nil {
+		return errors.Errorf("create dynamic client: %v", err)
+	}
+	r.dynamicClient = dynamicClient
+	r.settings = NewSettingsAccountClient(dynamicClient)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	clusterId, _, _, _, err := getClusterId(ctx, dynamicClient)
+	if err != nil {
+		log.Warnf("no cluster id to schedule the credential refresh by, %v", err)
+	}
+
+	if os.Getenv("S3_BUCKET") != "none" {
+		detectCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		r.detectJuicefs(detectCtx)
+	}
+
+	policy, err := r.refreshPolicy(clusterId)
+	if err != nil {
+		return err
+	}
+	r.refresher = schedule.New(policy, r.refreshJob, schedule.WithClock(r.clock))
+	return errors.WithStack(mgr.Add(r.refresher))
+}
+
+// refreshJob runs with the context of the manager, so a shutdown cancels
+// the requests to Olares Space and the juicefs command in flight.
+func (r *NodeInitController) refreshJob(ctx context.Context) schedule.Outcome {
+	logger := log.FromContext(ctx)
+	result, err := r.TriggerRefresh(ctx)
+	switch {
+	case errors.Is(err, ErrRefreshRunning):
+		// the refresh already running, e.g. from the admin api, counts
+		logger.Infof("skip scheduled refresh, %v", err)
+		err = nil
+	case err != nil && ctx.Err() != nil:
+		logger.Warnf("refresh credentials cancelled by shutdown, %v", err)
+	case err != nil:
+		logger.Errorf("refresh credentials error, %v", err)
+	}
+	outcome := schedule.Outcome{Err: err}
+	if expiresAt, ok := r.status.credentialsExpireAt(); ok {
+		outcome.ExpiresAt = expiresAt
+	}
+	if result != nil && result.NextRefresh != nil {
+		outcome.NextHint = *result.NextRefresh
+	}
+	if result != nil && result.RetryAt != nil {
+		outcome.NotBefore = *result.RetryAt
+	}
+	return outcome
+}
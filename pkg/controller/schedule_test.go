@@ -0,0 +1,99 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"bytetrade.io/web3os/osnode-init/pkg/schedule"
+	"bytetrade.io/web3os/osnode-init/pkg/task"
+	clocktesting "k8s.io/utils/clock/testing"
+)
+
+// blockingRefresh stands in for the credentials task, it runs until
+// release is closed or its context is done.
+type blockingRefresh struct {
+	task.Base
+	started chan struct{}
+	release chan struct{}
+}
+
+func (t *blockingRefresh) Name() string    { return TaskCredentials }
+func (t *blockingRefresh) Scheduled() bool { return true }
+
+func (t *blockingRefresh) Run(ctx context.Context, _ *task.Node) error {
+	close(t.started)
+	select {
+	case <-t.release:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func newRefreshController() (*NodeInitController, *blockingRefresh) {
+	r := NewNodeInitController(nil, nil, nil)
+	job := &blockingRefresh{started: make(chan struct{}), release: make(chan struct{})}
+	r.tasks = task.NewRegistry()
+	r.tasks.MustRegister(job)
+	r.status.setMaster(true)
+	return r, job
+}
+
+func TestRefreshSkipsWhileRunning(t *testing.T) {
+	r, job := newRefreshController()
+
+	done := make(chan error)
+	go func() {
+		_, err := r.TriggerRefresh(context.Background())
+		done <- err
+	}()
+	<-job.started
+
+	if _, err := r.TriggerRefresh(context.Background()); !errors.Is(err, ErrRefreshRunning) {
+		t.Fatalf("err = %v, want ErrRefreshRunning", err)
+	}
+	// a scheduled run that finds a refresh running is not a failure
+	if outcome := r.refreshJob(context.Background()); outcome.Err != nil {
+		t.Fatalf("skipped run failed, %v", outcome.Err)
+	}
+
+	close(job.release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRefreshCancelledOnShutdown(t *testing.T) {
+	r, job := newRefreshController()
+	clk := clocktesting.NewFakeClock(time.Now())
+	policy := schedule.PolicyFunc(func(now time.Time, _ *schedule.Outcome) time.Time { return now.Add(time.Hour) })
+	s := schedule.New(policy, r.refreshJob, schedule.WithClock(clk))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error)
+	go func() { stopped <- s.Start(ctx) }()
+
+	for !clk.HasWaiters() {
+		time.Sleep(time.Millisecond)
+	}
+	clk.Step(time.Hour)
+	<-job.started
+
+	cancel()
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("scheduler did not stop with the refresh in flight")
+	}
+
+	// the lock is released, the next refresh can run
+	if !r.refreshMu.TryLock() {
+		t.Fatal("refresh lock still held")
+	}
+	r.refreshMu.Unlock()
+}
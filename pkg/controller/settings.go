@@ -0,0 +1,191 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"bytetrade.io/web3os/osnode-init/pkg/log"
+	"bytetrade.io/web3os/osnode-init/pkg/tracing"
+	"github.com/emicklei/go-restful/v3"
+	"github.com/go-resty/resty/v2"
+	"github.com/pkg/errors"
+	"k8s.io/client-go/dynamic"
+)
+
+// accountExpireMargin refreshes the cached account a bit before Space
+// considers the token expired.
+const accountExpireMargin = time.Minute
+
+// Timestamp accepts the formats settings uses for AccountValue.Expired:
+// unix seconds or milliseconds, as a number or a string, or RFC3339.
+type Timestamp struct {
+	time.Time
+}
+
+func (t *Timestamp) UnmarshalJSON(b []byte) error {
+	b = bytes.TrimSpace(b)
+	if len(b) == 0 || bytes.Equal(b, []byte("null")) {
+		t.Time = time.Time{}
+		return nil
+	}
+
+	v := string(bytes.Trim(b, `"`))
+	if v == "" {
+		t.Time = time.Time{}
+		return nil
+	}
+	if n, err := strconv.ParseFloat(v, 64); err == nil {
+		// seconds are 10 digits until 2286, anything larger is milliseconds
+		if n > 1e11 {
+			t.Time = time.UnixMilli(int64(n))
+		} else {
+			t.Time = time.Unix(int64(n), 0)
+		}
+		return nil
+	}
+	parsed, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return fmt.Errorf("invalid timestamp %s", b)
+	}
+	t.Time = parsed
+	return nil
+}
+
+func (t Timestamp) MarshalJSON() ([]byte, error) {
+	if t.IsZero() {
+		return []byte("null"), nil
+	}
+	return json.Marshal(t.UnixMilli())
+}
+
+// SettingsAccountClient fetches the Olares Space account of the cluster
+// owner from the owner's settings service, and caches it until expired.
+type SettingsAccountClient struct {
+	client dynamic.Interface
+
+	mu      sync.Mutex
+	admin   string
+	account *AccountValue
+}
+
+func NewSettingsAccountClient(client dynamic.Interface) *SettingsAccountClient {
+	return &SettingsAccountClient{client: client}
+}
+
+// Get returns the cached account, refreshing it when it is missing or about
+// to expire.
+func (s *SettingsAccountClient) Get(ctx context.Context) (*AccountValue, error) {
+	logger := log.FromContext(ctx)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.account != nil && !s.expired(time.Now()) {
+		return s.account, nil
+	}
+
+	if s.admin == "" {
+		admin, err := getAdminUser(ctx, s.client)
+		if err != nil {
+			return nil, err
+		}
+		s.admin = admin
+	}
+
+	account, err := getAccountFromSettings(ctx, s.admin)
+	if err != nil {
+		// the owner may have changed, look it up again next time
+		s.admin = ""
+		return nil, err
+	}
+	if account.Userid == "" || account.Token == "" {
+		return nil, errors.Errorf("olares space account of %q is not bound", s.admin)
+	}
+
+	logger.Infof("olares space account of %q fetched, expires at %v", s.admin, account.Expired)
+	s.account = account
+	return account, nil
+}
+
+// Invalidate drops the cached account, e.g. after Space rejected the token.
+func (s *SettingsAccountClient) Invalidate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.account = nil
+}
+
+// Refresh fetches the account again, dropping the cached one.
+func (s *SettingsAccountClient) Refresh(ctx context.Context) (*AccountValue, error) {
+	s.Invalidate()
+	return s.Get(ctx)
+}
+
+func (s *SettingsAccountClient) expired(now time.Time) bool {
+	if s.account.Expired.IsZero() {
+		// no expiration given, trust it until Space says otherwise
+		return false
+	}
+	return now.Add(accountExpireMargin).After(s.account.Expired.Time)
+}
+
+func getAccountFromSettings(ctx context.Context, admin string) (*AccountValue, error) {
+	logger := log.FromContext(ctx)
+	settingsUrl := fmt.Sprintf("http://settings-service.user-space-%s/api/account", admin)
+	client := tracing.InjectResty(resty.New()).SetTimeout(2 * time.Second).SetRetryCount(3)
+
+	req := &ProxyRequest{
+		Op:       "getAccount",
+		DataType: "account",
+		Version:  "v1",
+		Group:    "service.settings",
+		Data:     "settings-account-space",
+	}
+
+	terminusNonce, err := GenTerminusNonce()
+	if err != nil {
+		logger.Error("generate nonce error, ", err)
+		return nil, err
+	}
+
+	logger.Info("fetch account from settings, ", settingsUrl)
+	resp, err := client.R().SetContext(ctx).
+		SetHeader(restful.HEADER_ContentType, restful.MIME_JSON).
+		SetHeader("Terminus-Nonce", terminusNonce).
+		SetBody(req).
+		SetResult(&AccountResponse{}).
+		Post(settingsUrl)
+
+	if err != nil {
+		logger.Error("request settings account api error, ", err)
+		return nil, err
+	}
+
+	if resp.StatusCode() != http.StatusOK {
+		logger.Error("request settings account api response not ok, ", resp.StatusCode())
+		return nil, fmt.Errorf("settings account response, %d, %s", resp.StatusCode(), string(resp.Body()))
+	}
+
+	accountResp := resp.Result().(*AccountResponse)
+	if accountResp.Code != 0 {
+		logger.Error("request settings account api response error, ", accountResp.Code, ", ", accountResp.Message)
+		return nil, errors.New(accountResp.Message)
+	}
+
+	if accountResp.Data == nil {
+		logger.Error("request settings account api response data is nil, ", accountResp.Code, ", ", accountResp.Message)
+		return nil, errors.New("request settings account api response data is nil")
+	}
+
+	var value AccountValue
+	if err = json.Unmarshal([]byte(accountResp.Data.Value), &value); err != nil {
+		logger.Error("parse value error, ", err)
+		return nil, err
+	}
+
+	return &value, nil
+}
@@ -0,0 +1,251 @@
+package controllers
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"bytetrade.io/web3os/osnode-init/pkg/cloud"
+	"bytetrade.io/web3os/osnode-init/pkg/juicefs"
+	"bytetrade.io/web3os/osnode-init/pkg/task"
+	"github.com/pkg/errors"
+)
+
+// NamespaceStatus is the last provisioning outcome of a target object on
+// this node.
+type NamespaceStatus struct {
+	TargetRef
+	LastReconcile time.Time  `json:"lastReconcile"`
+	Error         string     `json:"error,omitempty"`
+	FailingSince  *time.Time `json:"failingSince,omitempty"`
+	Dirs          []DirState `json:"dirs,omitempty"`
+	// Skipped tells why the object is not provisioned on this node.
+	Skipped string `json:"skipped,omitempty"`
+	// Migration is the last data migration after a hostpath change.
+	Migration *MigrationStatus `json:"migration,omitempty"`
+}
+
+// CredentialStatus is the state of the S3 credential rotation, only filled
+// on the node that runs it.
+type CredentialStatus struct {
+	Expiration   string         `json:"expiration,omitempty"`
+	ExpiresAt    *time.Time     `json:"expiresAt,omitempty"`
+	LastRotation time.Time      `json:"lastRotation,omitempty"`
+	LastResult   *RefreshResult `json:"lastResult,omitempty"`
+	// NextRefresh is when the refresh job runs next, empty while it runs.
+	NextRefresh *time.Time `json:"nextRefresh,omitempty"`
+	// Juicefs is the last look for the juicefs client.
+	Juicefs *JuicefsStatus `json:"juicefs,omitempty"`
+}
+
+// Status is a snapshot of what the controller has done on this node.
+type Status struct {
+	Node        string            `json:"node"`
+	Master      bool              `json:"master"`
+	Namespaces  []NamespaceStatus `json:"namespaces"`
+	Credentials *CredentialStatus `json:"credentials,omitempty"`
+	Tasks       []task.Status     `json:"tasks,omitempty"`
+}
+
+type statusTracker struct {
+	mu     sync.RWMutex
+	master bool
+	// namespaces and migrations are keyed by TargetRef.key
+	namespaces  map[string]*NamespaceStatus
+	migrations  map[string]*MigrationStatus
+	credentials *CredentialStatus
+}
+
+func newStatusTracker() *statusTracker {
+	return &statusTracker{namespaces: map[string]*NamespaceStatus{}, migrations: map[string]*MigrationStatus{}}
+}
+
+func (t *statusTracker) setMaster(master bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.master = master
+	if master && t.credentials == nil {
+		t.credentials = &CredentialStatus{}
+	}
+}
+
+func (t *statusTracker) isMaster() bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.master
+}
+
+func (t *statusTracker) recordProvision(ref TargetRef, dirs []DataDir, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	s := &NamespaceStatus{TargetRef: ref, LastReconcile: now}
+	for _, d := range dirs {
+		s.Dirs = append(s.Dirs, DirState{DataDir: d})
+	}
+	if err != nil {
+		s.Error = err.Error()
+		s.FailingSince = &now
+		if prev, ok := t.namespaces[ref.key()]; ok && prev.FailingSince != nil {
+			s.FailingSince = prev.FailingSince
+		}
+	}
+	t.namespaces[ref.key()] = s
+}
+
+func (t *statusTracker) recordSkip(ref TargetRef, reason string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.namespaces[ref.key()] = &NamespaceStatus{TargetRef: ref, LastReconcile: time.Now(), Skipped: reason}
+}
+
+// provisioned is true once the dirs of ref were created without error.
+func (t *statusTracker) provisioned(ref TargetRef) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	s, ok := t.namespaces[ref.key()]
+	return ok && s.Skipped == "" && s.Error == ""
+}
+
+// retainTargets drops the status of target objects not in refs, e.g. of a
+// deleted user, so they no longer count as failing.
+func (t *statusTracker) retainTargets(refs []TargetRef) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	keep := make(map[string]bool, len(refs))
+	for _, ref := range refs {
+		keep[ref.key()] = true
+	}
+	for key := range t.namespaces {
+		if !keep[key] {
+			delete(t.namespaces, key)
+		}
+	}
+}
+
+func (t *statusTracker) recordMigration(ref TargetRef, m *MigrationStatus) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if m == nil {
+		delete(t.migrations, ref.key())
+		return
+	}
+	c := *m
+	c.Moves = append([]DirMove(nil), m.Moves...)
+	t.migrations[ref.key()] = &c
+}
+
+// failingSince returns the target objects that keep failing since before t.
+func (t *statusTracker) failingSince(before time.Time) []NamespaceStatus {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	var failing []NamespaceStatus
+	for _, ns := range t.namespaces {
+		if ns.FailingSince != nil && ns.FailingSince.Before(before) {
+			failing = append(failing, *ns)
+		}
+	}
+	return failing
+}
+
+func (t *statusTracker) credentialsExpireAt() (time.Time, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if !t.master || t.credentials == nil || t.credentials.ExpiresAt == nil {
+		return time.Time{}, false
+	}
+	return *t.credentials.ExpiresAt, true
+}
+
+func (t *statusTracker) recordRefresh(result *RefreshResult) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.credentials == nil {
+		t.credentials = &CredentialStatus{}
+	}
+	t.credentials.LastRotation = time.Now()
+	t.credentials.LastResult = result
+	if result != nil && result.Applied {
+		t.credentials.Expiration = result.Expiration
+		t.credentials.ExpiresAt = nil
+		if expiresAt, ok := cloud.ParseTimestamp(result.Expiration); ok {
+			t.credentials.ExpiresAt = &expiresAt
+		}
+	}
+}
+
+func (t *statusTracker) recordJuicefs(binary *juicefs.Binary, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.credentials == nil {
+		t.credentials = &CredentialStatus{}
+	}
+	s := &JuicefsStatus{Binary: binary, DetectedAt: time.Now()}
+	if err != nil {
+		s.Error = err.Error()
+		s.Unsupported = errors.Is(err, juicefs.ErrUnsupportedVersion)
+	}
+	t.credentials.Juicefs = s
+}
+
+// juicefsError is why the last look for the juicefs client failed.
+func (t *statusTracker) juicefsError() error {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if t.credentials == nil || t.credentials.Juicefs == nil || t.credentials.Juicefs.Error == "" {
+		return nil
+	}
+	return errors.New(t.credentials.Juicefs.Error)
+}
+
+func (t *statusTracker) lastRefresh() *RefreshResult {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if t.credentials == nil {
+		return nil
+	}
+	return t.credentials.LastResult
+}
+
+// snapshot copies the status, refreshing the dir states from fsys.
+func (t *statusTracker) snapshot(fsys FileSystem) Status {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	status := Status{Node: NodeIP, Master: t.master}
+	for _, ns := range t.namespaces {
+		s := *ns
+		dirs := make([]DataDir, 0, len(ns.Dirs))
+		for _, d := range ns.Dirs {
+			dirs = append(dirs, d.DataDir)
+		}
+		s.Dirs = inspectDirs(fsys, dirs)
+		if m, ok := t.migrations[ns.key()]; ok {
+			c := *m
+			s.Migration = &c
+		}
+		status.Namespaces = append(status.Namespaces, s)
+	}
+	sort.Slice(status.Namespaces, func(i, j int) bool {
+		a, b := status.Namespaces[i], status.Namespaces[j]
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		return a.key() < b.key()
+	})
+
+	if t.credentials != nil {
+		c := *t.credentials
+		status.Credentials = &c
+	}
+	return status
+}
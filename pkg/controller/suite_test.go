@@ -0,0 +1,171 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/envtest"
+)
+
+// The integration tests run against an envtest API server. They are
+// skipped unless KUBEBUILDER_ASSETS points to its binaries, e.g.
+//
+//	KUBEBUILDER_ASSETS=$(setup-envtest use 1.25.x -p path) go test ./pkg/controller/
+var (
+	testEnv    *envtest.Environment
+	testConfig *rest.Config
+	testScheme = runtime.NewScheme()
+)
+
+func TestMain(m *testing.M) {
+	if os.Getenv("KUBEBUILDER_ASSETS") == "" {
+		os.Exit(m.Run())
+	}
+
+	_ = clientgoscheme.AddToScheme(testScheme)
+	testEnv = &envtest.Environment{
+		CRDDirectoryPaths:     []string{filepath.Join("testdata", "crds")},
+		ErrorIfCRDPathMissing: true,
+	}
+	cfg, err := testEnv.Start()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "start envtest: %v\n", err)
+		os.Exit(1)
+	}
+	testConfig = cfg
+
+	code := m.Run()
+	_ = testEnv.Stop()
+	os.Exit(code)
+}
+
+// hostEnv is a node of its own, with a temp dir standing in for /olares.
+type hostEnv struct {
+	t      *testing.T
+	ctx    context.Context
+	client client.Client
+	root   string
+	nodeIP string
+}
+
+var nodeSeq int
+
+func newHostEnv(t *testing.T) *hostEnv {
+	t.Helper()
+	if testConfig == nil {
+		t.Skip("KUBEBUILDER_ASSETS is not set, skipping integration test")
+	}
+
+	c, err := client.New(testConfig, client.Options{Scheme: testScheme})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nodeSeq++
+	h := &hostEnv{t: t, ctx: context.Background(), client: c, root: t.TempDir(),
+		nodeIP: fmt.Sprintf("10.0.0.%d", nodeSeq)}
+
+	// keep the test off the real host
+	oldNodeIP, oldPrereqs, oldStateDir, oldTemplates := NodeIP, HostPrereqs, migrationStateDir, DirTemplates
+	oldJuicefs, oldRedis := JuicefsSearchPaths, redisConfPath
+	t.Cleanup(func() {
+		NodeIP, HostPrereqs, migrationStateDir, DirTemplates = oldNodeIP, oldPrereqs, oldStateDir, oldTemplates
+		JuicefsSearchPaths, redisConfPath = oldJuicefs, oldRedis
+	})
+	NodeIP = h.nodeIP
+	HostPrereqs = HostPrerequisites{}
+	DirTemplates = map[string]*TemplateSource{}
+	migrationStateDir = filepath.Join(h.root, ".osnode-init", "migrations")
+	JuicefsSearchPaths = []string{filepath.Join(h.root, "juicefs")}
+	redisConfPath = filepath.Join(h.root, "redis.conf")
+	return h
+}
+
+// createNode creates the node of this env, a master when master is set.
+func (h *hostEnv) createNode(master bool) *corev1.Node {
+	h.t.Helper()
+	node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{
+		Name:   "node-" + h.nodeIP,
+		Labels: map[string]string{},
+	}}
+	if master {
+		node.Labels["node-role.kubernetes.io/master"] = ""
+	}
+	if err := h.client.Create(h.ctx, node); err != nil {
+		h.t.Fatal(err)
+	}
+	node.Status.Addresses = []corev1.NodeAddress{{Type: corev1.NodeInternalIP, Address: h.nodeIP}}
+	if err := h.client.Status().Update(h.ctx, node); err != nil {
+		h.t.Fatal(err)
+	}
+	h.t.Cleanup(func() { _ = h.client.Delete(context.Background(), node) })
+	return node
+}
+
+func (h *hostEnv) createNamespace(name string) {
+	h.t.Helper()
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name}}
+	if err := h.client.Create(h.ctx, ns); err != nil && !apierrors.IsAlreadyExists(err) {
+		h.t.Fatal(err)
+	}
+}
+
+// startManager runs the controller until the test ends.
+func (h *hostEnv) startManager() *NodeInitController {
+	h.t.Helper()
+	mgr, err := ctrl.NewManager(testConfig, ctrl.Options{
+		Scheme:                 testScheme,
+		MetricsBindAddress:     "0",
+		HealthProbeBindAddress: "0",
+	})
+	if err != nil {
+		h.t.Fatal(err)
+	}
+
+	r := NewNodeInitController(mgr.GetClient(), mgr.GetScheme(), testConfig)
+	if err = r.SetupWithManager(mgr); err != nil {
+		h.t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := mgr.Start(ctx); err != nil {
+			h.t.Errorf("manager stopped: %v", err)
+		}
+	}()
+	h.t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return r
+}
+
+// eventually retries check until it succeeds or timeout passes.
+func eventually(t *testing.T, timeout time.Duration, check func() error) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for {
+		err := check()
+		if err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("condition not met after %v: %v", timeout, err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
@@ -0,0 +1,365 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// EnvProvisionTargets points to the JSON file ProvisionTargets is loaded
+// from.
+const EnvProvisionTargets = "PROVISION_TARGETS"
+
+// Kinds of objects a provisioning target matches.
+const (
+	KindStatefulSet = "StatefulSet"
+	KindDeployment  = "Deployment"
+	KindDaemonSet   = "DaemonSet"
+	// KindNamespace matches namespaces, whose own annotations hold the
+	// hostpaths.
+	KindNamespace = "Namespace"
+)
+
+// TargetDir creates sub dirs under the hostpath in an annotation.
+type TargetDir struct {
+	Annotation string `json:"annotation"`
+	// SubDirs maps a sub dir name to its owner, [uid, gid].
+	SubDirs map[string][]int `json:"subDirs"`
+}
+
+// ProvisionTarget declares the objects whose data dirs are created on the
+// nodes.
+type ProvisionTarget struct {
+	// Name identifies the target in status and logs.
+	Name string `json:"name"`
+	Kind string `json:"kind"`
+	// Names matches the object name, any name when empty.
+	Names []string `json:"names,omitempty"`
+	// Namespaces are glob patterns, e.g. "user-space-*", any namespace
+	// when empty. For the Namespace kind they match the namespace itself.
+	Namespaces []string `json:"namespaces,omitempty"`
+	// Selector matches the labels of the object.
+	Selector *metav1.LabelSelector `json:"selector,omitempty"`
+	Dirs     []TargetDir           `json:"dirs"`
+	// AllNodes provisions on every node, not only where the pods of the
+	// object can be scheduled.
+	AllNodes bool `json:"allNodes,omitempty"`
+}
+
+// ProvisionTargets are provisioned on every node, see
+// LoadProvisionTargets. The built in target is the bfl of each user.
+var ProvisionTargets = []ProvisionTarget{{
+	Name:       "bfl",
+	Kind:       KindStatefulSet,
+	Names:      []string{BflStatefulSetName},
+	Namespaces: []string{"user-space*"},
+	Selector:   &metav1.LabelSelector{MatchLabels: map[string]string{"tier": "bfl"}},
+	Dirs: []TargetDir{
+		{Annotation: BflAnnotationAppCache, SubDirs: AppSubDirs},
+		{Annotation: BflAnnotationDbData, SubDirs: DbDataSubDirs},
+	},
+}}
+
+// LoadProvisionTargets replaces ProvisionTargets with the list in a JSON
+// file.
+func LoadProvisionTargets(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	var targets []ProvisionTarget
+	if err = json.Unmarshal(data, &targets); err != nil {
+		return errors.Errorf("parse %s, %v", path, err)
+	}
+	names := map[string]bool{}
+	for i := range targets {
+		t := &targets[i]
+		if names[t.Name] {
+			return errors.Errorf("duplicate provisioning target %q", t.Name)
+		}
+		names[t.Name] = true
+		if err = t.validate(); err != nil {
+			return errors.Errorf("provisioning target %q, %v", t.Name, err)
+		}
+	}
+	ProvisionTargets = targets
+	return nil
+}
+
+func (t *ProvisionTarget) validate() error {
+	if t.Name == "" {
+		return errors.New("name is required")
+	}
+	if newTargetList(t.Kind) == nil {
+		return errors.Errorf("unsupported kind %q", t.Kind)
+	}
+	for _, pattern := range t.Namespaces {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return errors.Errorf("invalid namespace pattern %q", pattern)
+		}
+	}
+	if _, err := t.labelSelector(); err != nil {
+		return err
+	}
+	if len(t.Dirs) == 0 {
+		return errors.New("no dirs")
+	}
+	for _, dir := range t.Dirs {
+		if dir.Annotation == "" {
+			return errors.New("dir without annotation")
+		}
+		for name, owner := range dir.SubDirs {
+			if name == "" || strings.Contains(name, "..") || filepath.IsAbs(name) {
+				return errors.Errorf("invalid sub dir %q", name)
+			}
+			if len(owner) != 2 {
+				return errors.Errorf("owner of %q is not [uid, gid]", name)
+			}
+		}
+	}
+	return nil
+}
+
+func (t *ProvisionTarget) labelSelector() (labels.Selector, error) {
+	if t.Selector == nil {
+		return labels.Everything(), nil
+	}
+	selector, err := metav1.LabelSelectorAsSelector(t.Selector)
+	if err != nil {
+		return nil, errors.Errorf("invalid selector, %v", err)
+	}
+	return selector, nil
+}
+
+func (t *ProvisionTarget) matches(o client.Object) bool {
+	if objectKind(o) != t.Kind {
+		return false
+	}
+	if len(t.Names) > 0 && !containsString(t.Names, o.GetName()) {
+		return false
+	}
+	namespace := o.GetNamespace()
+	if t.Kind == KindNamespace {
+		namespace = o.GetName()
+	}
+	if len(t.Namespaces) > 0 {
+		matched := false
+		for _, pattern := range t.Namespaces {
+			if ok, _ := path.Match(pattern, namespace); ok {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	selector, err := t.labelSelector()
+	return err == nil && selector.Matches(labels.Set(o.GetLabels()))
+}
+
+// hasSubDir reports whether any target creates a sub dir called name.
+func hasSubDir(name string) bool {
+	for _, t := range ProvisionTargets {
+		for _, dir := range t.Dirs {
+			if _, ok := dir.SubDirs[name]; ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func objectKind(o client.Object) string {
+	switch o.(type) {
+	case *appsv1.StatefulSet:
+		return KindStatefulSet
+	case *appsv1.Deployment:
+		return KindDeployment
+	case *appsv1.DaemonSet:
+		return KindDaemonSet
+	case *corev1.Namespace:
+		return KindNamespace
+	}
+	return ""
+}
+
+func newTargetObject(kind string) client.Object {
+	switch kind {
+	case KindStatefulSet:
+		return &appsv1.StatefulSet{}
+	case KindDeployment:
+		return &appsv1.Deployment{}
+	case KindDaemonSet:
+		return &appsv1.DaemonSet{}
+	case KindNamespace:
+		return &corev1.Namespace{}
+	}
+	return nil
+}
+
+func newTargetList(kind string) client.ObjectList {
+	switch kind {
+	case KindStatefulSet:
+		return &appsv1.StatefulSetList{}
+	case KindDeployment:
+		return &appsv1.DeploymentList{}
+	case KindDaemonSet:
+		return &appsv1.DaemonSetList{}
+	case KindNamespace:
+		return &corev1.NamespaceList{}
+	}
+	return nil
+}
+
+// targetKinds lists the kinds the targets match, each once.
+func targetKinds() []string {
+	var kinds []string
+	for _, t := range ProvisionTargets {
+		if !containsString(kinds, t.Kind) {
+			kinds = append(kinds, t.Kind)
+		}
+	}
+	return kinds
+}
+
+// TargetRef names an object matched by a provisioning target.
+type TargetRef struct {
+	Target    string `json:"target,omitempty"`
+	Kind      string `json:"kind,omitempty"`
+	Namespace string `json:"namespace"`
+	Name      string `json:"name,omitempty"`
+}
+
+func (r TargetRef) String() string {
+	if r.Kind == KindNamespace {
+		return "namespace " + r.Name
+	}
+	return strings.ToLower(r.Kind) + " " + r.Namespace + "/" + r.Name
+}
+
+func (r TargetRef) key() string {
+	return r.Kind + "/" + r.Namespace + "/" + r.Name
+}
+
+// targetObject is an object matched by a provisioning target.
+type targetObject struct {
+	client.Object
+	target *ProvisionTarget
+}
+
+// matchTarget returns o with the first target matching it.
+func matchTarget(o client.Object) (targetObject, bool) {
+	for i := range ProvisionTargets {
+		if ProvisionTargets[i].matches(o) {
+			return targetObject{Object: o, target: &ProvisionTargets[i]}, true
+		}
+	}
+	return targetObject{}, false
+}
+
+func (o targetObject) ref() TargetRef {
+	ref := TargetRef{Target: o.target.Name, Kind: o.target.Kind, Namespace: o.GetNamespace(), Name: o.GetName()}
+	if o.target.Kind == KindNamespace {
+		ref.Namespace = o.GetName()
+	}
+	return ref
+}
+
+// hostPaths maps each annotation of the target to its value on o.
+func (o targetObject) hostPaths() map[string]string {
+	paths := map[string]string{}
+	for _, dir := range o.target.Dirs {
+		paths[dir.Annotation] = o.GetAnnotations()[dir.Annotation]
+	}
+	return paths
+}
+
+func (o targetObject) missingAnnotations() []string {
+	var missing []string
+	for _, dir := range o.target.Dirs {
+		if o.GetAnnotations()[dir.Annotation] == "" {
+			missing = append(missing, dir.Annotation)
+		}
+	}
+	return missing
+}
+
+// dataDirs lists the dirs to create for o, sorted by path.
+func (o targetObject) dataDirs() []DataDir {
+	var dirs []DataDir
+	for _, dir := range o.target.Dirs {
+		parent := o.GetAnnotations()[dir.Annotation]
+		for name, owner := range dir.SubDirs {
+			dirs = append(dirs, DataDir{Path: filepath.Join(parent, name), Uid: owner[0], Gid: owner[1],
+				Template: DirTemplates[name]})
+		}
+	}
+	sort.Slice(dirs, func(i, j int) bool { return dirs[i].Path < dirs[j].Path })
+	return dirs
+}
+
+// listTargets lists the objects matched by the targets, in namespace only
+// unless it is empty.
+func listTargets(ctx context.Context, c client.Reader, namespace string) ([]targetObject, error) {
+	var objects []targetObject
+	for i := range ProvisionTargets {
+		t := &ProvisionTargets[i]
+		selector, err := t.labelSelector()
+		if err != nil {
+			return nil, err
+		}
+		list := newTargetList(t.Kind)
+		opts := []client.ListOption{client.MatchingLabelsSelector{Selector: selector}}
+		if namespace != "" && t.Kind != KindNamespace {
+			opts = append(opts, client.InNamespace(namespace))
+		}
+		if err = c.List(ctx, list, opts...); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		items, err := meta.ExtractList(list)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		for _, item := range items {
+			o, ok := item.(client.Object)
+			if !ok || !t.matches(o) {
+				continue
+			}
+			// an object matched by an earlier target belongs to that one
+			if first, _ := matchTarget(o); first.target != t {
+				continue
+			}
+			obj := targetObject{Object: o, target: t}
+			if namespace != "" && obj.ref().Namespace != namespace {
+				continue
+			}
+			objects = append(objects, obj)
+		}
+	}
+	sort.SliceStable(objects, func(i, j int) bool {
+		return objects[i].ref().Namespace < objects[j].ref().Namespace
+	})
+	return objects, nil
+}
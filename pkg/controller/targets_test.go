@@ -0,0 +1,151 @@
+package controllers
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"bytetrade.io/web3os/osnode-init/pkg/task"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// bflObject is sts as matched by the built in bfl target.
+func bflObject(sts *appsv1.StatefulSet) targetObject {
+	return targetObject{Object: sts, target: &ProvisionTargets[0]}
+}
+
+func TestListTargets(t *testing.T) {
+	oldTargets := ProvisionTargets
+	defer func() { ProvisionTargets = oldTargets }()
+	ProvisionTargets = append([]ProvisionTarget{
+		{
+			Name: "shared", Kind: KindDeployment, Namespaces: []string{"os-*"},
+			Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"data": "host"}},
+			Dirs:     []TargetDir{{Annotation: "data_hostpath", SubDirs: map[string][]int{"cache": {1000, 1000}}}},
+		},
+		{
+			Name: "ns", Kind: KindNamespace, Names: []string{"team-a"},
+			Dirs: []TargetDir{{Annotation: "share_hostpath", SubDirs: map[string][]int{"share": {1000, 1000}}}},
+		},
+	}, ProvisionTargets...)
+
+	bflLabels := map[string]string{"tier": "bfl"}
+	objects := []client.Object{
+		&appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Namespace: "user-space-alice", Name: BflStatefulSetName,
+			Labels: bflLabels, Annotations: map[string]string{BflAnnotationAppCache: "/a", BflAnnotationDbData: "/d"}}},
+		// not a user namespace
+		&appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Namespace: "os-system", Name: BflStatefulSetName, Labels: bflLabels}},
+		&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Namespace: "os-system", Name: "search",
+			Labels: map[string]string{"data": "host"}, Annotations: map[string]string{"data_hostpath": "/s"}}},
+		// no matching label
+		&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Namespace: "os-system", Name: "other"}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a"}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-b"}},
+	}
+	c := fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).WithObjects(objects...).Build()
+
+	got, err := listTargets(context.Background(), c, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []TargetRef{
+		{Target: "shared", Kind: KindDeployment, Namespace: "os-system", Name: "search"},
+		{Target: "ns", Kind: KindNamespace, Namespace: "team-a", Name: "team-a"},
+		{Target: "bfl", Kind: KindStatefulSet, Namespace: "user-space-alice", Name: BflStatefulSetName},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d objects, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i].ref() != want[i] {
+			t.Fatalf("object %d is %+v, want %+v", i, got[i].ref(), want[i])
+		}
+	}
+
+	if missing := got[1].missingAnnotations(); len(missing) != 1 || missing[0] != "share_hostpath" {
+		t.Fatalf("missing annotations %v", missing)
+	}
+	if dirs := got[0].dataDirs(); len(dirs) != 1 || dirs[0].Path != "/s/cache" {
+		t.Fatalf("dirs %+v", dirs)
+	}
+
+	inNs, err := listTargets(context.Background(), c, "team-a")
+	if err != nil || len(inNs) != 1 || inNs[0].ref().Kind != KindNamespace {
+		t.Fatalf("objects in team-a %+v, %v", inNs, err)
+	}
+}
+
+func TestLoadProvisionTargets(t *testing.T) {
+	oldTargets := ProvisionTargets
+	defer func() { ProvisionTargets = oldTargets }()
+
+	for _, tc := range []struct {
+		name    string
+		content string
+		wantErr bool
+	}{
+		{"valid", `[{"name": "apps", "kind": "DaemonSet", "namespaces": ["os-*"],
+			"dirs": [{"annotation": "data_hostpath", "subDirs": {"cache": [1000, 1000]}}]}]`, false},
+		{"unknown kind", `[{"name": "apps", "kind": "Job", "dirs": [{"annotation": "a", "subDirs": {}}]}]`, true},
+		{"no dirs", `[{"name": "apps", "kind": "Deployment"}]`, true},
+		{"bad owner", `[{"name": "apps", "kind": "Deployment",
+			"dirs": [{"annotation": "a", "subDirs": {"cache": [1000]}}]}]`, true},
+		{"escaping sub dir", `[{"name": "apps", "kind": "Deployment",
+			"dirs": [{"annotation": "a", "subDirs": {"../etc": [0, 0]}}]}]`, true},
+		{"duplicate name", `[{"name": "a", "kind": "Deployment", "dirs": [{"annotation": "a", "subDirs": {}}]},
+			{"name": "a", "kind": "DaemonSet", "dirs": [{"annotation": "a", "subDirs": {}}]}]`, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ProvisionTargets = oldTargets
+			path := filepath.Join(t.TempDir(), "targets.json")
+			if err := os.WriteFile(path, []byte(tc.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			err := LoadProvisionTargets(path)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tc.wantErr)
+			}
+			if err == nil && ProvisionTargets[0].Name != "apps" {
+				t.Fatalf("targets not replaced, %+v", ProvisionTargets)
+			}
+		})
+	}
+}
+
+func TestStatusForgetsDeletedTargets(t *testing.T) {
+	sts := &appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{
+		Namespace: "user-space-alice", Name: BflStatefulSetName, Labels: map[string]string{"tier": "bfl"}}}
+	c := fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).WithObjects(sts).Build()
+	r := NewNodeInitController(c, nil, nil)
+	r.fs = newMemFS()
+	dataDirs := &dataDirsTask{r: r}
+	node := &task.Node{Object: &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1"}}}
+
+	// no annotations, so the target fails until the user is deleted
+	if err := dataDirs.Run(context.Background(), node); err == nil {
+		t.Fatal("target without annotations should fail")
+	}
+	if failing := r.status.failingSince(time.Now().Add(time.Second)); len(failing) != 1 {
+		t.Fatalf("failing %+v", failing)
+	}
+
+	if err := c.Delete(context.Background(), sts); err != nil {
+		t.Fatal(err)
+	}
+	if err := dataDirs.Run(context.Background(), node); err != nil {
+		t.Fatal(err)
+	}
+	if failing := r.status.failingSince(time.Now().Add(time.Second)); len(failing) != 0 {
+		t.Fatalf("deleted target still failing, %+v", failing)
+	}
+	if namespaces := r.Status().Namespaces; len(namespaces) != 0 {
+		t.Fatalf("status %+v", namespaces)
+	}
+}
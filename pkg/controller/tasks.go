@@ -0,0 +1,125 @@
+package controllers
+
+import (
+	"context"
+	"strings"
+
+	"bytetrade.io/web3os/osnode-init/pkg/juicefs"
+	"bytetrade.io/web3os/osnode-init/pkg/log"
+	"bytetrade.io/web3os/osnode-init/pkg/task"
+	"github.com/pkg/errors"
+)
+
+// Built in tasks.
+const (
+	TaskDataDirs    = "data-dirs"
+	TaskCredentials = "s3-credentials"
+)
+
+// dataDirsTask creates the data dirs of every target object on this node.
+type dataDirsTask struct {
+	task.Base
+	r *NodeInitController
+}
+
+func (t *dataDirsTask) Name() string { return TaskDataDirs }
+
+func (t *dataDirsTask) Run(ctx context.Context, node *task.Node) error {
+	objects, err := listTargets(ctx, t.r, "")
+	if err != nil {
+		return err
+	}
+
+	refs := make([]TargetRef, 0, len(objects))
+	for _, o := range objects {
+		refs = append(refs, o.ref())
+	}
+	t.r.status.retainTargets(refs)
+
+	// one failing target does not hold up the others
+	var failed []string
+	for _, o := range objects {
+		ref := o.ref()
+		nsCtx := log.WithValues(ctx, "namespace", ref.Namespace, "target", ref.Target)
+		if reason := o.skipReason(node.Object); reason != "" {
+			log.FromContext(nsCtx).Debugf("skip %s on this node, %s", ref, reason)
+			t.r.status.recordSkip(ref, reason)
+			continue
+		}
+		migrating, err := t.r.migrateInBackground(nsCtx, o)
+		if migrating {
+			// provisioned once the data is at the new place
+			t.r.status.recordSkip(ref, "data migration is running")
+			continue
+		}
+		var changed int
+		if err == nil {
+			changed, err = provisionTarget(nsCtx, t.r.reader(), t.r.fs, o)
+		}
+		var dirs []DataDir
+		if len(o.missingAnnotations()) == 0 {
+			dirs = o.dataDirs()
+		}
+		t.r.status.recordProvision(ref, dirs, err)
+		t.r.recordProvisionEvents(o, node.Object, changed, err)
+		if err != nil {
+			failed = append(failed, err.Error())
+		}
+	}
+	if len(failed) > 0 {
+		return errors.Errorf("%d of %d target objects failed, %s", len(failed), len(objects), strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+func (t *dataDirsTask) Verify(ctx context.Context, node *task.Node) error {
+	results, err := verifyNode(ctx, t.r.Client, t.r.fs, node.Object)
+	if err != nil {
+		return err
+	}
+	var drift []string
+	for _, result := range results {
+		// a missing annotation is reported as a provisioning failure, and
+		// a target created since the last run is not provisioned yet
+		if result.Error != "" || !t.r.status.provisioned(result.TargetRef) {
+			continue
+		}
+		if !result.Ready() && !t.r.migrations.isRunning(result.key()) {
+			drift = append(drift, result.String())
+		}
+	}
+	if len(drift) > 0 {
+		return errors.Errorf("data dirs of %s are missing or have the wrong owner", strings.Join(drift, ", "))
+	}
+	return nil
+}
+
+// credentialsTask rotates the S3 credentials of juicefs, on the master node
+// only and on its own schedule.
+type credentialsTask struct {
+	task.Base
+	r *NodeInitController
+}
+
+func (t *credentialsTask) Name() string { return TaskCredentials }
+
+func (t *credentialsTask) Scheduled() bool { return true }
+
+func (t *credentialsTask) AppliesTo(node *task.Node) bool { return node.Master }
+
+func (t *credentialsTask) Run(ctx context.Context, _ *task.Node) error {
+	result, err := RefreshCredentials(ctx, t.r.config, t.r.settings, RefreshOptions{FindJuicefs: t.r.juicefsClient})
+	if errors.Is(err, juicefs.ErrUsage) {
+		t.r.forgetJuicefs()
+	}
+	t.r.status.recordRefresh(result)
+	t.r.recordRefreshEvents(ctx, result, err)
+	return err
+}
+
+func (t *credentialsTask) Verify(context.Context, *task.Node) error {
+	if expiresAt, ok := t.r.status.credentialsExpireAt(); ok && t.r.clock.Now().After(expiresAt) {
+		return errors.Errorf("s3 credentials expired at %v", expiresAt)
+	}
+	return nil
+}
@@ -0,0 +1,413 @@
+package controllers
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"bytetrade.io/web3os/osnode-init/pkg/log"
+	"bytetrade.io/web3os/osnode-init/pkg/tracing"
+	"github.com/go-resty/resty/v2"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// EnvDirTemplates points to the JSON file DirTemplates is loaded from.
+const EnvDirTemplates = "DATA_DIR_TEMPLATES"
+
+// TemplateSource is the initial content of a data dir, exactly one of the
+// fields is set. It is only copied into dirs which do not exist yet.
+type TemplateSource struct {
+	// ConfigMap is "namespace/name", each key becomes a file.
+	ConfigMap string `json:"configMap,omitempty"`
+	// HostTarball is the path of a tar or tar.gz file on the host.
+	HostTarball string `json:"hostTarball,omitempty"`
+	// OCI is an artifact in a local registry, e.g.
+	// "localhost:5000/olares/launcher-template:v1", whose layers are tar or
+	// tar.gz archives.
+	OCI string `json:"oci,omitempty"`
+	// PlainHTTP talks to the OCI registry without TLS.
+	PlainHTTP bool `json:"plainHTTP,omitempty"`
+}
+
+func (s *TemplateSource) String() string {
+	switch {
+	case s.ConfigMap != "":
+		return "configmap " + s.ConfigMap
+	case s.HostTarball != "":
+		return "tarball " + s.HostTarball
+	default:
+		return "oci " + s.OCI
+	}
+}
+
+func (s *TemplateSource) validate() error {
+	set := 0
+	for _, v := range []string{s.ConfigMap, s.HostTarball, s.OCI} {
+		if v != "" {
+			set++
+		}
+	}
+	if set != 1 {
+		return errors.New("exactly one of configMap, hostTarball or oci must be set")
+	}
+	if s.ConfigMap != "" && len(strings.Split(s.ConfigMap, "/")) != 2 {
+		return errors.Errorf("configMap %q is not namespace/name", s.ConfigMap)
+	}
+	return nil
+}
+
+// LoadDirTemplates reads DirTemplates from a JSON file, keyed by the name
+// of the sub dir, e.g. {"launcher": {"configMap": "os-system/launcher"}}.
+func LoadDirTemplates(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	templates := map[string]*TemplateSource{}
+	if err = json.Unmarshal(data, &templates); err != nil {
+		return errors.Errorf("parse %s, %v", path, err)
+	}
+	for name, t := range templates {
+		if !hasSubDir(name) {
+			return errors.Errorf("template for unknown data dir %q", name)
+		}
+		if err = t.validate(); err != nil {
+			return errors.Errorf("template of %q, %v", name, err)
+		}
+	}
+	DirTemplates = templates
+	return nil
+}
+
+// seedDir creates dir with the content of its template. The content is
+// prepared next to dir and renamed into place, so a dir either does not
+// exist or is fully seeded, and a failed seed is retried on next resync.
+func seedDir(ctx context.Context, c client.Reader, dir DataDir) (err error) {
+	ctx, span := tracing.Start(ctx, "seedDir",
+		attribute.String("dir", dir.Path), attribute.String("template", dir.Template.String()))
+	defer func() { tracing.End(span, err) }()
+
+	logger := log.FromContext(ctx).Named(log.ComponentFilesystem)
+	path := localPath(dir.Path)
+	parent, base := filepath.Dir(path), filepath.Base(path)
+	if err = os.MkdirAll(parent, 0755); err != nil {
+		return errors.WithStack(err)
+	}
+
+	// leftovers of a seed interrupted by a restart
+	stale, _ := filepath.Glob(filepath.Join(parent, "."+base+".seed-*"))
+	for _, s := range stale {
+		_ = os.RemoveAll(s)
+	}
+
+	tmp, err := os.MkdirTemp(parent, "."+base+".seed-")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer func() {
+		if err != nil {
+			_ = os.RemoveAll(tmp)
+		}
+	}()
+	if err = os.Chmod(tmp, 0755); err != nil {
+		return errors.WithStack(err)
+	}
+
+	switch t := dir.Template; {
+	case t.ConfigMap != "":
+		err = seedFromConfigMap(ctx, c, t.ConfigMap, tmp)
+	case t.HostTarball != "":
+		err = seedFromTarball(localPath(t.HostTarball), tmp)
+	case t.OCI != "":
+		err = seedFromOCI(ctx, t.OCI, t.PlainHTTP, tmp)
+	}
+	if err != nil {
+		return errors.Errorf("seed %s from %s, %v", dir.Path, dir.Template, err)
+	}
+
+	if err = chownTree(tmp, dir.Uid, dir.Gid); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, path); err != nil {
+		return errors.WithStack(err)
+	}
+	logger.Infof("%q seeded from %s", dir.Path, dir.Template)
+	return nil
+}
+
+func seedFromConfigMap(ctx context.Context, c client.Reader, ref, dest string) error {
+	if c == nil {
+		return errors.New("no kube client to read the configmap")
+	}
+	parts := strings.SplitN(ref, "/", 2)
+	var cm corev1.ConfigMap
+	if err := c.Get(ctx, types.NamespacedName{Namespace: parts[0], Name: parts[1]}, &cm); err != nil {
+		return errors.WithStack(err)
+	}
+
+	write := func(key string, data []byte) error {
+		if strings.Contains(key, "/") || key == ".." {
+			return errors.Errorf("invalid configmap key %q", key)
+		}
+		return errors.WithStack(os.WriteFile(filepath.Join(dest, key), data, 0644))
+	}
+	for key, value := range cm.Data {
+		if err := write(key, []byte(value)); err != nil {
+			return err
+		}
+	}
+	for key, value := range cm.BinaryData {
+		if err := write(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func seedFromTarball(path, dest string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer f.Close()
+	return extractTar(f, dest)
+}
+
+const (
+	mediaTypeOCIManifest    = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeDockerManifest = "application/vnd.docker.distribution.manifest.v2+json"
+)
+
+type ociManifest struct {
+	Layers []struct {
+		MediaType string `json:"mediaType"`
+		Digest    string `json:"digest"`
+	} `json:"layers"`
+}
+
+// seedFromOCI pulls the layers of ref with the registry API and extracts
+// them in order. Only single platform manifests are supported.
+func seedFromOCI(ctx context.Context, ref string, plainHTTP bool, dest string) error {
+	registry, repo, tag, err := parseOCIRef(ref)
+	if err != nil {
+		return err
+	}
+	scheme := "https"
+	if plainHTTP {
+		scheme = "http"
+	}
+	base := fmt.Sprintf("%s://%s/v2/%s", scheme, registry, repo)
+	client := tracing.InjectResty(resty.New()).SetTimeout(5 * time.Minute)
+
+	var manifest ociManifest
+	resp, err := client.R().SetContext(ctx).
+		SetHeader("Accept", mediaTypeOCIManifest+", "+mediaTypeDockerManifest).
+		SetResult(&manifest).
+		Get(base + "/manifests/" + tag)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if resp.StatusCode() != http.StatusOK {
+		return errors.Errorf("get manifest of %s, %d, %s", ref, resp.StatusCode(), string(resp.Body()))
+	}
+	if len(manifest.Layers) == 0 {
+		return errors.Errorf("%s has no layers", ref)
+	}
+
+	for _, layer := range manifest.Layers {
+		if err = pullLayer(ctx, client, base, layer.Digest, dest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func pullLayer(ctx context.Context, client *resty.Client, base, digest, dest string) error {
+	if !strings.HasPrefix(digest, "sha256:") {
+		return errors.Errorf("unsupported layer digest %q", digest)
+	}
+	resp, err := client.R().SetContext(ctx).SetDoNotParseResponse(true).Get(base + "/blobs/" + digest)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	body := resp.RawBody()
+	defer body.Close()
+	if resp.StatusCode() != http.StatusOK {
+		return errors.Errorf("get blob %s, %d", digest, resp.StatusCode())
+	}
+
+	// the blob is hashed while it is extracted, and rejected afterwards if
+	// it does not match, the tmp dir is thrown away then
+	hash := sha256.New()
+	if err = extractTar(io.TeeReader(body, hash), dest); err != nil {
+		return err
+	}
+	if _, err = io.Copy(hash, body); err != nil {
+		return errors.WithStack(err)
+	}
+	if got := "sha256:" + hex.EncodeToString(hash.Sum(nil)); got != digest {
+		return errors.Errorf("blob digest mismatch, want %s, got %s", digest, got)
+	}
+	return nil
+}
+
+// parseOCIRef splits "registry/repo:tag" or "registry/repo@sha256:...".
+func parseOCIRef(ref string) (registry, repo, tag string, err error) {
+	slash := strings.Index(ref, "/")
+	if slash <= 0 {
+		return "", "", "", errors.Errorf("oci reference %q has no registry", ref)
+	}
+	registry, rest := ref[:slash], ref[slash+1:]
+
+	if at := strings.Index(rest, "@"); at >= 0 {
+		return registry, rest[:at], rest[at+1:], nil
+	}
+	tag = "latest"
+	if colon := strings.LastIndex(rest, ":"); colon >= 0 {
+		rest, tag = rest[:colon], rest[colon+1:]
+	}
+	if rest == "" {
+		return "", "", "", errors.Errorf("oci reference %q has no repository", ref)
+	}
+	return registry, rest, tag, nil
+}
+
+// extractTar extracts a tar or tar.gz stream into dest. Entries escaping
+// dest, lexically or through a symlink extracted before, and special files
+// are rejected.
+func extractTar(r io.Reader, dest string) error {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		defer gz.Close()
+		r = gz
+	} else {
+		r = br
+	}
+
+	dest = filepath.Clean(dest)
+	within := func(p string) bool {
+		return p == dest || strings.HasPrefix(p, dest+string(filepath.Separator))
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		// layer whiteouts only matter for images
+		if strings.HasPrefix(filepath.Base(hdr.Name), ".wh.") {
+			continue
+		}
+		target := filepath.Join(dest, hdr.Name)
+		if !within(target) {
+			return errors.Errorf("tar entry %q escapes the target dir", hdr.Name)
+		}
+		// a symlink that points inside dest by itself may not once another
+		// symlink is followed below it, so nothing is written through one
+		if err = noSymlinkBetween(dest, filepath.Dir(target)); err != nil {
+			return errors.Wrapf(err, "tar entry %q", hdr.Name)
+		}
+		mode := os.FileMode(hdr.Mode).Perm()
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err = noSymlinkBetween(dest, target); err != nil {
+				return errors.Wrapf(err, "tar entry %q", hdr.Name)
+			}
+			if err = os.MkdirAll(target, mode|0700); err != nil {
+				return errors.WithStack(err)
+			}
+		case tar.TypeReg:
+			if err = os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return errors.WithStack(err)
+			}
+			if err = writeFile(target, tr, mode); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if filepath.IsAbs(hdr.Linkname) || !within(filepath.Join(filepath.Dir(target), hdr.Linkname)) {
+				return errors.Errorf("tar symlink %q points outside the target dir", hdr.Name)
+			}
+			if err = os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return errors.WithStack(err)
+			}
+			if err = os.Symlink(hdr.Linkname, target); err != nil {
+				return errors.WithStack(err)
+			}
+		default:
+			return errors.Errorf("unsupported tar entry %q of type %c", hdr.Name, hdr.Typeflag)
+		}
+	}
+}
+
+// noSymlinkBetween fails when a path component below dest, up to and
+// including p, is a symlink.
+func noSymlinkBetween(dest, p string) error {
+	rel, err := filepath.Rel(dest, p)
+	if err != nil || rel == "." {
+		return errors.WithStack(err)
+	}
+	cur := dest
+	for _, name := range strings.Split(rel, string(filepath.Separator)) {
+		cur = filepath.Join(cur, name)
+		fi, err := os.Lstat(cur)
+		if os.IsNotExist(err) {
+			// nothing deeper exists either
+			return nil
+		}
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return errors.Errorf("%s is a symlink", cur)
+		}
+	}
+	return nil
+}
+
+// writeFile does not follow a symlink at path.
+func writeFile(path string, r io.Reader, mode os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY|syscall.O_NOFOLLOW, mode)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if _, err = io.Copy(f, r); err != nil {
+		f.Close()
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(f.Close())
+}
+
+func chownTree(root string, uid, gid int) error {
+	return filepath.Walk(root, func(path string, _ os.FileInfo, err error) error {
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		return errors.WithStack(os.Lchown(path, uid, gid))
+	})
+}
@@ -0,0 +1,196 @@
+package controllers
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func tarball(t *testing.T, gz bool, entries map[string]string) []byte {
+	t.Helper()
+	var (
+		buf bytes.Buffer
+		zw  *gzip.Writer
+	)
+	tw := tar.NewWriter(&buf)
+	if gz {
+		zw = gzip.NewWriter(&buf)
+		tw = tar.NewWriter(zw)
+	}
+	for name, content := range entries {
+		hdr := &tar.Header{Name: name, Mode: 0640, Size: int64(len(content)), Typeflag: tar.TypeReg}
+		if strings.HasSuffix(name, "/") {
+			hdr = &tar.Header{Name: name, Mode: 0750, Typeflag: tar.TypeDir}
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func TestExtractTar(t *testing.T) {
+	for _, gz := range []bool{false, true} {
+		dest := t.TempDir()
+		data := tarball(t, gz, map[string]string{"conf/": "", "conf/app.json": "{}"})
+		if err := extractTar(bytes.NewReader(data), dest); err != nil {
+			t.Fatalf("gzip %v: %v", gz, err)
+		}
+		fi, err := os.Stat(filepath.Join(dest, "conf/app.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode().Perm() != 0640 {
+			t.Errorf("mode = %v, want 0640", fi.Mode().Perm())
+		}
+	}
+
+	data := tarball(t, false, map[string]string{"../escape": "x"})
+	if err := extractTar(bytes.NewReader(data), t.TempDir()); err == nil {
+		t.Fatal("entry escaping the target dir should be rejected")
+	}
+}
+
+func TestExtractTarSymlinkChain(t *testing.T) {
+	entries := []tar.Header{
+		{Name: "d/", Typeflag: tar.TypeDir, Mode: 0755},
+		// each link points inside dest by itself
+		{Name: "d/s", Typeflag: tar.TypeSymlink, Linkname: ".."},
+		{Name: "d/s/t", Typeflag: tar.TypeSymlink, Linkname: ".."},
+		{Name: "d/s/t/x", Typeflag: tar.TypeReg, Mode: 0644, Size: 1},
+	}
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for i := range entries {
+		if err := tw.WriteHeader(&entries[i]); err != nil {
+			t.Fatal(err)
+		}
+		if entries[i].Size > 0 {
+			tw.Write([]byte("x"))
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	root := t.TempDir()
+	dest := filepath.Join(root, "dest")
+	if err := extractTar(bytes.NewReader(buf.Bytes()), dest); err == nil {
+		t.Fatal("entry below a chain of symlinks should be rejected")
+	}
+	if _, err := os.Lstat(filepath.Join(root, "x")); !os.IsNotExist(err) {
+		t.Fatalf("file written outside the target dir, %v", err)
+	}
+
+	// a symlink already at the path of a file is not followed
+	outside := filepath.Join(root, "outside")
+	if err := os.WriteFile(outside, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(dest, "f")); err != nil {
+		t.Fatal(err)
+	}
+	data := tarball(t, false, map[string]string{"f": "x"})
+	if err := extractTar(bytes.NewReader(data), dest); err == nil {
+		t.Fatal("file written through an existing symlink")
+	}
+	if b, _ := os.ReadFile(outside); len(b) != 0 {
+		t.Fatalf("outside file changed to %q", b)
+	}
+}
+
+func TestSeedDir(t *testing.T) {
+	root := t.TempDir()
+	uid, gid := os.Getuid(), os.Getgid()
+
+	tarPath := filepath.Join(root, "launcher.tar.gz")
+	if err := os.WriteFile(tarPath, tarball(t, true, map[string]string{"config.yaml": "a: 1"}), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	layer := tarball(t, false, map[string]string{"oci.txt": "from registry"})
+	sum := sha256.Sum256(layer)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/olares/template/manifests/v1":
+			w.Header().Set("Content-Type", mediaTypeOCIManifest)
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{
+				"layers": []map[string]string{{"mediaType": "application/vnd.oci.image.layer.v1.tar", "digest": digest}},
+			})
+		case "/v2/olares/template/blobs/" + digest:
+			_, _ = w.Write(layer)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer registry.Close()
+
+	reader := fake.NewClientBuilder().WithObjects(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "os-system", Name: "tpl"},
+		Data:       map[string]string{"settings.json": "{}"},
+	}).Build()
+
+	tests := []struct {
+		name     string
+		template TemplateSource
+		file     string
+	}{
+		{"tarball", TemplateSource{HostTarball: tarPath}, "config.yaml"},
+		{"configmap", TemplateSource{ConfigMap: "os-system/tpl"}, "settings.json"},
+		{"oci", TemplateSource{OCI: strings.TrimPrefix(registry.URL, "http://") + "/olares/template:v1", PlainHTTP: true}, "oci.txt"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			template := tt.template
+			dir := DataDir{Path: filepath.Join(root, tt.name, "launcher"), Uid: uid, Gid: gid, Template: &template}
+			if err := seedDir(context.Background(), reader, dir); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := os.Stat(filepath.Join(dir.Path, tt.file)); err != nil {
+				t.Fatal(err)
+			}
+			leftovers, _ := filepath.Glob(filepath.Join(root, tt.name, ".launcher.seed-*"))
+			if len(leftovers) > 0 {
+				t.Fatalf("seed dirs left behind: %v", leftovers)
+			}
+		})
+	}
+}
+
+func TestSeedDirFailureLeavesNoDir(t *testing.T) {
+	root := t.TempDir()
+	dir := DataDir{Path: filepath.Join(root, "launcher"), Uid: os.Getuid(), Gid: os.Getgid(),
+		Template: &TemplateSource{HostTarball: filepath.Join(root, "missing.tar")}}
+	if err := seedDir(context.Background(), nil, dir); err == nil {
+		t.Fatal("want an error for a missing tarball")
+	}
+	if _, err := os.Stat(dir.Path); !os.IsNotExist(err) {
+		t.Fatalf("dir should not exist after a failed seed, %v", err)
+	}
+}
@@ -2,51 +2,46 @@ package controllers
 
 import (
 	"bytes"
-	"crypto/aes"
-	"crypto/cipher"
-	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"os"
-	"strconv"
+	"path/filepath"
 	"strings"
-	"time"
+
+	"bytetrade.io/web3os/osnode-init/pkg/nonce"
+	"k8s.io/utils/clock"
 )
 
-func GenTerminusNonce() (string, error) {
-	randomKey := os.Getenv("APP_RANDOM_KEY")
-	timestamp := getTimestamp()
-	cipherText, err := AesEncrypt([]byte(timestamp), []byte(randomKey))
+var terminusNonce *nonce.Generator
+
+// SetupTerminusNonce validates $APP_RANDOM_KEY and prepares the nonce
+// generator. The legacy "appservice:" format is sent until the services
+// are migrated, set TERMINUS_NONCE_VERSION=2 to send the new one. Nonces
+// are stamped with the time of clk.
+func SetupTerminusNonce(clk clock.PassiveClock) error {
+	key, err := nonce.KeyFromEnv()
 	if err != nil {
-		return "", err
+		return err
 	}
-	b64CipherText := base64.StdEncoding.EncodeToString(cipherText)
-	terminusNonce := "appservice:" + b64CipherText
-	return terminusNonce, nil
-}
-
-func getTimestamp() string {
-	t := time.Now().Unix()
-	return strconv.Itoa(int(t))
-}
 
-func AesEncrypt(origin, key []byte) ([]byte, error) {
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return nil, err
+	version := nonce.Version1
+	switch v := os.Getenv("TERMINUS_NONCE_VERSION"); v {
+	case "", "1":
+	case "2":
+		version = nonce.Version2
+	default:
+		return fmt.Errorf("TERMINUS_NONCE_VERSION must be 1 or 2, got %q", v)
 	}
-	blockSize := block.BlockSize()
-	origin = PKCS7Padding(origin, blockSize)
-	blockMode := cipher.NewCBCEncrypter(block, key[:blockSize])
-	crypted := make([]byte, len(origin))
-	blockMode.CryptBlocks(crypted, origin)
-	return crypted, nil
+	terminusNonce, err = nonce.NewGenerator(key, nonce.WithVersion(version), nonce.WithClock(clk.Now))
+	return err
 }
 
-func PKCS7Padding(ciphertext []byte, blockSize int) []byte {
-	padding := blockSize - len(ciphertext)%blockSize
-	padtext := bytes.Repeat([]byte{byte(padding)}, padding)
-	return append(ciphertext, padtext...)
+func GenTerminusNonce() (string, error) {
+	if terminusNonce == nil {
+		return "", errors.New("terminus nonce is not configured")
+	}
+	return terminusNonce.Generate()
 }
 
 func ToJSON(v any) string {
@@ -57,8 +52,11 @@ func ToJSON(v any) string {
 	return buf.String()
 }
 
+// redisConfPath is the config of the redis juicefs keeps its metadata in.
+var redisConfPath = localPath(filepath.Join(HostRoot, "data/redis/etc/redis.conf"))
+
 func getRedisIpAndPassword() (ip string, pwd string, err error) {
-	file, err := os.ReadFile("/olares/data/redis/etc/redis.conf")
+	file, err := os.ReadFile(redisConfPath)
 	if err != nil {
 		return
 	}
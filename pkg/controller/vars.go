@@ -17,4 +17,8 @@ var (
 		"mdbdata":        {1001, 1001},
 		"mdbdata-config": {1001, 1001},
 	}
+
+	// DirTemplates seeds the sub dirs above when they are created, keyed by
+	// sub dir name. See LoadDirTemplates.
+	DirTemplates = map[string]*TemplateSource{}
 )
@@ -0,0 +1,122 @@
+// Package hostpath translates paths on the host into the paths they are
+// mounted at in the pod, so the host can be mounted anywhere, e.g. its
+// root at /host.
+package hostpath
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Mount is a host dir and where it is mounted in the pod.
+type Mount struct {
+	Host  string
+	Local string
+}
+
+// Mapper translates host paths by their longest mounted prefix. The zero
+// Mapper leaves every path as it is, as when the host dirs are mounted at
+// the same paths.
+type Mapper struct {
+	mounts []Mount
+}
+
+// Parse reads mounts written as "HOST=LOCAL", e.g. "/=/host" or
+// "/olares=/data/olares". Both sides must be absolute.
+func Parse(specs []string) (*Mapper, error) {
+	var mounts []Mount
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		parts := strings.SplitN(spec, "=", 2)
+		if len(parts) != 2 || !filepath.IsAbs(parts[0]) || !filepath.IsAbs(parts[1]) {
+			return nil, errors.Errorf("host mount %q is not HOST=LOCAL with absolute paths", spec)
+		}
+		mounts = append(mounts, Mount{Host: filepath.Clean(parts[0]), Local: filepath.Clean(parts[1])})
+	}
+	return New(mounts...), nil
+}
+
+// New returns a Mapper of mounts.
+func New(mounts ...Mount) *Mapper {
+	m := &Mapper{mounts: append([]Mount(nil), mounts...)}
+	// the longest, most specific prefix first
+	sort.SliceStable(m.mounts, func(i, j int) bool { return len(m.mounts[i].Host) > len(m.mounts[j].Host) })
+	return m
+}
+
+// Local returns where the host path p is in the pod. Paths outside of
+// every mount, and relative paths, are returned cleaned but unchanged.
+func (m *Mapper) Local(p string) string {
+	if p == "" || !filepath.IsAbs(p) {
+		return p
+	}
+	p = filepath.Clean(p)
+	if m == nil {
+		return p
+	}
+	for _, mount := range m.mounts {
+		if rel, ok := under(p, mount.Host); ok {
+			return filepath.Join(mount.Local, rel)
+		}
+	}
+	return p
+}
+
+// MountOf returns the mount the host path p is under.
+func (m *Mapper) MountOf(p string) (Mount, bool) {
+	if m == nil || !filepath.IsAbs(p) {
+		return Mount{}, false
+	}
+	p = filepath.Clean(p)
+	for _, mount := range m.mounts {
+		if _, ok := under(p, mount.Host); ok {
+			return mount, true
+		}
+	}
+	return Mount{}, false
+}
+
+// Host is the reverse of Local.
+func (m *Mapper) Host(p string) string {
+	if p == "" || !filepath.IsAbs(p) {
+		return p
+	}
+	p = filepath.Clean(p)
+	if m == nil {
+		return p
+	}
+	for _, mount := range m.mounts {
+		if rel, ok := under(p, mount.Local); ok {
+			return filepath.Join(mount.Host, rel)
+		}
+	}
+	return p
+}
+
+// Mounts lists the mounts, the most specific first.
+func (m *Mapper) Mounts() []Mount {
+	if m == nil {
+		return nil
+	}
+	return append([]Mount(nil), m.mounts...)
+}
+
+// under returns p relative to dir, when p is dir or inside it.
+func under(p, dir string) (string, bool) {
+	if p == dir {
+		return ".", true
+	}
+	if dir == "/" {
+		return strings.TrimPrefix(p, "/"), true
+	}
+	if strings.HasPrefix(p, dir+"/") {
+		return p[len(dir)+1:], true
+	}
+	return "", false
+}
@@ -0,0 +1,38 @@
+package hostpath
+
+import "testing"
+
+func TestMapper(t *testing.T) {
+	m, err := Parse([]string{"/=/host", "/olares=/data/olares", " "})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct{ host, local string }{
+		{"/olares/userdata/alice", "/data/olares/userdata/alice"},
+		{"/olares", "/data/olares"},
+		{"/olaresx/a", "/host/olaresx/a"},
+		{"/usr/local/bin/juicefs", "/host/usr/local/bin/juicefs"},
+		{"/", "/host"},
+	} {
+		if got := m.Local(tc.host); got != tc.local {
+			t.Errorf("Local(%q) = %q, want %q", tc.host, got, tc.local)
+		}
+		if got := m.Host(tc.local); got != tc.host {
+			t.Errorf("Host(%q) = %q, want %q", tc.local, got, tc.host)
+		}
+	}
+
+	var identity *Mapper
+	if got := identity.Local("/olares/a/../b"); got != "/olares/b" {
+		t.Errorf("nil mapper changed the path to %q", got)
+	}
+	if got := m.Local("juicefs"); got != "juicefs" {
+		t.Errorf("relative path changed to %q", got)
+	}
+
+	for _, spec := range []string{"/olares", "olares=/data", "/olares=data"} {
+		if _, err := Parse([]string{spec}); err == nil {
+			t.Errorf("Parse(%q) should fail", spec)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package juicefs
+
+import (
+	"context"
+	"net/url"
+	"os/exec"
+
+	"github.com/pkg/errors"
+)
+
+// Capabilities are the flags of "juicefs config" a client version has.
+type Capabilities struct {
+	// SessionToken is --session-token, for temporary credentials.
+	SessionToken bool `json:"sessionToken"`
+	// Yes is --yes, which answers the prompts so nothing waits on stdin.
+	Yes bool `json:"yes"`
+}
+
+// CapabilitiesOf returns what version v supports.
+func CapabilitiesOf(v Version) Capabilities {
+	return Capabilities{
+		SessionToken: !v.Less(Version{Major: 1, Minor: 0, Patch: 0}),
+		Yes:          !v.Less(Version{Major: 1, Minor: 1, Patch: 0}),
+	}
+}
+
+// Credentials are the object storage keys of a volume.
+type Credentials struct {
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+}
+
+// ErrNotSupported is a flag the client version does not have.
+var ErrNotSupported = errors.New("not supported by this juicefs version")
+
+// ConfigArgs returns the arguments of "juicefs config" that set creds on
+// the volume whose metadata is at metaURL, for a client with caps.
+func ConfigArgs(metaURL string, creds Credentials, caps Capabilities) ([]string, error) {
+	args := []string{"config", metaURL, "--access-key", creds.AccessKey, "--secret-key", creds.SecretKey}
+	if creds.SessionToken != "" {
+		if !caps.SessionToken {
+			return nil, errors.Wrap(ErrNotSupported, "--session-token")
+		}
+		args = append(args, "--session-token", creds.SessionToken)
+	}
+	if caps.Yes {
+		args = append(args, "--yes")
+	}
+	return args, nil
+}
+
+// Config sets creds on the volume whose metadata is at metaURL. A failure
+// is a *CommandError.
+func (b *Binary) Config(ctx context.Context, metaURL string, creds Credentials) error {
+	args, err := ConfigArgs(metaURL, creds, b.Capabilities)
+	if err != nil {
+		return errors.Wrapf(err, "juicefs %s", b.Version)
+	}
+	out, err := exec.CommandContext(ctx, b.Path, args...).CombinedOutput()
+	if err != nil {
+		return newCommandError(ctx, "config", out, err,
+			metaPassword(metaURL), creds.AccessKey, creds.SecretKey, creds.SessionToken)
+	}
+	return nil
+}
+
+func metaPassword(metaURL string) string {
+	u, err := url.Parse(metaURL)
+	if err != nil || u.User == nil {
+		return ""
+	}
+	password, _ := u.User.Password()
+	return password
+}
@@ -0,0 +1,69 @@
+package juicefs
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestConfigArgs(t *testing.T) {
+	creds := Credentials{AccessKey: "ak", SecretKey: "sk", SessionToken: "st"}
+	args, err := ConfigArgs("redis://:pw@10.0.0.1:6379/1", creds, CapabilitiesOf(Version{1, 0, 4}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"config", "redis://:pw@10.0.0.1:6379/1", "--access-key", "ak", "--secret-key", "sk", "--session-token", "st"}
+	if !reflect.DeepEqual(args, want) {
+		t.Fatalf("args = %v", args)
+	}
+	if args, _ = ConfigArgs("m", creds, CapabilitiesOf(Version{1, 1, 0})); args[len(args)-1] != "--yes" {
+		t.Fatalf("args of 1.1.0 = %v", args)
+	}
+	if _, err = ConfigArgs("m", creds, Capabilities{}); !errors.Is(err, ErrNotSupported) {
+		t.Fatalf("err = %v", err)
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+	dir := t.TempDir()
+	bin := &Binary{Path: filepath.Join(dir, "juicefs"), Version: Version{1, 1, 0}, Capabilities: CapabilitiesOf(Version{1, 1, 0})}
+	creds := Credentials{AccessKey: "ak", SecretKey: "secret-key", SessionToken: "session-token"}
+
+	for _, tc := range []struct {
+		output string
+		code   int
+		cause  error
+	}{
+		{"<FATAL>: load setting: NOAUTH Authentication required.", 1, ErrMetaAuth},
+		{"<FATAL>: dial tcp 10.0.0.1:6379: connect: connection refused", 1, ErrUnreachable},
+		{"<FATAL>: database is not formatted, please run `juicefs format ...` first", 1, ErrNotFormatted},
+		{"<FATAL>: Storage s3://b is not configured correctly: InvalidAccessKeyId, key secret-key", 1, ErrStorageAuth},
+		{"flag provided but not defined: -yes", 1, ErrUsage},
+		{"panic: something else", 2, ErrCommandFailed},
+	} {
+		script := "#!/bin/sh\necho '" + tc.output + "' >&2\nexit " + string(rune('0'+tc.code)) + "\n"
+		if err := os.WriteFile(bin.Path, []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+		err := bin.Config(context.Background(), "redis://:pw@10.0.0.1:6379/1", creds)
+		var cmdErr *CommandError
+		if !errors.Is(err, tc.cause) || !errors.As(err, &cmdErr) || cmdErr.ExitCode != tc.code {
+			t.Errorf("%q: err = %v", tc.output, err)
+			continue
+		}
+		if strings.Contains(err.Error(), "secret-key") {
+			t.Errorf("secret in %v", err)
+		}
+	}
+
+	if err := os.WriteFile(bin.Path, []byte("#!/bin/sh\nexit 0\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := bin.Config(context.Background(), "redis://:pw@10.0.0.1:6379/1", creds); err != nil {
+		t.Fatal(err)
+	}
+}
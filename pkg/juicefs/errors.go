@@ -0,0 +1,96 @@
+package juicefs
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// The causes a CommandError matches, read from the output of juicefs.
+var (
+	ErrUsage         = errors.New("juicefs rejected the command line")
+	ErrMetaAuth      = errors.New("the juicefs metadata engine rejected the password")
+	ErrNotFormatted  = errors.New("the juicefs volume is not formatted")
+	ErrStorageAuth   = errors.New("the object storage rejected the credentials")
+	ErrUnreachable   = errors.New("juicefs cannot reach the metadata engine or object storage")
+	ErrCommandFailed = errors.New("juicefs command failed")
+)
+
+// outputPatterns map what juicefs prints to a cause, the first match wins.
+var outputPatterns = []struct {
+	cause    error
+	patterns []string
+}{
+	{ErrUsage, []string{"flag provided but not defined", "incorrect usage", "unknown flag"}},
+	{ErrMetaAuth, []string{"noauth", "wrongpass", "invalid password", "invalid username-password"}},
+	{ErrNotFormatted, []string{"not formatted"}},
+	{ErrStorageAuth, []string{"invalidaccesskeyid", "signaturedoesnotmatch", "expiredtoken",
+		"invalidtoken", "accessdenied", "access denied"}},
+	{ErrUnreachable, []string{"connection refused", "i/o timeout", "no route to host", "no such host"}},
+}
+
+// CommandError is a juicefs command that did not succeed.
+type CommandError struct {
+	Command string
+	// ExitCode is -1 when juicefs did not exit by itself, e.g. it was
+	// killed or could not start.
+	ExitCode int
+	// Output is what juicefs printed, with the secrets it was passed
+	// redacted.
+	Output string
+	// Cause is one of the errors above, or the error of the context.
+	Cause error
+}
+
+func (e *CommandError) Error() string {
+	msg := fmt.Sprintf("juicefs %s exited with %d, %v", e.Command, e.ExitCode, e.Cause)
+	if line := lastLine(e.Output); line != "" {
+		msg += ": " + line
+	}
+	return msg
+}
+
+func (e *CommandError) Unwrap() error { return e.Cause }
+
+func newCommandError(ctx context.Context, command string, out []byte, err error, secrets ...string) error {
+	e := &CommandError{Command: command, ExitCode: -1, Output: redact(string(out), secrets), Cause: ErrCommandFailed}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		e.ExitCode = exitErr.ExitCode()
+	}
+	if ctx.Err() != nil {
+		e.Cause = ctx.Err()
+		return errors.WithStack(e)
+	}
+	if e.ExitCode == -1 && e.Output == "" {
+		e.Output = err.Error()
+	}
+	lower := strings.ToLower(e.Output)
+	for _, p := range outputPatterns {
+		for _, pattern := range p.patterns {
+			if strings.Contains(lower, pattern) {
+				e.Cause = p.cause
+				return errors.WithStack(e)
+			}
+		}
+	}
+	return errors.WithStack(e)
+}
+
+func redact(out string, secrets []string) string {
+	for _, secret := range secrets {
+		if secret != "" {
+			out = strings.ReplaceAll(out, secret, "****")
+		}
+	}
+	return out
+}
+
+// lastLine is where juicefs prints the fatal error.
+func lastLine(out string) string {
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
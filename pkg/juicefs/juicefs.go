@@ -0,0 +1,171 @@
+// Package juicefs finds the juicefs client on the node and runs it with the
+// flags its version supports.
+package juicefs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// versionTimeout bounds running "juicefs --version".
+const versionTimeout = 10 * time.Second
+
+// Version is a juicefs client version.
+type Version struct {
+	Major int
+	Minor int
+	Patch int
+}
+
+// The supported clients are at least MinVersion and older than MaxVersion,
+// as another major version may change the flags.
+var (
+	MinVersion = Version{Major: 1, Minor: 0, Patch: 0}
+	MaxVersion = Version{Major: 2, Minor: 0, Patch: 0}
+)
+
+// ErrUnsupportedVersion is matched by an UnsupportedVersionError.
+var ErrUnsupportedVersion = errors.New("unsupported juicefs version")
+
+// UnsupportedVersionError is a client outside of the supported versions.
+type UnsupportedVersionError struct {
+	Path    string
+	Version Version
+}
+
+func (e *UnsupportedVersionError) Error() string {
+	return fmt.Sprintf("juicefs %s at %s is unsupported, it must be at least %s and older than %s",
+		e.Version, e.Path, MinVersion, MaxVersion)
+}
+
+func (e *UnsupportedVersionError) Is(target error) bool { return target == ErrUnsupportedVersion }
+
+var versionPattern = regexp.MustCompile(`version (\d+)\.(\d+)\.(\d+)`)
+
+// ParseVersion reads the output of "juicefs --version", e.g.
+// "juicefs version 1.1.0+2023-09-04.08c4ae6".
+func ParseVersion(out string) (Version, error) {
+	m := versionPattern.FindStringSubmatch(out)
+	if m == nil {
+		return Version{}, errors.Errorf("no version in %q", strings.TrimSpace(out))
+	}
+	var v Version
+	v.Major, _ = strconv.Atoi(m[1])
+	v.Minor, _ = strconv.Atoi(m[2])
+	v.Patch, _ = strconv.Atoi(m[3])
+	return v, nil
+}
+
+func (v Version) String() string {
+	return fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+}
+
+// MarshalText writes v as "1.1.0".
+func (v Version) MarshalText() ([]byte, error) {
+	return []byte(v.String()), nil
+}
+
+// Less reports whether v is older than o.
+func (v Version) Less(o Version) bool {
+	if v.Major != o.Major {
+		return v.Major < o.Major
+	}
+	if v.Minor != o.Minor {
+		return v.Minor < o.Minor
+	}
+	return v.Patch < o.Patch
+}
+
+// Binary is a juicefs client found on the node.
+type Binary struct {
+	Path         string       `json:"path"`
+	Version      Version      `json:"version"`
+	Capabilities Capabilities `json:"capabilities"`
+}
+
+// Find returns the first candidate that is an executable file of a
+// supported version. Candidates without a slash are looked up in $PATH.
+// The error lists why each candidate was passed over and matches
+// ErrUnsupportedVersion when a client was only passed over for its version.
+func Find(ctx context.Context, candidates []string) (*Binary, error) {
+	var notFound findError
+	for _, candidate := range candidates {
+		path, err := lookPath(candidate)
+		if err != nil {
+			notFound.rejected = append(notFound.rejected, err.Error())
+			continue
+		}
+		version, err := versionOf(ctx, path)
+		if err != nil {
+			notFound.rejected = append(notFound.rejected, fmt.Sprintf("%s: %v", path, err))
+			continue
+		}
+		if version.Less(MinVersion) || !version.Less(MaxVersion) {
+			e := &UnsupportedVersionError{Path: path, Version: version}
+			notFound.rejected = append(notFound.rejected, e.Error())
+			if notFound.unsupported == nil {
+				notFound.unsupported = e
+			}
+			continue
+		}
+		return &Binary{Path: path, Version: version, Capabilities: CapabilitiesOf(version)}, nil
+	}
+	if len(notFound.rejected) == 0 {
+		return nil, errors.New("no juicefs search paths")
+	}
+	return nil, errors.WithStack(&notFound)
+}
+
+type findError struct {
+	rejected    []string
+	unsupported *UnsupportedVersionError
+}
+
+func (e *findError) Error() string {
+	return "no usable juicefs client, " + strings.Join(e.rejected, "; ")
+}
+
+func (e *findError) Unwrap() error {
+	if e.unsupported == nil {
+		return nil
+	}
+	return e.unsupported
+}
+func lookPath(candidate string) (string, error) {
+	if !strings.Contains(candidate, "/") {
+		path, err := exec.LookPath(candidate)
+		if err != nil {
+			return "", errors.Errorf("%s: not in $PATH", candidate)
+		}
+		return path, nil
+	}
+	fi, err := os.Stat(candidate)
+	if os.IsNotExist(err) {
+		return "", errors.Errorf("%s: not found", candidate)
+	}
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	if !fi.Mode().IsRegular() || fi.Mode().Perm()&0111 == 0 {
+		return "", errors.Errorf("%s: not an executable file", candidate)
+	}
+	return candidate, nil
+}
+
+func versionOf(ctx context.Context, path string) (Version, error) {
+	ctx, cancel := context.WithTimeout(ctx, versionTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, path, "--version").CombinedOutput()
+	if err != nil {
+		return Version{}, errors.Errorf("--version failed, %v", err)
+	}
+	return ParseVersion(string(out))
+}
@@ -0,0 +1,64 @@
+package juicefs
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func fakeClient(t *testing.T, dir, name, version string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	script := "#!/bin/sh\necho \"juicefs version " + version + "+2023-09-04.08c4ae6\"\n"
+	if err := os.WriteFile(path, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestFind(t *testing.T) {
+	dir := t.TempDir()
+	old := fakeClient(t, dir, "old", "0.17.5")
+	current := fakeClient(t, dir, "current", "1.1.0")
+	next := fakeClient(t, dir, "next", "2.0.1")
+	notExec := filepath.Join(dir, "data")
+	if err := os.WriteFile(notExec, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	bin, err := Find(context.Background(),
+		[]string{filepath.Join(dir, "missing"), notExec, old, next, current})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bin.Path != current || bin.Version != (Version{1, 1, 0}) || !bin.Capabilities.Yes {
+		t.Fatalf("found %+v", bin)
+	}
+
+	_, err = Find(context.Background(), []string{filepath.Join(dir, "missing"), old, next})
+	var unsupported *UnsupportedVersionError
+	if !errors.Is(err, ErrUnsupportedVersion) || !errors.As(err, &unsupported) || unsupported.Path != old ||
+		!strings.Contains(err.Error(), "not found") || !strings.Contains(err.Error(), "2.0.1") {
+		t.Fatalf("err = %v", err)
+	}
+
+	_, err = Find(context.Background(), []string{filepath.Join(dir, "missing")})
+	if err == nil || errors.Is(err, ErrUnsupportedVersion) {
+		t.Fatalf("err = %v", err)
+	}
+}
+
+func TestParseVersion(t *testing.T) {
+	if v, err := ParseVersion("juicefs version 1.0.4+2023-04-06.f1c475d\n"); err != nil || v != (Version{1, 0, 4}) {
+		t.Fatalf("parsed %v, %v", v, err)
+	}
+	if _, err := ParseVersion("juicefs: command not found"); err == nil {
+		t.Fatal("want an error")
+	}
+	if !(Version{0, 17, 5}).Less(Version{1, 0, 0}) || (Version{1, 1, 0}).Less(Version{1, 0, 9}) {
+		t.Fatal("Less is wrong")
+	}
+}
@@ -0,0 +1,30 @@
+package log
+
+import (
+	"context"
+
+	"go.uber.org/zap"
+)
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying l.
+func NewContext(ctx context.Context, l *zap.SugaredLogger) context.Context {
+	return context.WithValue(ctx, contextKey{}, l)
+}
+
+// FromContext returns the logger carried by ctx, or the global one.
+func FromContext(ctx context.Context) *zap.SugaredLogger {
+	if ctx != nil {
+		if l, ok := ctx.Value(contextKey{}).(*zap.SugaredLogger); ok {
+			return l
+		}
+	}
+	return plain
+}
+
+// WithValues returns a copy of ctx whose logger has the extra key value
+// pairs, e.g. the namespace or the reconcile id being worked on.
+func WithValues(ctx context.Context, args ...any) context.Context {
+	return NewContext(ctx, FromContext(ctx).With(args...))
+}
@@ -0,0 +1,219 @@
+package log
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Components with their own log level. A logger belongs to the component of
+// the last segment of its name, as set by Named, that has a level, so
+// "controller.cloud" logs at the cloud level and "cloud.client" too.
+const (
+	ComponentController = "controller"
+	ComponentCloud      = "cloud"
+	ComponentFilesystem = "filesystem"
+)
+
+// levels holds the global level and the per component overrides.
+type levels struct {
+	global zap.AtomicLevel
+	// configured is the level set at startup, restored by ToggleDebug.
+	configured zapcore.Level
+
+	mu         sync.RWMutex
+	components map[string]zapcore.Level
+}
+
+var lv = &levels{global: zap.NewAtomicLevel(), components: map[string]zapcore.Level{}}
+
+func (l *levels) levelFor(loggerName string) zapcore.LevelEnabler {
+	if loggerName == "" {
+		return l.global
+	}
+	segments := strings.Split(loggerName, ".")
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for i := len(segments) - 1; i >= 0; i-- {
+		if level, ok := l.components[segments[i]]; ok {
+			return level
+		}
+	}
+	return l.global
+}
+
+// Enabled is true if the global level or any component enables level.
+func (l *levels) Enabled(level zapcore.Level) bool {
+	if l.global.Enabled(level) {
+		return true
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for _, c := range l.components {
+		if c.Enabled(level) {
+			return true
+		}
+	}
+	return false
+}
+
+// levelCore filters entries by the level of the component that logs them.
+type levelCore struct {
+	zapcore.Core
+	levels *levels
+}
+
+func (c *levelCore) Enabled(level zapcore.Level) bool {
+	return c.levels.Enabled(level)
+}
+
+func (c *levelCore) With(fields []zapcore.Field) zapcore.Core {
+	return &levelCore{Core: c.Core.With(fields), levels: c.levels}
+}
+
+func (c *levelCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if !c.levels.levelFor(ent.LoggerName).Enabled(ent.Level) {
+		return ce
+	}
+	return c.Core.Check(ent, ce)
+}
+
+// SetLevel changes the global level at runtime.
+func SetLevel(level string) error {
+	l, err := parseLevel(level)
+	if err != nil {
+		return err
+	}
+	lv.global.SetLevel(l)
+	return nil
+}
+
+// SetComponentLevel overrides the level of component, an empty level drops
+// the override so the component follows the global level again.
+func SetComponentLevel(component, level string) error {
+	lv.mu.Lock()
+	defer lv.mu.Unlock()
+
+	if level == "" {
+		delete(lv.components, component)
+		return nil
+	}
+	l, err := parseLevel(level)
+	if err != nil {
+		return err
+	}
+	lv.components[component] = l
+	return nil
+}
+
+// SetComponentLevels parses "cloud=debug,filesystem=warn".
+func SetComponentLevels(spec string) error {
+	for _, pair := range strings.Split(spec, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("invalid component level %q, want component=level", pair)
+		}
+		if err := SetComponentLevel(kv[0], kv[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ToggleDebug switches the global level between debug and the level
+// configured at startup.
+func ToggleDebug() zapcore.Level {
+	if lv.global.Level() == zapcore.DebugLevel && lv.configured != zapcore.DebugLevel {
+		lv.global.SetLevel(lv.configured)
+	} else {
+		lv.global.SetLevel(zapcore.DebugLevel)
+	}
+	return lv.global.Level()
+}
+
+// HandleSignals toggles debug logging on SIGUSR1 until ctx is done.
+func HandleSignals(ctx context.Context) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR1)
+
+	go func() {
+		defer signal.Stop(ch)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ch:
+				Infof("SIGUSR1 received, log level is %s now", ToggleDebug())
+			}
+		}
+	}()
+}
+
+type levelPayload struct {
+	Level      string            `json:"level"`
+	Components map[string]string `json:"components,omitempty"`
+}
+
+// LevelHandler serves the current levels on GET, and changes them on PUT
+// with ?level=debug, optionally scoped with &component=cloud.
+func LevelHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut, http.MethodPost:
+			q := r.URL.Query()
+			var err error
+			if component := q.Get("component"); component != "" {
+				err = SetComponentLevel(component, q.Get("level"))
+			} else {
+				err = SetLevel(q.Get("level"))
+			}
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				_ = json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+				return
+			}
+			Infow("log level changed", "query", r.URL.RawQuery)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		payload := levelPayload{Level: lv.global.Level().String(), Components: map[string]string{}}
+		lv.mu.RLock()
+		names := make([]string, 0, len(lv.components))
+		for name := range lv.components {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			payload.Components[name] = lv.components[name].String()
+		}
+		lv.mu.RUnlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(payload)
+	})
+}
+
+func parseLevel(level string) (zapcore.Level, error) {
+	var l zapcore.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return l, fmt.Errorf("invalid log level %q", level)
+	}
+	return l, nil
+}
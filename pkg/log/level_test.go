@@ -0,0 +1,54 @@
+package log
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap/zapcore"
+)
+
+func TestComponentLevels(t *testing.T) {
+	var buf bytes.Buffer
+	Init(Options{Level: "info", Format: FormatJSON, Writers: []zapcore.WriteSyncer{zapcore.AddSync(&buf)}})
+	defer func() {
+		_ = SetComponentLevel(ComponentCloud, "")
+		_ = SetComponentLevel(ComponentController, "")
+	}()
+
+	cloud := GetLogger().Named(ComponentCloud)
+	fs := GetLogger().Named(ComponentFilesystem)
+
+	cloud.Debug("cloud-hidden")
+	if err := SetComponentLevel(ComponentCloud, "debug"); err != nil {
+		t.Fatal(err)
+	}
+	cloud.Named("client").Debug("cloud-shown")
+	fs.Debug("fs-hidden")
+
+	// the controller names its loggers after the controller first
+	if err := SetComponentLevel(ComponentController, "error"); err != nil {
+		t.Fatal(err)
+	}
+	controller := GetLogger().Named(ComponentController)
+	controller.Named(ComponentCloud).Debug("nested-cloud-shown")
+	controller.Named(ComponentFilesystem).Info("nested-fs-hidden")
+	Debug("global-hidden")
+
+	ToggleDebug()
+	Debug("global-shown")
+	ToggleDebug()
+	Debug("global-hidden-again")
+
+	out := buf.String()
+	for _, msg := range []string{"cloud-shown", "nested-cloud-shown", "global-shown"} {
+		if !strings.Contains(out, msg) {
+			t.Errorf("%q is missing", msg)
+		}
+	}
+	for _, msg := range []string{"cloud-hidden", "fs-hidden", "nested-fs-hidden", "global-hidden"} {
+		if strings.Contains(out, `"`+msg+`"`) {
+			t.Errorf("%q should be filtered", msg)
+		}
+	}
+}
@@ -3,11 +3,22 @@ package log
 import (
 	"os"
 
+	"github.com/go-logr/logr"
+	"github.com/go-logr/zapr"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
+	"gopkg.in/natefinch/lumberjack.v2"
+	"k8s.io/klog/v2"
 )
 
-var logger *zap.SugaredLogger
+// Both loggers discard everything until Init, e.g. in tests.
+var (
+	logger = zap.NewNop().Sugar()
+
+	// plain is logger without the extra caller skip of the package level
+	// helpers, handed out to code that logs through it directly.
+	plain = zap.NewNop().Sugar()
+)
 
 type LevelLog = zapcore.Level
 
@@ -21,7 +32,39 @@ const (
 	LevelPanic  = zapcore.PanicLevel
 )
 
-func InitLog(level any) {
+const (
+	FormatConsole = "console"
+	FormatJSON    = "json"
+)
+
+type Options struct {
+	// Level is a level name or a LevelLog.
+	Level any
+	// Format is FormatConsole or FormatJSON.
+	Format string
+	// Writers default to stdout.
+	Writers []zapcore.WriteSyncer
+	// Fields are key value pairs on every entry, klog and logr ones too,
+	// e.g. the node this process runs on.
+	Fields []any
+
+	// File additionally writes logs to a size rotated file, for nodes
+	// without a log collector.
+	File           string
+	FileMaxSizeMB  int
+	FileMaxBackups int
+	FileMaxAgeDays int
+}
+
+// InitLog sets up the global logger, writing to stdout unless writers are
+// given.
+func InitLog(level any, writers ...zapcore.WriteSyncer) {
+	Init(Options{Level: level, Writers: writers})
+}
+
+// Init sets up the global logger and routes klog through it, so every
+// stream of the process shares one format.
+func Init(opts Options) {
 	encoderConfig := zapcore.EncoderConfig{
 		TimeKey:        "time",
 		LevelKey:       "level",
@@ -37,27 +80,67 @@ func InitLog(level any) {
 		EncodeName:     zapcore.FullNameEncoder,
 	}
 
-	var writers []zapcore.WriteSyncer
-	writers = append(writers, os.Stdout)
+	writers := opts.Writers
+	if len(writers) == 0 {
+		writers = append(writers, os.Stdout)
+	}
+	if opts.File != "" {
+		writers = append(writers, zapcore.AddSync(&lumberjack.Logger{
+			Filename:   opts.File,
+			MaxSize:    opts.FileMaxSizeMB,
+			MaxBackups: opts.FileMaxBackups,
+			MaxAge:     opts.FileMaxAgeDays,
+			Compress:   true,
+		}))
+	}
 
-	atomicLevel := zap.NewAtomicLevel()
 	var l zapcore.Level
-	switch v := level.(type) {
+	switch v := opts.Level.(type) {
 	case string:
 		l = getLevel(v)
 	case LevelLog:
 		l = v
 	}
-	atomicLevel.SetLevel(l)
-
-	core := zapcore.NewCore(
-		zapcore.NewConsoleEncoder(encoderConfig),
-		zapcore.NewMultiWriteSyncer(writers...),
-		atomicLevel,
-	)
-	logger = zap.New(core,
+	lv.global.SetLevel(l)
+	lv.configured = l
+
+	var encoder zapcore.Encoder
+	if opts.Format == FormatJSON {
+		encoder = zapcore.NewJSONEncoder(encoderConfig)
+	} else {
+		encoder = zapcore.NewConsoleEncoder(encoderConfig)
+	}
+
+	// the inner core accepts everything, levelCore applies the global and
+	// per component levels
+	core := &levelCore{
+		Core: zapcore.NewCore(
+			encoder,
+			zapcore.NewMultiWriteSyncer(writers...),
+			zapcore.DebugLevel,
+		),
+		levels: lv,
+	}
+	base := zap.New(core,
 		zap.AddCaller(), zap.Development(),
-		zap.AddCallerSkip(1), zap.AddStacktrace(zapcore.FatalLevel)).Sugar()
+		zap.AddStacktrace(zapcore.FatalLevel))
+	if len(opts.Fields) > 0 {
+		base = base.Sugar().With(opts.Fields...).Desugar()
+	}
+
+	setBase(base)
+	klog.SetLogger(zapr.NewLogger(base.Named("klog")))
+}
+
+func setBase(base *zap.Logger) {
+	plain = base.Sugar()
+	logger = base.WithOptions(zap.AddCallerSkip(1)).Sugar()
+}
+
+// Logr adapts the global logger for libraries using logr, such as
+// controller-runtime.
+func Logr() logr.Logger {
+	return zapr.NewLogger(plain.Desugar())
 }
 
 func getLevel(level string) (l zapcore.Level) {
@@ -0,0 +1,31 @@
+package log
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap/zapcore"
+	"k8s.io/klog/v2"
+)
+
+func TestInitFields(t *testing.T) {
+	var buf bytes.Buffer
+	Init(Options{Level: "info", Format: FormatJSON, Writers: []zapcore.WriteSyncer{zapcore.AddSync(&buf)},
+		Fields: []any{"node", "10.0.0.1"}})
+
+	Info("from the package")
+	Logr().Info("from logr")
+	klog.Info("from klog")
+	klog.Flush()
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("logged %q", buf.String())
+	}
+	for _, line := range lines {
+		if !strings.Contains(line, `"node":"10.0.0.1"`) {
+			t.Errorf("no node field in %s", line)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+// Package nonce generates and verifies the Terminus-Nonce header used to
+// authenticate calls between Olares system services.
+//
+// A nonce is the current unix timestamp encrypted with AES-CBC under the
+// shared APP_RANDOM_KEY. Two formats exist:
+//
+//	appservice:<base64(ciphertext)>        v1, the key doubles as IV
+//	appservice:v2:<base64(iv|ciphertext)>  v2, random IV per nonce
+//
+// v1 is kept so services can migrate one by one, Verify accepts both.
+package nonce
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	Prefix   = "appservice:"
+	v2Prefix = "v2:"
+
+	Version1 = 1
+	Version2 = 2
+
+	// EnvKey holds the shared AES key.
+	EnvKey = "APP_RANDOM_KEY"
+
+	DefaultSkew = 5 * time.Minute
+)
+
+var (
+	ErrMissingKey = errors.New("nonce key is empty")
+	ErrInvalidKey = errors.New("nonce key must be 16, 24 or 32 bytes")
+	ErrMalformed  = errors.New("malformed nonce")
+	ErrExpired    = errors.New("nonce timestamp is out of the allowed clock skew")
+)
+
+// ParseKey validates key is usable as an AES key.
+func ParseKey(key string) ([]byte, error) {
+	switch len(key) {
+	case 0:
+		return nil, ErrMissingKey
+	case 16, 24, 32:
+		return []byte(key), nil
+	}
+	return nil, fmt.Errorf("%w, got %d", ErrInvalidKey, len(key))
+}
+
+// KeyFromEnv reads and validates $APP_RANDOM_KEY.
+func KeyFromEnv() ([]byte, error) {
+	key, err := ParseKey(os.Getenv(EnvKey))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", EnvKey, err)
+	}
+	return key, nil
+}
+
+// Generator creates nonces with a fixed key.
+type Generator struct {
+	key     []byte
+	version int
+	rand    io.Reader
+	now     func() time.Time
+}
+
+type Option func(*Generator)
+
+// WithVersion selects the nonce format, Version2 by default.
+func WithVersion(version int) Option {
+	return func(g *Generator) {
+		g.version = version
+	}
+}
+
+// WithRand replaces the IV source, for tests.
+func WithRand(r io.Reader) Option {
+	return func(g *Generator) {
+		g.rand = r
+	}
+}
+
+// WithClock replaces time.Now.
+func WithClock(now func() time.Time) Option {
+	return func(g *Generator) {
+		g.now = now
+	}
+}
+
+func NewGenerator(key []byte, opts ...Option) (*Generator, error) {
+	if _, err := ParseKey(string(key)); err != nil {
+		return nil, err
+	}
+	g := &Generator{key: key, version: Version2, rand: rand.Reader, now: time.Now}
+	for _, opt := range opts {
+		opt(g)
+	}
+	if g.version != Version1 && g.version != Version2 {
+		return nil, fmt.Errorf("unknown nonce version %d", g.version)
+	}
+	return g, nil
+}
+
+// Generate returns a nonce for the current time.
+func (g *Generator) Generate() (string, error) {
+	timestamp := []byte(strconv.FormatInt(g.now().Unix(), 10))
+
+	if g.version == Version1 {
+		cipherText, err := encrypt(timestamp, g.key, g.key[:aes.BlockSize])
+		if err != nil {
+			return "", err
+		}
+		return Prefix + base64.StdEncoding.EncodeToString(cipherText), nil
+	}
+
+	iv := make([]byte, aes.BlockSize)
+	if _, err := io.ReadFull(g.rand, iv); err != nil {
+		return "", fmt.Errorf("read nonce iv: %w", err)
+	}
+	cipherText, err := encrypt(timestamp, g.key, iv)
+	if err != nil {
+		return "", err
+	}
+	return Prefix + v2Prefix + base64.StdEncoding.EncodeToString(append(iv, cipherText...)), nil
+}
+
+// Verify decrypts nonce and checks its timestamp is within skew of now.
+// It returns the timestamp carried by the nonce.
+func Verify(nonce string, key []byte, now time.Time, skew time.Duration) (time.Time, error) {
+	if _, err := ParseKey(string(key)); err != nil {
+		return time.Time{}, err
+	}
+	if !strings.HasPrefix(nonce, Prefix) {
+		return time.Time{}, ErrMalformed
+	}
+	payload := strings.TrimPrefix(nonce, Prefix)
+
+	var iv []byte
+	if strings.HasPrefix(payload, v2Prefix) {
+		payload = strings.TrimPrefix(payload, v2Prefix)
+	} else {
+		iv = key[:aes.BlockSize]
+	}
+
+	data, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		return time.Time{}, ErrMalformed
+	}
+	if iv == nil {
+		if len(data) < aes.BlockSize {
+			return time.Time{}, ErrMalformed
+		}
+		iv, data = data[:aes.BlockSize], data[aes.BlockSize:]
+	}
+
+	plain, err := decrypt(data, key, iv)
+	if err != nil {
+		return time.Time{}, err
+	}
+	secs, err := strconv.ParseInt(string(plain), 10, 64)
+	if err != nil {
+		return time.Time{}, ErrMalformed
+	}
+
+	ts := time.Unix(secs, 0)
+	if d := now.Sub(ts); d > skew || d < -skew {
+		return ts, ErrExpired
+	}
+	return ts, nil
+}
+
+func encrypt(origin, key, iv []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	origin = pkcs7Padding(origin, block.BlockSize())
+	crypted := make([]byte, len(origin))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(crypted, origin)
+	return crypted, nil
+}
+
+func decrypt(crypted, key, iv []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(crypted) == 0 || len(crypted)%block.BlockSize() != 0 {
+		return nil, ErrMalformed
+	}
+	plain := make([]byte, len(crypted))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, crypted)
+	return pkcs7Unpadding(plain, block.BlockSize())
+}
+
+func pkcs7Padding(text []byte, blockSize int) []byte {
+	padding := blockSize - len(text)%blockSize
+	return append(text, bytes.Repeat([]byte{byte(padding)}, padding)...)
+}
+
+func pkcs7Unpadding(text []byte, blockSize int) ([]byte, error) {
+	n := len(text)
+	if n == 0 {
+		return nil, ErrMalformed
+	}
+	padding := int(text[n-1])
+	if padding == 0 || padding > blockSize || padding > n {
+		return nil, ErrMalformed
+	}
+	for _, b := range text[n-padding:] {
+		if int(b) != padding {
+			return nil, ErrMalformed
+		}
+	}
+	return text[:n-padding], nil
+}
@@ -0,0 +1,96 @@
+package nonce
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+var (
+	testKey  = []byte("0123456789abcdef")
+	testTime = time.Unix(1700000000, 0)
+	testIV   = []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+)
+
+func TestGenerateKnownVectors(t *testing.T) {
+	clock := func() time.Time { return testTime }
+
+	cases := []struct {
+		version int
+		want    string
+	}{
+		{Version1, "appservice:QXRXZKW0A9bj1nLtGsZqtA=="},
+		{Version2, "appservice:v2:AAECAwQFBgcICQoLDA0OD0OcZWHlUIaxRfLjjniIW3w="},
+	}
+	for _, c := range cases {
+		g, err := NewGenerator(testKey, WithVersion(c.version), WithClock(clock),
+			WithRand(bytes.NewReader(testIV)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := g.Generate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != c.want {
+			t.Errorf("v%d: got %q, want %q", c.version, got, c.want)
+		}
+
+		ts, err := Verify(got, testKey, testTime.Add(time.Minute), DefaultSkew)
+		if err != nil || !ts.Equal(testTime) {
+			t.Errorf("v%d: verify %v, %v", c.version, ts, err)
+		}
+	}
+}
+
+func TestGenerateRandomIV(t *testing.T) {
+	g, err := NewGenerator(testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, _ := g.Generate()
+	b, _ := g.Generate()
+	if a == b {
+		t.Fatal("two nonces share the same iv")
+	}
+}
+
+func TestVerifyErrors(t *testing.T) {
+	g, _ := NewGenerator(testKey, WithClock(func() time.Time { return testTime }))
+	valid, _ := g.Generate()
+
+	cases := []struct {
+		name  string
+		nonce string
+		key   []byte
+		now   time.Time
+		want  error
+	}{
+		{"expired", valid, testKey, testTime.Add(DefaultSkew + time.Second), ErrExpired},
+		{"future", valid, testKey, testTime.Add(-DefaultSkew - time.Second), ErrExpired},
+		{"no prefix", "QXRXZKW0A9bj1nLtGsZqtA==", testKey, testTime, ErrMalformed},
+		{"bad base64", "appservice:v2:***", testKey, testTime, ErrMalformed},
+		{"short", "appservice:v2:AAEC", testKey, testTime, ErrMalformed},
+		{"wrong key", valid, []byte("fedcba9876543210"), testTime, ErrMalformed},
+		{"invalid key", valid, []byte("short"), testTime, ErrInvalidKey},
+	}
+	for _, c := range cases {
+		if _, err := Verify(c.nonce, c.key, c.now, DefaultSkew); !errors.Is(err, c.want) {
+			t.Errorf("%s: got %v, want %v", c.name, err, c.want)
+		}
+	}
+}
+
+func TestParseKey(t *testing.T) {
+	for _, key := range []string{"", "short", "0123456789abcdef0"} {
+		if _, err := ParseKey(key); err == nil {
+			t.Errorf("key %q should be rejected", key)
+		}
+	}
+	for _, n := range []int{16, 24, 32} {
+		if _, err := ParseKey(string(bytes.Repeat([]byte("k"), n))); err != nil {
+			t.Errorf("%d bytes key: %v", n, err)
+		}
+	}
+}
@@ -0,0 +1,256 @@
+// Package schedule runs a job repeatedly at times chosen by a Policy.
+//
+// The clock and the source of randomness are injectable, so when a job
+// runs can be tested without waiting for it.
+package schedule
+
+import (
+	"context"
+	"hash/fnv"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	"k8s.io/utils/clock"
+)
+
+// Outcome is the result of a run.
+type Outcome struct {
+	// Err is the error of the run, nil on success.
+	Err error
+	// ExpiresAt is when what the run produced expires, zero if unknown.
+	ExpiresAt time.Time
+	// NextHint is when the other side suggests to run next, e.g. a next
+	// refresh time sent by a server. Zero if there is none.
+	NextHint time.Time
+	// NotBefore is the earliest the next run may start, e.g. from a
+	// Retry-After header. Zero if there is none.
+	NotBefore time.Time
+	// Failures counts the runs that failed in a row, this one included.
+	// The Scheduler fills it in.
+	Failures int
+}
+
+// Policy decides when to run next. last is nil before the first run.
+type Policy interface {
+	Next(now time.Time, last *Outcome) time.Time
+}
+
+// PolicyFunc adapts a function to Policy.
+type PolicyFunc func(now time.Time, last *Outcome) time.Time
+
+func (f PolicyFunc) Next(now time.Time, last *Outcome) time.Time { return f(now, last) }
+
+// Cron runs at the times of a standard cron spec, e.g. "7 */8 * * *".
+func Cron(spec string) (Policy, error) {
+	s, err := cron.ParseStandard(spec)
+	if err != nil {
+		return nil, err
+	}
+	return PolicyFunc(func(now time.Time, _ *Outcome) time.Time { return s.Next(now) }), nil
+}
+
+// Spread runs once every Interval, Offset into each interval counted
+// from the unix epoch. Deriving Offset from a stable id with OffsetOf
+// spreads the runs of many installs evenly, independent of when each
+// of them started.
+type Spread struct {
+	Interval time.Duration
+	Offset   time.Duration
+}
+
+func (p Spread) Next(now time.Time, _ *Outcome) time.Time {
+	interval := int64(p.Interval)
+	start := now.UnixNano() - now.UnixNano()%interval
+	next := time.Unix(0, start+int64(p.Offset)%interval).In(now.Location())
+	if !next.After(now) {
+		next = next.Add(p.Interval)
+	}
+	return next
+}
+
+// OffsetOf hashes id to an offset in [0, interval).
+func OffsetOf(id string, interval time.Duration) time.Duration {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(id))
+	return time.Duration(h.Sum64() % uint64(interval))
+}
+
+// RandomOffset returns a random offset in [0, interval), for when there
+// is no stable id to use OffsetOf with.
+func RandomOffset(interval time.Duration) time.Duration {
+	return time.Duration(random() * float64(interval))
+}
+
+var (
+	randMu sync.Mutex
+	// math/rand is not seeded by default, every install would share the
+	// same sequence
+	rnd = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+func random() float64 {
+	randMu.Lock()
+	defer randMu.Unlock()
+	return rnd.Float64()
+}
+
+// Refresh adds to a Base policy what renewing something that expires
+// needs: an earlier run before it expires, backoff after failures,
+// jitter, and the hints of the server it renews from.
+type Refresh struct {
+	Base Policy
+	// RefreshBefore runs this long before the last outcome expires, when
+	// that is sooner than Base.
+	RefreshBefore time.Duration
+	// MinBackoff is the delay after the first failure. It doubles with
+	// each failure in a row up to MaxBackoff.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// Jitter delays each run by up to this much.
+	Jitter time.Duration
+	// Rand returns a number in [0, 1), a randomly seeded source by default.
+	Rand func() float64
+}
+
+// Next returns the earliest of the Base run, or the NextHint of last
+// when there is one, and the renewal before last expires. After a failure
+// it backs off instead. The jittered result is never before NotBefore.
+func (p *Refresh) Next(now time.Time, last *Outcome) time.Time {
+	var next time.Time
+	switch {
+	case last != nil && last.Err != nil && p.MinBackoff > 0:
+		next = now.Add(p.backoff(last.Failures))
+	default:
+		next = p.Base.Next(now, last)
+		if last != nil && !last.NextHint.IsZero() {
+			next = last.NextHint
+		}
+		if last != nil && !last.ExpiresAt.IsZero() {
+			if renew := last.ExpiresAt.Add(-p.RefreshBefore); renew.Before(next) {
+				next = renew
+			}
+		}
+	}
+	if next.Before(now) {
+		next = now
+	}
+
+	next = next.Add(p.jitter())
+	if last != nil && next.Before(last.NotBefore) {
+		next = last.NotBefore
+	}
+	return next
+}
+
+func (p *Refresh) backoff(failures int) time.Duration {
+	d := p.MinBackoff
+	for i := 1; i < failures; i++ {
+		d *= 2
+		if p.MaxBackoff > 0 && d >= p.MaxBackoff {
+			return p.MaxBackoff
+		}
+	}
+	return d
+}
+
+func (p *Refresh) jitter() time.Duration {
+	if p.Jitter <= 0 {
+		return 0
+	}
+	r := random
+	if p.Rand != nil {
+		r = p.Rand
+	}
+	return time.Duration(r() * float64(p.Jitter))
+}
+
+// Job is what a Scheduler runs.
+type Job func(ctx context.Context) Outcome
+
+// Scheduler runs a Job at the times its Policy chooses. It implements
+// manager.Runnable.
+type Scheduler struct {
+	policy Policy
+	job    Job
+	clock  clock.Clock
+
+	mu   sync.Mutex
+	next time.Time
+	last *Outcome
+}
+
+type Option func(*Scheduler)
+
+// WithClock replaces the real clock.
+func WithClock(c clock.Clock) Option {
+	return func(s *Scheduler) {
+		s.clock = c
+	}
+}
+
+func New(policy Policy, job Job, opts ...Option) *Scheduler {
+	s := &Scheduler{policy: policy, job: job, clock: clock.RealClock{}}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Start runs the job until ctx is done.
+func (s *Scheduler) Start(ctx context.Context) error {
+	for {
+		s.mu.Lock()
+		next := s.policy.Next(s.clock.Now(), s.last)
+		s.next = next
+		s.mu.Unlock()
+
+		timer := s.clock.NewTimer(next.Sub(s.clock.Now()))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
+		case <-timer.C():
+		}
+
+		s.mu.Lock()
+		s.next = time.Time{}
+		s.mu.Unlock()
+
+		outcome := s.job(ctx)
+		s.mu.Lock()
+		if outcome.Err != nil {
+			if s.last != nil {
+				outcome.Failures = s.last.Failures
+			}
+			outcome.Failures++
+		}
+		s.last = &outcome
+		s.mu.Unlock()
+	}
+}
+
+// NeedLeaderElection is false, every node schedules its own job.
+func (s *Scheduler) NeedLeaderElection() bool {
+	return false
+}
+
+// Next returns when the job runs next, zero before Start and while the
+// job runs.
+func (s *Scheduler) Next() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.next
+}
+
+// Last returns the outcome of the last run, nil before the first one.
+func (s *Scheduler) Last() *Outcome {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.last == nil {
+		return nil
+	}
+	last := *s.last
+	return &last
+}
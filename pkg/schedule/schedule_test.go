@@ -0,0 +1,176 @@
+package schedule
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	clocktesting "k8s.io/utils/clock/testing"
+)
+
+var t0 = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func every(d time.Duration) Policy {
+	return PolicyFunc(func(now time.Time, _ *Outcome) time.Time { return now.Add(d) })
+}
+
+func TestRefreshNext(t *testing.T) {
+	p := &Refresh{
+		Base:          every(8 * time.Hour),
+		RefreshBefore: time.Hour,
+		MinBackoff:    time.Minute,
+		MaxBackoff:    10 * time.Minute,
+	}
+	failed := errors.New("failed")
+
+	tests := []struct {
+		name string
+		last *Outcome
+		want time.Duration
+	}{
+		{name: "first run", want: 8 * time.Hour},
+		{name: "no expiry", last: &Outcome{}, want: 8 * time.Hour},
+		{name: "expires after base", last: &Outcome{ExpiresAt: t0.Add(12 * time.Hour)}, want: 8 * time.Hour},
+		{name: "expires before base", last: &Outcome{ExpiresAt: t0.Add(3 * time.Hour)}, want: 2 * time.Hour},
+		{name: "expires now", last: &Outcome{ExpiresAt: t0.Add(30 * time.Minute)}, want: 0},
+		{name: "first failure", last: &Outcome{Err: failed, Failures: 1}, want: time.Minute},
+		{name: "third failure", last: &Outcome{Err: failed, Failures: 3}, want: 4 * time.Minute},
+		{name: "backoff capped", last: &Outcome{Err: failed, Failures: 10}, want: 10 * time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := p.Next(t0, tt.last).Sub(t0); got != tt.want {
+				t.Fatalf("next in %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// server hints
+	hinted := []struct {
+		name string
+		last *Outcome
+		want time.Duration
+	}{
+		{name: "next hint", last: &Outcome{NextHint: t0.Add(5 * time.Hour)}, want: 5 * time.Hour},
+		{name: "hint after expiry", last: &Outcome{NextHint: t0.Add(20 * time.Hour), ExpiresAt: t0.Add(12 * time.Hour)},
+			want: 11 * time.Hour},
+		{name: "retry after", last: &Outcome{Err: failed, Failures: 1, NotBefore: t0.Add(30 * time.Minute)},
+			want: 30 * time.Minute},
+		{name: "retry after shorter than backoff", last: &Outcome{Err: failed, Failures: 3, NotBefore: t0.Add(time.Second)},
+			want: 4 * time.Minute},
+	}
+	for _, tt := range hinted {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := p.Next(t0, tt.last).Sub(t0); got != tt.want {
+				t.Fatalf("next in %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	p.Jitter, p.Rand = 10*time.Minute, func() float64 { return 0.5 }
+	if got := p.Next(t0, nil).Sub(t0); got != 8*time.Hour+5*time.Minute {
+		t.Fatalf("jittered next in %v", got)
+	}
+}
+
+func TestSpread(t *testing.T) {
+	p := Spread{Interval: 8 * time.Hour, Offset: 3*time.Hour + 7*time.Minute}
+
+	for _, tt := range []struct{ now, want time.Time }{
+		{t0, t0.Add(3*time.Hour + 7*time.Minute)},
+		{t0.Add(3*time.Hour + 7*time.Minute), t0.Add(11*time.Hour + 7*time.Minute)},
+		{t0.Add(23 * time.Hour), t0.Add(27*time.Hour + 7*time.Minute)},
+	} {
+		if got := p.Next(tt.now, nil); !got.Equal(tt.want) {
+			t.Errorf("next after %v = %v, want %v", tt.now, got, tt.want)
+		}
+	}
+
+	if OffsetOf("cluster-a", time.Hour) != OffsetOf("cluster-a", time.Hour) {
+		t.Fatal("offset is not stable")
+	}
+	// ids spread over the whole interval
+	buckets := map[time.Duration]bool{}
+	for i := 0; i < 200; i++ {
+		offset := OffsetOf(fmt.Sprintf("cluster-%d", i), 8*time.Hour)
+		if offset < 0 || offset >= 8*time.Hour {
+			t.Fatalf("offset %v out of range", offset)
+		}
+		buckets[offset/time.Hour] = true
+	}
+	if len(buckets) != 8 {
+		t.Fatalf("offsets only fall into %d of 8 hours", len(buckets))
+	}
+}
+
+func TestCron(t *testing.T) {
+	p, err := Cron("7 */8 * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := p.Next(t0.Add(time.Hour), nil); !got.Equal(t0.Add(8*time.Hour + 7*time.Minute)) {
+		t.Fatalf("next = %v", got)
+	}
+	if _, err = Cron("not a spec"); err == nil {
+		t.Fatal("invalid spec should fail")
+	}
+}
+
+func TestScheduler(t *testing.T) {
+	clk := clocktesting.NewFakeClock(t0)
+	runs := make(chan time.Time)
+	results := []Outcome{{Err: errors.New("failed")}, {Err: errors.New("failed")}, {}}
+
+	s := New(&Refresh{Base: every(time.Hour), MinBackoff: time.Minute}, func(ctx context.Context) Outcome {
+		runs <- clk.Now()
+		outcome := results[0]
+		results = results[1:]
+		return outcome
+	}, WithClock(clk))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- s.Start(ctx) }()
+
+	// step waits for the scheduler to wait on its timer, then fires it
+	step := func(d time.Duration) time.Time {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for !clk.HasWaiters() {
+			if time.Now().After(deadline) {
+				t.Fatal("scheduler is not waiting")
+			}
+			time.Sleep(time.Millisecond)
+		}
+		clk.Step(d)
+		return <-runs
+	}
+
+	if at := step(time.Hour); !at.Equal(t0.Add(time.Hour)) {
+		t.Fatalf("first run at %v", at)
+	}
+	// failures back off, 1m then 2m
+	if at := step(time.Minute); !at.Equal(t0.Add(61 * time.Minute)) {
+		t.Fatalf("retry at %v", at)
+	}
+	if at := step(2 * time.Minute); !at.Equal(t0.Add(63 * time.Minute)) {
+		t.Fatalf("second retry at %v", at)
+	}
+	if last := s.Last(); last == nil || last.Err != nil || last.Failures != 0 {
+		t.Fatalf("last = %+v", last)
+	}
+
+	for !clk.HasWaiters() {
+		time.Sleep(time.Millisecond)
+	}
+	if next := s.Next(); !next.Equal(t0.Add(123 * time.Minute)) {
+		t.Fatalf("next = %v", next)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,266 @@
+package task
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"bytetrade.io/web3os/osnode-init/pkg/log"
+	"bytetrade.io/web3os/osnode-init/pkg/tracing"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+var (
+	ErrDuplicate = errors.New("task is already registered")
+	ErrUnknown   = errors.New("unknown task")
+	ErrCycle     = errors.New("task dependencies form a cycle")
+)
+
+// Registry holds the tasks of this node.
+type Registry struct {
+	mu     sync.Mutex
+	tasks  map[string]Task
+	status map[string]*Status
+	// applied is true for tasks which ran, so Cleanup is due once they stop
+	// applying.
+	applied map[string]bool
+}
+
+func NewRegistry() *Registry {
+	return &Registry{tasks: map[string]Task{}, status: map[string]*Status{}, applied: map[string]bool{}}
+}
+
+// Register adds t, dependencies are checked when the tasks are run.
+func (r *Registry) Register(t Task) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.tasks[t.Name()]; ok {
+		return errors.Wrap(ErrDuplicate, t.Name())
+	}
+	r.tasks[t.Name()] = t
+	r.status[t.Name()] = &Status{Name: t.Name(), DependsOn: t.DependsOn(), State: StatePending}
+	return nil
+}
+
+// MustRegister is Register for tasks known at build time.
+func (r *Registry) MustRegister(tasks ...Task) {
+	for _, t := range tasks {
+		if err := r.Register(t); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// Ordered returns the tasks sorted so that every task comes after its
+// dependencies, ties are broken by name.
+func (r *Registry) Ordered() ([]Task, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.ordered()
+}
+
+func (r *Registry) ordered() ([]Task, error) {
+	names := make([]string, 0, len(r.tasks))
+	for name := range r.tasks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	const (
+		visiting = 1
+		done     = 2
+	)
+	marks := map[string]int{}
+	var ordered []Task
+
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		switch marks[name] {
+		case done:
+			return nil
+		case visiting:
+			return errors.Wrapf(ErrCycle, "%v", append(path, name))
+		}
+		t, ok := r.tasks[name]
+		if !ok {
+			return errors.Wrapf(ErrUnknown, "%s, required by %s", name, path[len(path)-1])
+		}
+
+		marks[name] = visiting
+		deps := append([]string(nil), t.DependsOn()...)
+		sort.Strings(deps)
+		for _, dep := range deps {
+			if err := visit(dep, append(path, name)); err != nil {
+				return err
+			}
+		}
+		marks[name] = done
+		ordered = append(ordered, t)
+		return nil
+	}
+
+	for _, name := range names {
+		if err := visit(name, nil); err != nil {
+			return nil, err
+		}
+	}
+	return ordered, nil
+}
+
+// RunAll runs every task which is not Scheduled, in dependency order. A
+// task whose dependency did not succeed is Blocked and not run. The joined
+// errors of the failed tasks are returned.
+func (r *Registry) RunAll(ctx context.Context, node *Node) error {
+	tasks, err := r.Ordered()
+	if err != nil {
+		return err
+	}
+
+	var failed []string
+	for _, t := range tasks {
+		if s, ok := t.(Scheduled); ok && s.Scheduled() {
+			continue
+		}
+		if err := r.run(ctx, t, node); err != nil && !errors.Is(err, errBlocked) {
+			failed = append(failed, fmt.Sprintf("%s: %v", t.Name(), err))
+		}
+	}
+	if len(failed) > 0 {
+		return errors.Errorf("tasks failed, %v", failed)
+	}
+	return nil
+}
+
+// Run runs the task name alone, e.g. from its schedule or on demand. Its
+// dependencies must have succeeded before.
+func (r *Registry) Run(ctx context.Context, name string, node *Node) error {
+	r.mu.Lock()
+	t, ok := r.tasks[name]
+	r.mu.Unlock()
+	if !ok {
+		return errors.Wrap(ErrUnknown, name)
+	}
+	return r.run(ctx, t, node)
+}
+
+var errBlocked = errors.New("blocked")
+
+func (r *Registry) run(ctx context.Context, t Task, node *Node) (err error) {
+	name := t.Name()
+	logger := log.FromContext(ctx).With("task", name)
+
+	if !t.AppliesTo(node) {
+		r.mu.Lock()
+		applied := r.applied[name]
+		delete(r.applied, name)
+		r.mu.Unlock()
+
+		if applied {
+			logger.Info("task does not apply to this node anymore, clean up")
+			err = t.Cleanup(ctx, node)
+		}
+		r.finish(name, StateNotApplicable, time.Time{}, err)
+		return err
+	}
+
+	if blocker := r.blockedBy(t); blocker != "" {
+		r.finish(name, StateBlocked, time.Time{}, errors.Errorf("dependency %s has not succeeded", blocker))
+		return errBlocked
+	}
+
+	ctx, span := tracing.Start(ctx, "task "+name, attribute.String("task", name))
+	defer func() { tracing.End(span, err) }()
+
+	start := time.Now()
+	r.mu.Lock()
+	r.applied[name] = true
+	r.mu.Unlock()
+
+	if err = t.Run(ctx, node); err != nil {
+		logger.Errorf("task failed, %v", err)
+		r.finish(name, StateFailed, start, err)
+		return err
+	}
+	r.finish(name, StateSucceeded, start, nil)
+	return nil
+}
+
+func (r *Registry) blockedBy(t Task) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, dep := range t.DependsOn() {
+		if s, ok := r.status[dep]; !ok || s.State != StateSucceeded {
+			return dep
+		}
+	}
+	return ""
+}
+
+func (r *Registry) finish(name string, state State, start time.Time, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s := r.status[name]
+	s.State, s.Error = state, ""
+	if err != nil {
+		s.Error = err.Error()
+	}
+	if !start.IsZero() {
+		s.LastRun, s.Duration = &start, time.Since(start).Round(time.Millisecond).String()
+	}
+}
+
+// VerifyAll runs Verify of every task that applies to node, and records
+// the drift found.
+func (r *Registry) VerifyAll(ctx context.Context, node *Node) []Status {
+	tasks, err := r.Ordered()
+	if err != nil {
+		return nil
+	}
+	for _, t := range tasks {
+		if !t.AppliesTo(node) {
+			continue
+		}
+		drift := t.Verify(ctx, node)
+
+		r.mu.Lock()
+		s := r.status[t.Name()]
+		s.Drift = ""
+		if drift != nil {
+			s.Drift = drift.Error()
+		}
+		r.mu.Unlock()
+	}
+	return r.Statuses()
+}
+
+// Statuses returns a copy of the task statuses, in dependency order.
+func (r *Registry) Statuses() []Status {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	tasks, err := r.ordered()
+	if err != nil {
+		// keep the status readable with a broken dependency graph
+		tasks = nil
+		for _, t := range r.tasks {
+			tasks = append(tasks, t)
+		}
+		sort.Slice(tasks, func(i, j int) bool { return tasks[i].Name() < tasks[j].Name() })
+	}
+
+	statuses := make([]Status, 0, len(tasks))
+	for _, t := range tasks {
+		s := *r.status[t.Name()]
+		if s.LastRun != nil {
+			lastRun := *s.LastRun
+			s.LastRun = &lastRun
+		}
+		statuses = append(statuses, s)
+	}
+	return statuses
+}
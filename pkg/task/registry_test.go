@@ -0,0 +1,114 @@
+package task
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+type fakeTask struct {
+	Base
+	name    string
+	deps    []string
+	applies bool
+	err     error
+
+	runs, cleanups int
+}
+
+func (f *fakeTask) Name() string                     { return f.name }
+func (f *fakeTask) DependsOn() []string              { return f.deps }
+func (f *fakeTask) AppliesTo(*Node) bool             { return f.applies }
+func (f *fakeTask) Run(context.Context, *Node) error { f.runs++; return f.err }
+func (f *fakeTask) Cleanup(context.Context, *Node) error {
+	f.cleanups++
+	return nil
+}
+
+func newFake(name string, deps ...string) *fakeTask {
+	return &fakeTask{name: name, deps: deps, applies: true}
+}
+
+func TestOrdered(t *testing.T) {
+	r := NewRegistry()
+	r.MustRegister(newFake("c", "b"), newFake("a"), newFake("b", "a"), newFake("d"))
+
+	tasks, err := r.Ordered()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, task := range tasks {
+		names = append(names, task.Name())
+	}
+	if got, want := names, []string{"a", "b", "c", "d"}; len(got) != len(want) ||
+		got[0] != want[0] || got[1] != want[1] || got[2] != want[2] || got[3] != want[3] {
+		t.Fatalf("order = %v, want %v", got, want)
+	}
+}
+
+func TestOrderedErrors(t *testing.T) {
+	r := NewRegistry()
+	r.MustRegister(newFake("a", "b"), newFake("b", "a"))
+	if _, err := r.Ordered(); !errors.Is(err, ErrCycle) {
+		t.Fatalf("err = %v, want ErrCycle", err)
+	}
+
+	r = NewRegistry()
+	r.MustRegister(newFake("a", "missing"))
+	if _, err := r.Ordered(); !errors.Is(err, ErrUnknown) {
+		t.Fatalf("err = %v, want ErrUnknown", err)
+	}
+
+	if err := r.Register(newFake("a")); !errors.Is(err, ErrDuplicate) {
+		t.Fatalf("err = %v, want ErrDuplicate", err)
+	}
+}
+
+func TestRunAll(t *testing.T) {
+	base := newFake("base")
+	base.err = errors.New("boom")
+	dependent := newFake("dependent", "base")
+	other := newFake("other")
+
+	r := NewRegistry()
+	r.MustRegister(base, dependent, other)
+
+	node := &Node{}
+	if err := r.RunAll(context.Background(), node); err == nil {
+		t.Fatal("want the error of base")
+	}
+	if dependent.runs != 0 || other.runs != 1 {
+		t.Fatalf("runs: dependent %d, other %d", dependent.runs, other.runs)
+	}
+
+	states := map[string]State{}
+	for _, s := range r.Statuses() {
+		states[s.Name] = s.State
+	}
+	if states["base"] != StateFailed || states["dependent"] != StateBlocked || states["other"] != StateSucceeded {
+		t.Fatalf("states = %v", states)
+	}
+
+	base.err = nil
+	if err := r.RunAll(context.Background(), node); err != nil {
+		t.Fatal(err)
+	}
+	if dependent.runs != 1 {
+		t.Fatalf("dependent should run once base succeeded, runs %d", dependent.runs)
+	}
+
+	other.applies = false
+	if err := r.RunAll(context.Background(), node); err != nil {
+		t.Fatal(err)
+	}
+	if other.cleanups != 1 {
+		t.Fatalf("other should be cleaned up once, cleanups %d", other.cleanups)
+	}
+	if err := r.RunAll(context.Background(), node); err != nil {
+		t.Fatal(err)
+	}
+	if other.cleanups != 1 {
+		t.Fatalf("other should be cleaned up once, cleanups %d", other.cleanups)
+	}
+}
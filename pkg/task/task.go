@@ -0,0 +1,76 @@
+// Package task runs the node initialization steps. Each step is a Task,
+// tasks are kept in a Registry which runs them in dependency order and
+// keeps the status of each.
+package task
+
+import (
+	"context"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Node is the node the tasks run on.
+type Node struct {
+	IP     string
+	Master bool
+	// Object is the Node as last seen, it is nil before the first reconcile.
+	Object *corev1.Node
+}
+
+// Task is a node initialization step.
+type Task interface {
+	// Name is unique within a Registry, e.g. "data-dirs".
+	Name() string
+	// DependsOn names the tasks that must succeed before this one runs.
+	DependsOn() []string
+	// AppliesTo reports whether the task runs on node at all.
+	AppliesTo(node *Node) bool
+	// Run brings the node to the state the task wants, it must be safe to
+	// call again when the state is already reached.
+	Run(ctx context.Context, node *Node) error
+	// Verify checks the state without changing anything, a non nil error
+	// describes the drift.
+	Verify(ctx context.Context, node *Node) error
+	// Cleanup undoes what Run did, when the task stopped applying to node.
+	Cleanup(ctx context.Context, node *Node) error
+}
+
+// Scheduled is implemented by tasks which run on their own schedule, e.g.
+// from cron, instead of on every reconcile.
+type Scheduled interface {
+	Scheduled() bool
+}
+
+// Base implements the optional parts of Task, tasks embed it and only
+// override what they need.
+type Base struct{}
+
+func (Base) DependsOn() []string                  { return nil }
+func (Base) AppliesTo(*Node) bool                 { return true }
+func (Base) Verify(context.Context, *Node) error  { return nil }
+func (Base) Cleanup(context.Context, *Node) error { return nil }
+
+type State string
+
+const (
+	StatePending   State = "Pending"
+	StateSucceeded State = "Succeeded"
+	StateFailed    State = "Failed"
+	// StateBlocked means a dependency did not succeed.
+	StateBlocked State = "Blocked"
+	// StateNotApplicable means AppliesTo is false on this node.
+	StateNotApplicable State = "NotApplicable"
+)
+
+// Status of a task on this node.
+type Status struct {
+	Name      string     `json:"name"`
+	DependsOn []string   `json:"dependsOn,omitempty"`
+	State     State      `json:"state"`
+	LastRun   *time.Time `json:"lastRun,omitempty"`
+	Duration  string     `json:"duration,omitempty"`
+	Error     string     `json:"error,omitempty"`
+	// Drift is the last error of Verify, if it found any.
+	Drift string `json:"drift,omitempty"`
+}
@@ -0,0 +1,109 @@
+// Package tracing sets up OpenTelemetry tracing. Until Init is called with
+// an endpoint, every span is a no-op.
+package tracing
+
+import (
+	"context"
+	"os"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	instrumentationName = "bytetrade.io/web3os/osnode-init"
+
+	// EnvEndpoint is the standard OTLP endpoint variable, used when no
+	// endpoint flag is given.
+	EnvEndpoint = "OTEL_EXPORTER_OTLP_ENDPOINT"
+)
+
+type Options struct {
+	// Endpoint of the OTLP/HTTP collector, e.g. localhost:4318. When empty
+	// $OTEL_EXPORTER_OTLP_ENDPOINT is used, tracing stays disabled without
+	// either.
+	Endpoint string
+	// Insecure sends spans over plain HTTP, the usual setup for a collector
+	// running next to the pod.
+	Insecure bool
+	// SampleRatio of root spans to record, 1 records all.
+	SampleRatio float64
+	// Attributes are added to the resource of every span, e.g. the node.
+	Attributes []attribute.KeyValue
+}
+
+// Init installs the global tracer provider and the W3C trace context
+// propagator. The returned func flushes pending spans, call it on exit.
+func Init(ctx context.Context, opts Options) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{}))
+
+	if opts.Endpoint == "" && os.Getenv(EnvEndpoint) == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	var exporterOpts []otlptracehttp.Option
+	if opts.Endpoint != "" {
+		// the exporter reads the environment on its own otherwise
+		exporterOpts = append(exporterOpts, otlptracehttp.WithEndpoint(opts.Endpoint))
+	}
+	if opts.Insecure {
+		exporterOpts = append(exporterOpts, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(ctx, exporterOpts...)
+	if err != nil {
+		return nil, errors.Errorf("create otlp exporter, %v", err)
+	}
+
+	attrs := append([]attribute.KeyValue{semconv.ServiceNameKey.String("osnode-init")}, opts.Attributes...)
+	if host, err := os.Hostname(); err == nil {
+		attrs = append(attrs, semconv.HostNameKey.String(host))
+	}
+	res := resource.NewWithAttributes(semconv.SchemaURL, attrs...)
+
+	ratio := opts.SampleRatio
+	if ratio <= 0 || ratio > 1 {
+		ratio = 1
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+	)
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
+
+// Start starts a span named name as a child of the span in ctx.
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentationName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End records err on span, if any, and ends it. It is meant to be deferred
+// with a named error result: defer func() { tracing.End(span, err) }().
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// InjectResty propagates the trace context of each request's context in
+// its headers.
+func InjectResty(client *resty.Client) *resty.Client {
+	return client.OnBeforeRequest(func(_ *resty.Client, req *resty.Request) error {
+		otel.GetTextMapPropagator().Inject(req.Context(), propagation.HeaderCarrier(req.Header))
+		return nil
+	})
+}